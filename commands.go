@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+const usage = `usage: routy [command]
+
+Without a command routy starts the proxy.
+
+Commands:
+  certs                 list the certificates in the certs cache and when they expire
+  cache purge [prefix]  remove cached responses whose host and path start with prefix,
+                        e.g. example.com/assets/, or every cached response
+`
+
+// runCommand runs a CLI subcommand instead of starting the proxy.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "certs":
+		return listCerts()
+	case "cache":
+		if len(args) < 2 || args[1] != "purge" {
+			return fmt.Errorf("usage: routy cache purge [prefix]")
+		}
+
+		prefix := ""
+		if len(args) > 2 {
+			prefix = args[2]
+		}
+
+		return purgeCache(prefix)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", args[0], usage)
+	}
+}
+
+func listCerts() error {
+	certs, err := models.GetCertificates()
+	if err != nil {
+		return err
+	}
+
+	if len(certs) == 0 {
+		fmt.Println("No certificates found.")
+		return nil
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NAME\tDNS NAMES\tISSUER\tEXPIRES\tDAYS LEFT")
+
+	for _, c := range certs {
+		_, _ = fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%d\n",
+			c.Name,
+			strings.Join(c.DNSNames, ","),
+			c.Issuer,
+			c.NotAfter.Format(time.RFC3339),
+			c.DaysRemaining(now),
+		)
+	}
+
+	return w.Flush()
+}
+
+// purgeCache asks the running instance to purge its response cache through
+// the local status endpoint.
+func purgeCache(prefix string) error {
+	routes, err := models.GetDomainRoutes()
+	if err != nil {
+		return err
+	}
+
+	u := url.URL{
+		Scheme:   "http",
+		Host:     routes.StatusAddress(),
+		Path:     "/cache/purge",
+		RawQuery: url.Values{"prefix": {prefix}}.Encode(),
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(u.String(), "", nil)
+	if err != nil {
+		return fmt.Errorf("failed to reach the status endpoint: %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("purge failed: %s", resp.Status)
+	}
+
+	var result struct {
+		Purged int `json:"purged"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+
+	fmt.Printf("Purged %d cached responses.\n", result.Purged)
+
+	return nil
+}
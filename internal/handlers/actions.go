@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+// newRedirectHandler returns a handler that redirects to the templated
+// destination in cfg.
+func newRedirectHandler(cfg *models.Redirect) (http.Handler, error) {
+	status := cfg.Status
+	if status == 0 {
+		status = http.StatusFound
+	}
+
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, fmt.Errorf("unsupported redirect status %d", status)
+	}
+
+	if cfg.To == "" {
+		return nil, fmt.Errorf("redirect destination is required")
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, expandRedirect(cfg.To, req), status)
+	}), nil
+}
+
+// expandRedirect fills the placeholders in a redirect template from req.
+// {apex} is the host without a leading "www." and {www} is the host with one.
+func expandRedirect(to string, req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+
+	host := hostWithoutPort(req.Host)
+	apex := strings.TrimPrefix(host, "www.")
+
+	uri := req.URL.EscapedPath()
+	if req.URL.RawQuery != "" {
+		uri += "?" + req.URL.RawQuery
+	}
+
+	return strings.NewReplacer(
+		"{scheme}", scheme,
+		"{host}", host,
+		"{apex}", apex,
+		"{www}", "www."+apex,
+		"{path}", req.URL.EscapedPath(),
+		"{query}", req.URL.RawQuery,
+		"{uri}", uri,
+	).Replace(to)
+}
+
+// newRespondHandler returns a handler that writes the fixed response in cfg.
+func newRespondHandler(cfg *models.Respond) http.Handler {
+	status := cfg.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	contentType := cfg.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for k, v := range cfg.Headers {
+			w.Header().Set(k, v)
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+
+		if req.Method != http.MethodHead {
+			_, _ = w.Write([]byte(cfg.Body))
+		}
+	})
+}
+
+// fallbackHandler returns the catch-all handler for requests to hosts routy
+// has no routes for, or nil when no fallback is configured.
+func (r *Routy) fallbackHandler() (http.Handler, error) {
+	if r.routes.Fallback == nil {
+		return nil, nil
+	}
+
+	return r.pathHandler(models.Domain{}, models.Subdomain{}, *r.routes.Fallback)
+}
+
+// isKnownHost reports whether host is one of the configured hostnames.
+func (r *Routy) isKnownHost(host string) bool {
+	host = hostWithoutPort(host)
+	for _, h := range r.hostnames {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// httpRedirectHandler redirects known hosts to https and sends requests for
+// unknown hosts to the fallback.
+func (r *Routy) httpRedirectHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.isKnownHost(req.Host) {
+			r.serveFallback(fallback, w, req)
+			return
+		}
+
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			http.Error(w, "Use HTTPS", http.StatusBadRequest)
+			return
+		}
+
+		http.Redirect(w, req, "https://"+hostWithoutPort(req.Host)+req.URL.RequestURI(), http.StatusFound)
+	})
+}
+
+func (r *Routy) serveFallback(fallback http.Handler, w http.ResponseWriter, req *http.Request) {
+	req = r.requestIDs.assign(w, req)
+
+	req, span := r.tracing.startRequest(req, "fallback")
+	defer span.End()
+	w = r.tracing.writer(w, span)
+
+	if r.isDenied(req) {
+		return
+	}
+
+	req = r.geoIP.annotate(req)
+	r.accessLog <- req
+
+	if !r.limits.requestLimits(nil).apply(w, req) {
+		return
+	}
+
+	fallback.ServeHTTP(w, req)
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+func TestExpandRedirect(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		to     string
+		target string
+		tls    bool
+		want   string
+	}{
+		{
+			name:   "path preserving",
+			to:     "https://new.example.com{uri}",
+			target: "http://old.example.com/a/b?c=d",
+			want:   "https://new.example.com/a/b?c=d",
+		},
+		{
+			name:   "www to apex",
+			to:     "{scheme}://{apex}{path}",
+			target: "https://www.example.com/x",
+			tls:    true,
+			want:   "https://example.com/x",
+		},
+		{
+			name:   "apex to www",
+			to:     "https://{www}{uri}",
+			target: "http://example.com:8080/",
+			want:   "https://www.example.com/",
+		},
+		{
+			name:   "query only",
+			to:     "https://{host}/search?{query}",
+			target: "http://example.com/find?q=1",
+			want:   "https://example.com/search?q=1",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			} else {
+				req.TLS = nil
+			}
+			if got := expandRedirect(tt.to, req); got != tt.want {
+				t.Fatalf("expandRedirect() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRedirectHandler(t *testing.T) {
+	t.Parallel()
+
+	if _, err := newRedirectHandler(&models.Redirect{To: "https://example.com", Status: 200}); err == nil {
+		t.Fatalf("expected error for non-redirect status")
+	}
+	if _, err := newRedirectHandler(&models.Redirect{}); err == nil {
+		t.Fatalf("expected error for missing destination")
+	}
+
+	h, err := newRedirectHandler(&models.Redirect{To: "https://example.com{uri}", Status: http.StatusPermanentRedirect})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://old.example.com/p", nil))
+
+	if rec.Code != http.StatusPermanentRedirect {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusPermanentRedirect)
+	}
+	if got := rec.Header().Get("Location"); got != "https://example.com/p" {
+		t.Fatalf("location = %q", got)
+	}
+}
+
+func TestNewRespondHandler(t *testing.T) {
+	t.Parallel()
+
+	h := newRespondHandler(&models.Respond{
+		Status:      http.StatusServiceUnavailable,
+		Body:        `{"status":"maintenance"}`,
+		ContentType: "application/json",
+		Headers:     map[string]string{"Retry-After": "120"},
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	if rec.Body.String() != `{"status":"maintenance"}` {
+		t.Fatalf("body = %q", rec.Body.String())
+	}
+	if rec.Header().Get("Content-Type") != "application/json" || rec.Header().Get("Retry-After") != "120" {
+		t.Fatalf("unexpected headers: %v", rec.Header())
+	}
+
+	rec = httptest.NewRecorder()
+	newRespondHandler(&models.Respond{Body: "ok"}).ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "http://example.com/", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Fatalf("HEAD response = %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHttpRedirectHandler(t *testing.T) {
+	t.Parallel()
+
+	accessLog := make(chan *http.Request, 1)
+	r := &Routy{
+		accessLog: accessLog,
+		denyList:  &models.DenyList{},
+		hostnames: []string{"example.com"},
+	}
+
+	fallback := newRespondHandler(&models.Respond{Status: http.StatusNotFound, Body: "unknown host"})
+	h := r.httpRedirectHandler(fallback)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/a?b=c", nil))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "https://example.com/a?b=c" {
+		t.Fatalf("known host response = %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://other.org/", nil))
+	if rec.Code != http.StatusNotFound || rec.Body.String() != "unknown host" {
+		t.Fatalf("unknown host response = %d %q", rec.Code, rec.Body.String())
+	}
+}
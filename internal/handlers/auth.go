@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"net/http"
+	"path/filepath"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+// authorizer decides whether a request may pass. When it may, authorize
+// returns the request to send on, possibly with identity headers added;
+// otherwise it has answered the client and ok is false.
+type authorizer interface {
+	authorize(w http.ResponseWriter, req *http.Request) (*http.Request, bool)
+}
+
+// pathAuthorizers returns the checks configured on a path, in the order they
+// run. The sign in configured for the path's host, if any, runs first.
+func (r *Routy) pathAuthorizers(host string, oidc *models.OIDC, path models.Path) ([]authorizer, error) {
+	var auths []authorizer
+
+	login, err := r.oidcLogin(host, oidc)
+	if err != nil {
+		return nil, err
+	}
+	if login != nil {
+		auths = append(auths, login)
+	}
+
+	basic, err := newBasicAuth(path.BasicAuth)
+	if err != nil {
+		return nil, err
+	}
+	if basic != nil {
+		auths = append(auths, basic)
+	}
+
+	jwt, err := newJWTAuth(path.JWT)
+	if err != nil {
+		return nil, err
+	}
+	if jwt != nil {
+		auths = append(auths, jwt)
+	}
+
+	forward, err := newForwardAuth(path.ForwardAuth, r.proxies, r.tracing, r.EventLog)
+	if err != nil {
+		return nil, err
+	}
+	if forward != nil {
+		auths = append(auths, forward)
+	}
+
+	return auths, nil
+}
+
+// authorizeAll runs every check, stopping at the first that fails.
+func authorizeAll(auths []authorizer, w http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	for _, a := range auths {
+		var ok bool
+		if req, ok = a.authorize(w, req); !ok {
+			return nil, false
+		}
+	}
+
+	return req, true
+}
+
+// authHandler only passes requests every check allows on to next.
+func authHandler(auths []authorizer, next http.Handler) http.Handler {
+	if len(auths) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req, ok := authorizeAll(auths, w, req)
+		if !ok {
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// dataFilePath resolves name against the data directory unless it is
+// absolute.
+func dataFilePath(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+
+	m, err := models.NewModel()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(m.DataDir, name), nil
+}
@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/models"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultBasicAuthRealm = "Restricted"
+
+	// htpasswdCheckInterval is how often the file is checked for changes.
+	htpasswdCheckInterval = 5 * time.Second
+
+	// basicAuthCacheTTL is how long a verified password is remembered, as
+	// bcrypt and argon2 are slow by design.
+	basicAuthCacheTTL = time.Minute
+	maxBasicAuthCache = 1000
+
+	basicAuthHashBcrypt = "bcrypt"
+	basicAuthHashArgon2 = "argon2"
+)
+
+// dummyBasicAuthHash is checked for unknown users so they take as long to
+// reject as a wrong password.
+var dummyBasicAuthHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("routy"), bcrypt.DefaultCost)
+	return hash
+})
+
+// basicAuth checks user names and passwords against an htpasswd file, which
+// is read again when it changes.
+type basicAuth struct {
+	file       string
+	realm      string
+	userHeader string
+	now        func() time.Time
+
+	mu        sync.Mutex
+	users     map[string]string
+	modTime   time.Time
+	checkedAt time.Time
+	verified  map[[sha256.Size]byte]time.Time
+}
+
+// newBasicAuth returns nil when cfg is nil.
+func newBasicAuth(cfg *models.BasicAuth) (*basicAuth, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	if cfg.File == "" {
+		return nil, fmt.Errorf("basic auth file is required")
+	}
+
+	file, err := dataFilePath(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+
+	ba := &basicAuth{
+		file:     file,
+		realm:    cfg.Realm,
+		now:      time.Now,
+		verified: make(map[[sha256.Size]byte]time.Time),
+	}
+
+	if ba.realm == "" {
+		ba.realm = defaultBasicAuthRealm
+	}
+	if cfg.UserHeader != "" {
+		ba.userHeader = http.CanonicalHeaderKey(cfg.UserHeader)
+	}
+
+	if err := ba.load(); err != nil {
+		return nil, err
+	}
+
+	return ba, nil
+}
+
+func (ba *basicAuth) authorize(w http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	user, password, ok := req.BasicAuth()
+	if !ok || !ba.check(user, password) {
+		w.Header().Set("Www-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, strings.ReplaceAll(ba.realm, `"`, "")))
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil, false
+	}
+
+	if ba.userHeader != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(ba.userHeader, user)
+	}
+
+	return req, true
+}
+
+// check reports whether password is right for user.
+func (ba *basicAuth) check(user, password string) bool {
+	ba.reload()
+
+	ba.mu.Lock()
+	hash, known := ba.users[user]
+	ba.mu.Unlock()
+
+	if !known {
+		_ = bcrypt.CompareHashAndPassword(dummyBasicAuthHash(), []byte(password))
+		return false
+	}
+
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+
+	ba.mu.Lock()
+	expires, cached := ba.verified[key]
+	ba.mu.Unlock()
+
+	if cached && ba.now().Before(expires) {
+		return true
+	}
+
+	if !verifyPasswordHash(hash, password) {
+		return false
+	}
+
+	ba.mu.Lock()
+	if len(ba.verified) >= maxBasicAuthCache {
+		ba.verified = make(map[[sha256.Size]byte]time.Time)
+	}
+	ba.verified[key] = ba.now().Add(basicAuthCacheTTL)
+	ba.mu.Unlock()
+
+	return true
+}
+
+// reload reads the file again when it has changed since it was last read. A
+// file that has become invalid leaves the previous users in place.
+func (ba *basicAuth) reload() {
+	ba.mu.Lock()
+	if ba.now().Sub(ba.checkedAt) < htpasswdCheckInterval {
+		ba.mu.Unlock()
+		return
+	}
+	ba.checkedAt = ba.now()
+	modTime := ba.modTime
+	ba.mu.Unlock()
+
+	fi, err := os.Stat(ba.file)
+	if err != nil || fi.ModTime().Equal(modTime) {
+		return
+	}
+
+	_ = ba.load()
+}
+
+func (ba *basicAuth) load() error {
+	fi, err := os.Stat(ba.file)
+	if err != nil {
+		return fmt.Errorf("failed to read basic auth file: %v", err)
+	}
+
+	data, err := os.ReadFile(ba.file)
+	if err != nil {
+		return fmt.Errorf("failed to read basic auth file: %v", err)
+	}
+
+	users, err := parseHtpasswd(data)
+	if err != nil {
+		return fmt.Errorf("invalid basic auth file %s: %v", ba.file, err)
+	}
+
+	ba.mu.Lock()
+	ba.users = users
+	ba.modTime = fi.ModTime()
+	ba.checkedAt = ba.now()
+	ba.verified = make(map[[sha256.Size]byte]time.Time)
+	ba.mu.Unlock()
+
+	return nil
+}
+
+// parseHtpasswd reads user:hash lines, skipping blank lines and comments.
+func parseHtpasswd(data []byte) (map[string]string, error) {
+	users := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d is not user:hash", n)
+		}
+
+		if passwordHashType(hash) == "" {
+			return nil, fmt.Errorf("line %d: only bcrypt and argon2 hashes are supported", n)
+		}
+
+		users[user] = hash
+	}
+
+	return users, scanner.Err()
+}
+
+func passwordHashType(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return basicAuthHashBcrypt
+	case strings.HasPrefix(hash, "$argon2id$"), strings.HasPrefix(hash, "$argon2i$"):
+		return basicAuthHashArgon2
+	default:
+		return ""
+	}
+}
+
+func verifyPasswordHash(hash, password string) bool {
+	switch passwordHashType(hash) {
+	case basicAuthHashBcrypt:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case basicAuthHashArgon2:
+		return verifyArgon2(hash, password)
+	default:
+		return false
+	}
+}
+
+// verifyArgon2 checks password against a hash in the PHC string format, such
+// as $argon2id$v=19$m=65536,t=3,p=4$salt$hash.
+func verifyArgon2(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[2] != "v="+strconv.Itoa(argon2.Version) {
+		return false
+	}
+
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil || iterations == 0 || threads == 0 {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+
+	var got []byte
+	if parts[1] == "argon2id" {
+		got = argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(want)))
+	} else {
+		got = argon2.Key([]byte(password), salt, iterations, memory, threads, uint32(len(want)))
+	}
+
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/models"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword() error = %v", err)
+	}
+
+	return string(hash)
+}
+
+func argon2Hash(t *testing.T, password string) string {
+	t.Helper()
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		t.Fatalf("rand.Read() error = %v", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, 1, 1024, 1, 32)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func writeHtpasswd(t *testing.T, file, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "users.htpasswd")
+	writeHtpasswd(t, file, "# staff\nalice:"+bcryptHash(t, "wonderland")+"\n\nbob:"+argon2Hash(t, "builder")+"\n")
+
+	ba, err := newBasicAuth(&models.BasicAuth{File: file, Realm: "staff", UserHeader: "X-Auth-User"})
+	if err != nil {
+		t.Fatalf("newBasicAuth() error = %v", err)
+	}
+
+	handler := authHandler([]authorizer{ba}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, req.Header.Get("X-Auth-User"))
+	}))
+
+	tests := []struct {
+		name       string
+		user       string
+		password   string
+		noAuth     bool
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "bcrypt", user: "alice", password: "wonderland", wantStatus: http.StatusOK, wantBody: "alice"},
+		{name: "argon2", user: "bob", password: "builder", wantStatus: http.StatusOK, wantBody: "bob"},
+		{name: "wrong password", user: "alice", password: "builder", wantStatus: http.StatusUnauthorized},
+		{name: "unknown user", user: "carol", password: "wonderland", wantStatus: http.StatusUnauthorized},
+		{name: "no credentials", noAuth: true, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+			req.Header.Set("X-Auth-User", "mallory")
+			if !tt.noAuth {
+				req.SetBasicAuth(tt.user, tt.password)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+
+			if tt.wantStatus == http.StatusUnauthorized {
+				if got, want := rec.Header().Get("Www-Authenticate"), `Basic realm="staff", charset="UTF-8"`; got != want {
+					t.Fatalf("Www-Authenticate = %q, want %q", got, want)
+				}
+				return
+			}
+
+			if rec.Body.String() != tt.wantBody {
+				t.Fatalf("user header = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestBasicAuthReload(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "users.htpasswd")
+	writeHtpasswd(t, file, "alice:"+bcryptHash(t, "wonderland")+"\n")
+
+	ba, err := newBasicAuth(&models.BasicAuth{File: file})
+	if err != nil {
+		t.Fatalf("newBasicAuth() error = %v", err)
+	}
+
+	now := time.Now()
+	ba.now = func() time.Time { return now }
+
+	writeHtpasswd(t, file, "alice:"+bcryptHash(t, "looking-glass")+"\n")
+	if err := os.Chtimes(file, now, now.Add(time.Minute)); err != nil {
+		t.Fatalf("Chtimes() error = %v", err)
+	}
+
+	if !ba.check("alice", "wonderland") {
+		t.Fatalf("check() = false before the reload interval, want true")
+	}
+
+	now = now.Add(htpasswdCheckInterval)
+
+	if ba.check("alice", "wonderland") {
+		t.Fatalf("check() with the old password = true after reload, want false")
+	}
+	if !ba.check("alice", "looking-glass") {
+		t.Fatalf("check() with the new password = false after reload, want true")
+	}
+}
+
+func TestParseHtpasswdRejectsWeakHashes(t *testing.T) {
+	t.Parallel()
+
+	tests := []string{
+		"alice:$apr1$salt$hash",
+		"alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"alice:plaintext",
+		"no-separator",
+	}
+
+	for _, data := range tests {
+		if _, err := parseHtpasswd([]byte(data)); err == nil {
+			t.Fatalf("parseHtpasswd(%q) error = nil, want an error", data)
+		}
+	}
+}
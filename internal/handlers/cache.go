@@ -0,0 +1,542 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/models"
+	"golang.org/x/sync/singleflight"
+)
+
+// cacheableStatuses are the statuses a shared cache may store when the
+// response carries explicit freshness information.
+var cacheableStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// uncachedHeaders are never stored with a cached response.
+var uncachedHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Age",
+	"X-Cache",
+}
+
+// responseCache serves a path's responses from the shared cache store.
+type responseCache struct {
+	store *cacheStore
+	cfg   *models.PathCache
+	group singleflight.Group
+	next  http.Handler
+}
+
+func newResponseCache(store *cacheStore, cfg *models.PathCache) *responseCache {
+	if cfg == nil || store == nil {
+		return nil
+	}
+
+	return &responseCache{store: store, cfg: cfg}
+}
+
+// cacheKey identifies a response by host and request URI. HEAD requests share
+// the entries of GET requests.
+func cacheKey(req *http.Request) string {
+	return hostWithoutPort(req.Host) + req.URL.RequestURI()
+}
+
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	if req.Header.Get("Upgrade") != "" || req.Header.Get("Range") != "" {
+		return false
+	}
+
+	_, noStore := parseCacheControl(req.Header.Get("Cache-Control"))["no-store"]
+
+	return !noStore
+}
+
+// parseCacheControl splits a Cache-Control header into lowercased directives
+// and their values.
+func parseCacheControl(header string) map[string]string {
+	cc := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, value, _ := strings.Cut(part, "=")
+		cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+
+	return cc
+}
+
+func directiveSeconds(cc map[string]string, name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return time.Duration(n) * time.Second, true
+}
+
+// currentAge is how old the entry is, including the age it had when stored.
+func (e *cacheEntry) currentAge(now time.Time) time.Duration {
+	return e.Age + now.Sub(e.StoredAt)
+}
+
+// handler puts the cache in front of next.
+func (c *responseCache) handler(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+
+	c.next = next
+
+	return c
+}
+
+func (c *responseCache) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !cacheableRequest(req) {
+		w.Header().Set("X-Cache", "BYPASS")
+		c.next.ServeHTTP(w, req)
+		return
+	}
+
+	key := cacheKey(req)
+	now := time.Now()
+	_, noCache := parseCacheControl(req.Header.Get("Cache-Control"))["no-cache"]
+
+	entry := c.lookup(key, req)
+	if entry != nil && !noCache {
+		age := entry.currentAge(now)
+		if age < entry.FreshFor {
+			c.serve(w, req, entry, "HIT", now)
+			return
+		}
+
+		if age < entry.FreshFor+entry.SWR {
+			c.serve(w, req, entry, "STALE", now)
+			go c.revalidate(key, req)
+			return
+		}
+	}
+
+	if req.Method == http.MethodHead {
+		w.Header().Set("X-Cache", "MISS")
+		c.next.ServeHTTP(w, req)
+		return
+	}
+
+	c.fetch(w, req, key, entry)
+}
+
+// lookup returns the stored variant matching the request's Vary values.
+func (c *responseCache) lookup(key string, req *http.Request) *cacheEntry {
+	obj := c.store.get(key)
+	if obj == nil {
+		return nil
+	}
+
+	for _, v := range obj.Variants {
+		if varyMatches(v, req) {
+			return v
+		}
+	}
+
+	return nil
+}
+
+func varyMatches(e *cacheEntry, req *http.Request) bool {
+	for name, want := range e.VaryValues {
+		if strings.Join(req.Header.Values(name), ", ") != want {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fetch forwards a miss upstream. Concurrent misses for the same key wait for
+// the first one and are served from its stored response. When a stale entry
+// is available for stale-if-error the response is held back so the stale
+// entry can be served instead of an upstream error.
+func (c *responseCache) fetch(w http.ResponseWriter, req *http.Request, key string, stale *cacheEntry) {
+	now := time.Now()
+	holdBack := stale != nil && stale.currentAge(now) < stale.FreshFor+stale.SIE
+	leader := false
+
+	v, _, _ := c.group.Do(key, func() (any, error) {
+		leader = true
+
+		rec := &cacheRecorder{limit: c.store.maxObject}
+		if !holdBack {
+			w.Header().Set("X-Cache", "MISS")
+			rec.w = w
+			rec.outer = w.Header().Clone()
+		}
+
+		c.next.ServeHTTP(rec, req)
+
+		if holdBack {
+			if rec.status >= http.StatusInternalServerError {
+				c.serve(w, req, stale, "STALE", time.Now())
+				return nil, nil
+			}
+
+			rec.Header().Set("X-Cache", "MISS")
+			rec.writeTo(w)
+		}
+
+		return c.save(key, req, rec), nil
+	})
+
+	if leader {
+		return
+	}
+
+	if entry, ok := v.(*cacheEntry); ok && entry != nil && varyMatches(entry, req) {
+		c.serve(w, req, entry, "HIT", time.Now())
+		return
+	}
+
+	w.Header().Set("X-Cache", "MISS")
+	c.next.ServeHTTP(w, req)
+}
+
+// revalidate refreshes a stale entry in the background.
+func (c *responseCache) revalidate(key string, req *http.Request) {
+	bg := req.Clone(context.Background())
+
+	_, _, _ = c.group.Do(key, func() (any, error) {
+		rec := &cacheRecorder{limit: c.store.maxObject}
+		c.next.ServeHTTP(rec, bg)
+
+		return c.save(key, bg, rec), nil
+	})
+}
+
+// save stores a recorded response when it is cacheable and returns the new
+// entry, or nil when it was not stored.
+func (c *responseCache) save(key string, req *http.Request, rec *cacheRecorder) *cacheEntry {
+	entry := c.newEntry(req, rec, time.Now())
+	if entry == nil {
+		return nil
+	}
+
+	obj := &cacheObject{Key: key, Variants: []*cacheEntry{entry}}
+	if existing := c.store.get(key); existing != nil {
+		for _, v := range existing.Variants {
+			if !sameVary(v.VaryValues, entry.VaryValues) && len(obj.Variants) < maxCacheVariants {
+				obj.Variants = append(obj.Variants, v)
+			}
+		}
+	}
+
+	c.store.put(obj)
+
+	return entry
+}
+
+func sameVary(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newEntry builds a cache entry from a recorded response following the
+// shared cache rules, returning nil when the response may not be stored.
+func (c *responseCache) newEntry(req *http.Request, rec *cacheRecorder, now time.Time) *cacheEntry {
+	if rec.overflow || !cacheableStatuses[rec.status] {
+		return nil
+	}
+
+	h := rec.header
+	cc := parseCacheControl(h.Get("Cache-Control"))
+
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[d]; ok {
+			return nil
+		}
+	}
+
+	if h.Get("Set-Cookie") != "" {
+		return nil
+	}
+
+	_, public := cc["public"]
+	sMaxAge, hasSMaxAge := directiveSeconds(cc, "s-maxage")
+	if req.Header.Get("Authorization") != "" && !public && !hasSMaxAge {
+		return nil
+	}
+
+	var fresh time.Duration
+	maxAge, hasMaxAge := directiveSeconds(cc, "max-age")
+
+	switch {
+	case hasSMaxAge:
+		fresh = sMaxAge
+	case hasMaxAge:
+		fresh = maxAge
+	case h.Get("Expires") != "":
+		expires, err := http.ParseTime(h.Get("Expires"))
+		if err != nil {
+			return nil
+		}
+
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		fresh = expires.Sub(date)
+	case c.cfg.DefaultTTL > 0:
+		fresh = time.Duration(c.cfg.DefaultTTL) * time.Millisecond
+	default:
+		return nil
+	}
+
+	entry := &cacheEntry{
+		Status:     rec.status,
+		Header:     h.Clone(),
+		Body:       rec.body.Bytes(),
+		VaryValues: make(map[string]string),
+		StoredAt:   now,
+		FreshFor:   fresh,
+		SWR:        time.Duration(c.cfg.StaleWhileRevalidate) * time.Millisecond,
+		SIE:        time.Duration(c.cfg.StaleIfError) * time.Millisecond,
+	}
+
+	if d, ok := directiveSeconds(cc, "stale-while-revalidate"); ok {
+		entry.SWR = d
+	}
+	if d, ok := directiveSeconds(cc, "stale-if-error"); ok {
+		entry.SIE = d
+	}
+	if age, err := strconv.Atoi(h.Get("Age")); err == nil && age > 0 {
+		entry.Age = time.Duration(age) * time.Second
+	}
+
+	for _, name := range h.Values("Vary") {
+		for _, field := range strings.Split(name, ",") {
+			field = http.CanonicalHeaderKey(strings.TrimSpace(field))
+			if field == "*" {
+				return nil
+			}
+			if field != "" {
+				entry.VaryValues[field] = strings.Join(req.Header.Values(field), ", ")
+			}
+		}
+	}
+
+	for _, name := range uncachedHeaders {
+		entry.Header.Del(name)
+	}
+
+	return entry
+}
+
+// serve writes a cached entry to the client.
+func (c *responseCache) serve(w http.ResponseWriter, req *http.Request, entry *cacheEntry, status string, now time.Time) {
+	h := w.Header()
+	for k, v := range entry.Header {
+		h[k] = append([]string(nil), v...)
+	}
+
+	h.Set("Age", strconv.Itoa(int(entry.currentAge(now).Seconds())))
+	h.Set("X-Cache", status)
+
+	if etag := entry.Header.Get("Etag"); etag != "" && etagListMatches(strings.Join(req.Header.Values("If-None-Match"), ","), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(entry.Status)
+	if req.Method != http.MethodHead {
+		_, _ = w.Write(entry.Body)
+	}
+}
+
+// etagListMatches reports whether an If-None-Match list holds etag, or is *.
+// Tags are compared weakly, as RFC 9110 asks for If-None-Match, so a client
+// holding the W/ form of a compressed response still matches.
+func etagListMatches(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+
+	for {
+		list = strings.TrimLeft(list, " \t,")
+		if list == "" {
+			return false
+		}
+		if list[0] == '*' {
+			return true
+		}
+
+		tag := strings.TrimPrefix(list, "W/")
+		if tag == "" || tag[0] != '"' {
+			return false
+		}
+
+		end := strings.IndexByte(tag[1:], '"')
+		if end < 0 {
+			return false
+		}
+		if tag[:end+2] == etag {
+			return true
+		}
+
+		list = tag[end+2:]
+	}
+}
+
+// cacheRecorder captures a response for storage. When w is set the response
+// is also streamed to the client as it arrives; otherwise it is held back.
+// outer holds the headers set on w before the upstream ran, which belong to
+// the request rather than the response and are not stored.
+type cacheRecorder struct {
+	w           http.ResponseWriter
+	outer       http.Header
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	limit       int64
+	overflow    bool
+}
+
+func (rec *cacheRecorder) Header() http.Header {
+	if rec.w != nil {
+		return rec.w.Header()
+	}
+
+	if rec.header == nil {
+		rec.header = make(http.Header)
+	}
+
+	return rec.header
+}
+
+func (rec *cacheRecorder) WriteHeader(code int) {
+	if rec.wroteHeader {
+		return
+	}
+
+	if code >= 100 && code < 200 {
+		if rec.w != nil {
+			rec.w.WriteHeader(code)
+		}
+		return
+	}
+
+	rec.wroteHeader = true
+	rec.status = code
+
+	if rec.w != nil {
+		rec.header = headerChanges(rec.outer, rec.w.Header())
+		rec.w.WriteHeader(code)
+	}
+}
+
+// headerChanges returns the headers of after that are missing from before or
+// have other values.
+func headerChanges(before, after http.Header) http.Header {
+	h := make(http.Header)
+	for k, v := range after {
+		if !slices.Equal(before[k], v) {
+			h[k] = slices.Clone(v)
+		}
+	}
+
+	return h
+}
+
+func (rec *cacheRecorder) Write(p []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+
+	if rec.w != nil {
+		if !rec.overflow {
+			if int64(rec.body.Len()+len(p)) > rec.limit {
+				rec.overflow = true
+				rec.body.Reset()
+			} else {
+				rec.body.Write(p)
+			}
+		}
+
+		return rec.w.Write(p)
+	}
+
+	// a held back response is kept in full so it can still be sent to the
+	// client, but it is too large to store once it passes the limit
+	rec.body.Write(p)
+	if int64(rec.body.Len()) > rec.limit {
+		rec.overflow = true
+	}
+
+	return len(p), nil
+}
+
+func (rec *cacheRecorder) Flush() {
+	if rec.w != nil {
+		_ = http.NewResponseController(rec.w).Flush()
+	}
+}
+
+func (rec *cacheRecorder) Unwrap() http.ResponseWriter {
+	return rec.w
+}
+
+// writeTo sends a held back response to the client.
+func (rec *cacheRecorder) writeTo(w http.ResponseWriter) {
+	h := w.Header()
+	for k, v := range rec.header {
+		h[k] = v
+	}
+
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	w.WriteHeader(status)
+	_, _ = w.Write(rec.body.Bytes())
+}
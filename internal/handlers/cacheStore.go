@@ -0,0 +1,422 @@
+package handlers
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+const (
+	defaultCacheMaxMemoryBytes = 64 << 20
+	defaultCacheMaxObjectBytes = 1 << 20
+	defaultCacheMaxDiskBytes   = 1 << 30
+	maxCacheVariants           = 8
+)
+
+// cacheEntry is a stored response for one set of Vary header values.
+type cacheEntry struct {
+	Status     int
+	Header     http.Header
+	Body       []byte
+	VaryValues map[string]string
+	StoredAt   time.Time
+	Age        time.Duration
+	FreshFor   time.Duration
+	SWR        time.Duration
+	SIE        time.Duration
+}
+
+// cacheObject holds every variant of a response stored under one key.
+type cacheObject struct {
+	Key      string
+	Variants []*cacheEntry
+}
+
+func (o *cacheObject) size() int64 {
+	var n int64
+	for _, v := range o.Variants {
+		n += int64(len(v.Body)) + 512
+		for k, vs := range v.Header {
+			n += int64(len(k))
+			for _, s := range vs {
+				n += int64(len(s))
+			}
+		}
+	}
+
+	return n
+}
+
+// memoryItem is an object in memory. seq orders the objects stored under a
+// key, so that a late disk write cannot replace a newer copy.
+type memoryItem struct {
+	obj  *cacheObject
+	size int64
+	seq  uint64
+}
+
+// evictedItem is an object on its way from memory to disk. gen is the purge
+// generation it was evicted in.
+type evictedItem struct {
+	obj *cacheObject
+	seq uint64
+	gen uint64
+}
+
+type diskItem struct {
+	key     string
+	size    int64
+	modTime time.Time
+	seq     uint64
+}
+
+// cacheStore is an LRU response store bounded by size, with an optional disk
+// tier that receives entries evicted from memory. mu guards the memory tier
+// and diskMu the disk tier. Files are only read and written under diskMu,
+// which is never taken while mu is held, so memory hits do not wait on disk.
+type cacheStore struct {
+	mu        sync.Mutex
+	maxMemory int64
+	maxObject int64
+	memSize   int64
+	lru       *list.List
+	items     map[string]*list.Element
+	seq       uint64
+	gen       uint64
+
+	diskMu   sync.Mutex
+	diskDir  string
+	maxDisk  int64
+	diskSize int64
+	disk     map[string]diskItem
+}
+
+func newCacheStore(cfg *models.CacheStore) (*cacheStore, error) {
+	s := &cacheStore{
+		maxMemory: defaultCacheMaxMemoryBytes,
+		maxObject: defaultCacheMaxObjectBytes,
+		maxDisk:   defaultCacheMaxDiskBytes,
+		lru:       list.New(),
+		items:     make(map[string]*list.Element),
+	}
+
+	if cfg == nil {
+		return s, nil
+	}
+
+	if cfg.MaxMemoryBytes > 0 {
+		s.maxMemory = cfg.MaxMemoryBytes
+	}
+	if cfg.MaxObjectBytes > 0 {
+		s.maxObject = cfg.MaxObjectBytes
+	}
+	if cfg.MaxDiskBytes > 0 {
+		s.maxDisk = cfg.MaxDiskBytes
+	}
+
+	if cfg.Disk {
+		dir, err := models.GetCacheDir()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.openDisk(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// openDisk indexes the entries already stored in dir.
+func (s *cacheStore) openDisk(dir string) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("unable to create cache directory: %v", err)
+	}
+
+	s.diskDir = dir
+	s.disk = make(map[string]diskItem)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory: %v", err)
+	}
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		obj, err := readCacheFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			_ = os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		s.disk[e.Name()] = diskItem{key: obj.Key, size: info.Size(), modTime: info.ModTime()}
+		s.diskSize += info.Size()
+	}
+
+	s.trimDisk()
+
+	return nil
+}
+
+func cacheFilename(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func readCacheFile(fp string) (*cacheObject, error) {
+	data, err := os.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &cacheObject{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(obj); err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// get returns the object stored under key, promoting disk entries to memory.
+func (s *cacheStore) get(key string) *cacheObject {
+	s.mu.Lock()
+	if el, ok := s.items[key]; ok {
+		s.lru.MoveToFront(el)
+		obj := el.Value.(*memoryItem).obj
+		s.mu.Unlock()
+
+		return obj
+	}
+	gen := s.gen
+	s.mu.Unlock()
+
+	if s.disk == nil {
+		return nil
+	}
+
+	obj := s.takeDisk(key)
+	if obj == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	if el, ok := s.items[key]; ok {
+		// stored again while the disk copy was read
+		obj = el.Value.(*memoryItem).obj
+		s.mu.Unlock()
+
+		return obj
+	}
+	if s.gen != gen {
+		s.mu.Unlock()
+		return nil
+	}
+	evicted := s.putLocked(obj)
+	s.mu.Unlock()
+
+	s.writeDisk(evicted)
+
+	return obj
+}
+
+// takeDisk reads the disk copy of key and removes it from the disk tier.
+func (s *cacheStore) takeDisk(key string) *cacheObject {
+	s.diskMu.Lock()
+	defer s.diskMu.Unlock()
+
+	name := cacheFilename(key)
+	if _, ok := s.disk[name]; !ok {
+		return nil
+	}
+
+	obj, err := readCacheFile(filepath.Join(s.diskDir, name))
+	s.removeDisk(name)
+	if err != nil || obj.Key != key {
+		return nil
+	}
+
+	return obj
+}
+
+// put stores obj, replacing anything already stored under its key. Objects
+// larger than the object limit are not stored.
+func (s *cacheStore) put(obj *cacheObject) {
+	if obj.size() > s.maxObject {
+		return
+	}
+
+	s.mu.Lock()
+	evicted := s.putLocked(obj)
+	s.mu.Unlock()
+
+	if s.disk != nil {
+		s.diskMu.Lock()
+		s.removeDisk(cacheFilename(obj.Key))
+		s.diskMu.Unlock()
+	}
+
+	s.writeDisk(evicted)
+}
+
+// putLocked stores obj in memory and returns the objects evicted to make
+// room, which the caller passes to writeDisk once mu is released.
+func (s *cacheStore) putLocked(obj *cacheObject) []evictedItem {
+	if el, ok := s.items[obj.Key]; ok {
+		s.memSize -= el.Value.(*memoryItem).size
+		s.lru.Remove(el)
+		delete(s.items, obj.Key)
+	}
+
+	s.seq++
+	item := &memoryItem{obj: obj, size: obj.size(), seq: s.seq}
+	s.items[obj.Key] = s.lru.PushFront(item)
+	s.memSize += item.size
+
+	var evicted []evictedItem
+	for s.memSize > s.maxMemory && s.lru.Len() > 1 {
+		el := s.lru.Back()
+		item := el.Value.(*memoryItem)
+		s.lru.Remove(el)
+		delete(s.items, item.obj.Key)
+		s.memSize -= item.size
+
+		if s.disk != nil {
+			evicted = append(evicted, evictedItem{obj: item.obj, seq: item.seq, gen: s.gen})
+		}
+	}
+
+	return evicted
+}
+
+// writeDisk moves objects evicted from memory to the disk tier. Objects that
+// were stored again since, or evicted before a purge, are dropped.
+func (s *cacheStore) writeDisk(evicted []evictedItem) {
+	if len(evicted) == 0 {
+		return
+	}
+
+	encoded := make([][]byte, len(evicted))
+	for i, e := range evicted {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(e.obj); err == nil {
+			encoded[i] = buf.Bytes()
+		}
+	}
+
+	s.diskMu.Lock()
+	defer s.diskMu.Unlock()
+
+	for i, e := range evicted {
+		name := cacheFilename(e.obj.Key)
+		if encoded[i] == nil || !s.evictionCurrent(e) || s.disk[name].seq > e.seq {
+			continue
+		}
+
+		s.removeDisk(name)
+		if err := os.WriteFile(filepath.Join(s.diskDir, name), encoded[i], 0600); err != nil {
+			continue
+		}
+
+		s.disk[name] = diskItem{key: e.obj.Key, size: int64(len(encoded[i])), modTime: time.Now(), seq: e.seq}
+		s.diskSize += int64(len(encoded[i]))
+	}
+
+	s.trimDisk()
+}
+
+// evictionCurrent reports whether e is still the latest copy of its key.
+func (s *cacheStore) evictionCurrent(e evictedItem) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, stored := s.items[e.obj.Key]
+
+	return !stored && s.gen == e.gen
+}
+
+func (s *cacheStore) removeDisk(name string) {
+	item, ok := s.disk[name]
+	if !ok {
+		return
+	}
+
+	_ = os.Remove(filepath.Join(s.diskDir, name))
+	delete(s.disk, name)
+	s.diskSize -= item.size
+}
+
+// trimDisk removes the oldest disk entries until the tier fits its limit.
+func (s *cacheStore) trimDisk() {
+	if s.diskSize <= s.maxDisk {
+		return
+	}
+
+	names := make([]string, 0, len(s.disk))
+	for name := range s.disk {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return s.disk[names[i]].modTime.Before(s.disk[names[j]].modTime)
+	})
+
+	for _, name := range names {
+		if s.diskSize <= s.maxDisk {
+			return
+		}
+		s.removeDisk(name)
+	}
+}
+
+// purge removes every entry whose key starts with prefix and returns how
+// many were removed. An empty prefix removes everything.
+func (s *cacheStore) purge(prefix string) int {
+	s.mu.Lock()
+	s.gen++
+	n := 0
+	for key, el := range s.items {
+		if strings.HasPrefix(key, prefix) {
+			s.memSize -= el.Value.(*memoryItem).size
+			s.lru.Remove(el)
+			delete(s.items, key)
+			n++
+		}
+	}
+	s.mu.Unlock()
+
+	if s.disk == nil {
+		return n
+	}
+
+	s.diskMu.Lock()
+	defer s.diskMu.Unlock()
+
+	for name, item := range s.disk {
+		if strings.HasPrefix(item.key, prefix) {
+			s.removeDisk(name)
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+func newTestCache(t *testing.T, cfg *models.PathCache, upstream http.HandlerFunc) http.Handler {
+	t.Helper()
+
+	store, err := newCacheStore(nil)
+	if err != nil {
+		t.Fatalf("newCacheStore: %v", err)
+	}
+
+	return newResponseCache(store, cfg).handler(upstream)
+}
+
+func cacheRequest(h http.Handler, target string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestResponseCacheHitAndMiss(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	h := newTestCache(t, &models.PathCache{}, func(w http.ResponseWriter, req *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = fmt.Fprintf(w, "response %d", n)
+	})
+
+	rec := cacheRequest(h, "http://example.com/a", nil)
+	if rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "response 1" {
+		t.Fatalf("first request = %q %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+
+	rec = cacheRequest(h, "http://example.com/a", nil)
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "response 1" {
+		t.Fatalf("second request = %q %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if rec.Header().Get("Age") == "" {
+		t.Fatalf("cached response is missing the Age header")
+	}
+
+	rec = cacheRequest(h, "http://example.com/a", map[string]string{"If-None-Match": `"v1"`})
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("conditional request status = %d, want 304", rec.Code)
+	}
+
+	rec = cacheRequest(h, "http://example.com/a?x=1", nil)
+	if rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("different query should miss, got %q", rec.Header().Get("X-Cache"))
+	}
+
+	rec = cacheRequest(h, "http://example.com/a", map[string]string{"Cache-Control": "no-cache"})
+	if rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "response 3" {
+		t.Fatalf("no-cache request = %q %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/a", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Header().Get("X-Cache") != "BYPASS" {
+		t.Fatalf("POST should bypass, got %q", rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestResponseCacheIfNoneMatch(t *testing.T) {
+	t.Parallel()
+
+	h := newTestCache(t, &models.PathCache{}, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("cached"))
+	})
+	cacheRequest(h, "http://example.com/a", nil)
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		want        int
+	}{
+		{name: "strong tag", ifNoneMatch: `"v1"`, want: http.StatusNotModified},
+		{name: "weak tag from the compressor", ifNoneMatch: `W/"v1"`, want: http.StatusNotModified},
+		{name: "tag in a list", ifNoneMatch: `"v0", W/"v1"`, want: http.StatusNotModified},
+		{name: "any tag", ifNoneMatch: "*", want: http.StatusNotModified},
+		{name: "other tags", ifNoneMatch: `"v0", "v2"`, want: http.StatusOK},
+		{name: "unquoted tag", ifNoneMatch: "v1", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rec := cacheRequest(h, "http://example.com/a", map[string]string{"If-None-Match": tt.ifNoneMatch})
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseCacheKeepsRequestHeaders(t *testing.T) {
+	t.Parallel()
+
+	ri := newRequestIDs(nil, nil)
+
+	cache := newTestCache(t, &models.PathCache{}, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		_, _ = w.Write([]byte("cached"))
+	})
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cache.ServeHTTP(w, ri.assign(w, req))
+	})
+
+	miss := cacheRequest(h, "http://example.com/a", nil)
+	hit := cacheRequest(h, "http://example.com/a", nil)
+
+	if hit.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("second request X-Cache = %q, want HIT", hit.Header().Get("X-Cache"))
+	}
+
+	for _, rec := range []*httptest.ResponseRecorder{miss, hit} {
+		if ids := rec.Header().Values("X-Request-Id"); len(ids) != 1 || ids[0] == "" {
+			t.Fatalf("X-Request-Id = %v, want one ID", ids)
+		}
+	}
+
+	if miss.Header().Get("X-Request-Id") == hit.Header().Get("X-Request-Id") {
+		t.Fatalf("the cache hit was served with the request ID of the miss")
+	}
+}
+
+func TestResponseCacheUncacheable(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{name: "no freshness", headers: map[string]string{}, status: http.StatusOK},
+		{name: "no-store", headers: map[string]string{"Cache-Control": "no-store, max-age=60"}, status: http.StatusOK},
+		{name: "private", headers: map[string]string{"Cache-Control": "private, max-age=60"}, status: http.StatusOK},
+		{name: "set-cookie", headers: map[string]string{"Cache-Control": "max-age=60", "Set-Cookie": "a=b"}, status: http.StatusOK},
+		{name: "vary star", headers: map[string]string{"Cache-Control": "max-age=60", "Vary": "*"}, status: http.StatusOK},
+		{name: "server error", headers: map[string]string{"Cache-Control": "max-age=60"}, status: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			h := newTestCache(t, &models.PathCache{}, func(w http.ResponseWriter, req *http.Request) {
+				for k, v := range tt.headers {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(tt.status)
+			})
+
+			cacheRequest(h, "http://example.com/", nil)
+			if got := cacheRequest(h, "http://example.com/", nil).Header().Get("X-Cache"); got != "MISS" {
+				t.Fatalf("second request X-Cache = %q, want MISS", got)
+			}
+		})
+	}
+}
+
+func TestResponseCacheDefaultTTLAndVary(t *testing.T) {
+	t.Parallel()
+
+	h := newTestCache(t, &models.PathCache{DefaultTTL: 60000}, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Vary", "Accept-Language")
+		_, _ = w.Write([]byte("lang=" + req.Header.Get("Accept-Language")))
+	})
+
+	en := map[string]string{"Accept-Language": "en"}
+	de := map[string]string{"Accept-Language": "de"}
+
+	cacheRequest(h, "http://example.com/", en)
+	cacheRequest(h, "http://example.com/", de)
+
+	if rec := cacheRequest(h, "http://example.com/", en); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "lang=en" {
+		t.Fatalf("en variant = %q %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if rec := cacheRequest(h, "http://example.com/", de); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "lang=de" {
+		t.Fatalf("de variant = %q %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+}
+
+func TestResponseCacheStaleWhileRevalidate(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	revalidated := make(chan struct{}, 1)
+	h := newTestCache(t, &models.PathCache{}, func(w http.ResponseWriter, req *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		_, _ = fmt.Fprintf(w, "v%d", n)
+		if n > 1 {
+			revalidated <- struct{}{}
+		}
+	})
+
+	cacheRequest(h, "http://example.com/", nil)
+
+	rec := cacheRequest(h, "http://example.com/", nil)
+	if rec.Header().Get("X-Cache") != "STALE" || rec.Body.String() != "v1" {
+		t.Fatalf("stale response = %q %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+
+	select {
+	case <-revalidated:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("entry was not revalidated in the background")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cacheRequest(h, "http://example.com/", nil).Body.String() != "v1" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("revalidated response was not stored")
+}
+
+func TestResponseCacheStaleIfError(t *testing.T) {
+	t.Parallel()
+
+	var failing atomic.Bool
+	h := newTestCache(t, &models.PathCache{StaleIfError: 60000}, func(w http.ResponseWriter, req *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		_, _ = w.Write([]byte("good"))
+	})
+
+	cacheRequest(h, "http://example.com/", nil)
+	failing.Store(true)
+
+	rec := cacheRequest(h, "http://example.com/", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "STALE" || rec.Body.String() != "good" {
+		t.Fatalf("stale-if-error response = %d %q %q", rec.Code, rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+}
+
+func TestResponseCacheCoalescesMisses(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	h := newTestCache(t, &models.PathCache{}, func(w http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("shared"))
+	})
+
+	var wg sync.WaitGroup
+	results := make([]string, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = cacheRequest(h, "http://example.com/slow", nil).Body.String()
+		}(i)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("upstream called %d times, want 1", n)
+	}
+	for i, r := range results {
+		if r != "shared" {
+			t.Fatalf("result %d = %q", i, r)
+		}
+	}
+}
+
+func TestCacheStoreEvictsToDiskAndPurges(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("ROUTY_DATA_DIR", tmp)
+
+	store, err := newCacheStore(&models.CacheStore{MaxMemoryBytes: 2000, Disk: true})
+	if err != nil {
+		t.Fatalf("newCacheStore: %v", err)
+	}
+
+	body := make([]byte, 900)
+	for _, key := range []string{"example.com/a", "example.com/b", "other.org/c"} {
+		store.put(&cacheObject{Key: key, Variants: []*cacheEntry{{Status: 200, Body: body}}})
+	}
+
+	if len(store.disk) == 0 {
+		t.Fatalf("expected an entry to be evicted to disk")
+	}
+	if obj := store.get("example.com/a"); obj == nil || len(obj.Variants[0].Body) != 900 {
+		t.Fatalf("evicted entry was not read back from disk")
+	}
+
+	reopened, err := newCacheStore(&models.CacheStore{MaxMemoryBytes: 2000, Disk: true})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if len(reopened.disk) != len(store.disk) {
+		t.Fatalf("disk index not rebuilt: %d entries, want %d", len(reopened.disk), len(store.disk))
+	}
+
+	if n := store.purge("example.com/"); n != 2 {
+		t.Fatalf("purge removed %d entries, want 2", n)
+	}
+	if store.get("example.com/a") != nil || store.get("example.com/b") != nil {
+		t.Fatalf("purged entries still present")
+	}
+	if store.get("other.org/c") == nil {
+		t.Fatalf("unrelated entry was purged")
+	}
+}
+
+func TestCacheStoreMemoryHitDuringDiskIO(t *testing.T) {
+	t.Setenv("ROUTY_DATA_DIR", t.TempDir())
+
+	store, err := newCacheStore(&models.CacheStore{MaxMemoryBytes: 2000, Disk: true})
+	if err != nil {
+		t.Fatalf("newCacheStore: %v", err)
+	}
+
+	store.put(&cacheObject{Key: "example.com/a", Variants: []*cacheEntry{{Status: 200, Body: []byte("a")}}})
+
+	// a slow disk write or read holds the disk tier
+	store.diskMu.Lock()
+	defer store.diskMu.Unlock()
+
+	done := make(chan *cacheObject, 1)
+	go func() {
+		done <- store.get("example.com/a")
+	}()
+
+	select {
+	case obj := <-done:
+		if obj == nil {
+			t.Fatalf("memory entry was not found")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("memory hit waited for the disk tier")
+	}
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+const (
+	defaultCertCheckInterval = time.Hour
+	defaultCertWarnDays      = 30
+	defaultCertErrorDays     = 7
+
+	// autocert renews certificates 30 days before they expire. A certificate
+	// still in the cache well past that point means renewal is failing.
+	certRenewalDays = 30
+	certRenewalSlop = 2
+)
+
+// certMonitorSettings returns the monitor config with defaults applied.
+func (r *Routy) certMonitorSettings() (time.Duration, int, int) {
+	interval := defaultCertCheckInterval
+	warnDays := defaultCertWarnDays
+	errorDays := defaultCertErrorDays
+
+	if cfg := r.routes.CertMonitor; cfg != nil {
+		if cfg.CheckInterval > 0 {
+			interval = time.Duration(cfg.CheckInterval) * time.Millisecond
+		}
+		if cfg.WarnDays > 0 {
+			warnDays = cfg.WarnDays
+		}
+		if cfg.ErrorDays > 0 {
+			errorDays = cfg.ErrorDays
+		}
+	}
+
+	return interval, warnDays, errorDays
+}
+
+// startCertMonitor periodically scans the certs cache and raises events for
+// certificates that are close to expiry or that have missed their renewal.
+func (r *Routy) startCertMonitor() {
+	if r.routes.CertMonitor != nil && r.routes.CertMonitor.Disabled {
+		return
+	}
+
+	interval, _, _ := r.certMonitorSettings()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			r.checkCertificates()
+			<-ticker.C
+		}
+	}()
+}
+
+func (r *Routy) checkCertificates() {
+	certs, err := models.GetCertificates()
+	if err != nil {
+		r.EventLog <- logging.EventLogMessage{
+			Level:   "ERROR",
+			Caller:  "checkCertificates()->models.GetCertificates()",
+			Message: fmt.Sprintf("failed to scan certificate cache: %v", err),
+		}
+
+		return
+	}
+
+	_, warnDays, errorDays := r.certMonitorSettings()
+	now := time.Now()
+
+	for _, c := range certs {
+		level, msg := certificateStatus(c, now, warnDays, errorDays)
+		if level == "OK" {
+			continue
+		}
+
+		r.EventLog <- logging.EventLogMessage{
+			Level:   level,
+			Caller:  "checkCertificates()",
+			Message: msg,
+		}
+	}
+}
+
+// certificateStatus classifies a certificate against the expiry thresholds and
+// returns the event level with a message describing the problem.
+func certificateStatus(c models.CertificateInfo, now time.Time, warnDays, errorDays int) (string, string) {
+	days := c.DaysRemaining(now)
+
+	switch {
+	case !now.Before(c.NotAfter):
+		return "ERROR", fmt.Sprintf("certificate %s expired on %s", c.Name, c.NotAfter.Format(time.RFC3339))
+	case days <= errorDays:
+		return "ERROR", fmt.Sprintf("certificate %s expires in %d days on %s; renewal has failed", c.Name, days, c.NotAfter.Format(time.RFC3339))
+	case days <= warnDays && days < certRenewalDays-certRenewalSlop:
+		return "WARN", fmt.Sprintf("certificate %s expires in %d days on %s; renewal is overdue", c.Name, days, c.NotAfter.Format(time.RFC3339))
+	case days <= warnDays:
+		return "WARN", fmt.Sprintf("certificate %s expires in %d days on %s", c.Name, days, c.NotAfter.Format(time.RFC3339))
+	}
+
+	return "OK", ""
+}
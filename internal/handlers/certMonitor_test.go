@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+func TestCertificateStatus(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name     string
+		notAfter time.Time
+		want     string
+		renewal  string
+	}{
+		{name: "healthy", notAfter: now.Add(60 * day), want: "OK"},
+		{name: "inside renewal window", notAfter: now.Add(29 * day), want: "WARN"},
+		{name: "renewal overdue", notAfter: now.Add(20 * day), want: "WARN", renewal: "renewal is overdue"},
+		{name: "error threshold", notAfter: now.Add(7 * day), want: "ERROR", renewal: "renewal has failed"},
+		{name: "expired", notAfter: now.Add(-day), want: "ERROR"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			c := models.CertificateInfo{Name: "example.com", NotAfter: tt.notAfter}
+			got, msg := certificateStatus(c, now, defaultCertWarnDays, defaultCertErrorDays)
+			if got != tt.want {
+				t.Fatalf("certificateStatus() = %q (%s), want %q", got, msg, tt.want)
+			}
+			if _, renewal, _ := strings.Cut(msg, "; "); renewal != tt.renewal {
+				t.Fatalf("certificateStatus() message = %q, want renewal note %q", msg, tt.renewal)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerOpenFor  = 30 * time.Second
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+type breakerOutcome int
+
+const (
+	breakerSuccess breakerOutcome = iota
+	breakerFailure
+	breakerIgnored
+)
+
+// circuitBreaker tracks the health of one upstream. It opens after a run of
+// consecutive failures, fails fast while open, and after the open period lets
+// a single probe through before deciding whether to close again.
+type circuitBreaker struct {
+	mu          sync.Mutex
+	upstream    string
+	threshold   int
+	openFor     time.Duration
+	state       breakerState
+	consecutive int
+	openedAt    time.Time
+	probing     bool
+	now         func() time.Time
+	notify      func(upstream string, from, to breakerState)
+}
+
+func newCircuitBreaker(upstream string, cfg *models.CircuitBreaker, notify func(string, breakerState, breakerState)) *circuitBreaker {
+	cb := &circuitBreaker{
+		upstream:  upstream,
+		threshold: defaultBreakerFailures,
+		openFor:   timeoutOrDefault(cfg.OpenFor, defaultBreakerOpenFor),
+		now:       time.Now,
+		notify:    notify,
+	}
+
+	if cfg.Failures > 0 {
+		cb.threshold = cfg.Failures
+	}
+
+	return cb
+}
+
+// allow returns errCircuitOpen when a request must not be sent upstream.
+func (cb *circuitBreaker) allow() error {
+	cb.mu.Lock()
+
+	from := cb.state
+	switch cb.state {
+	case breakerOpen:
+		if cb.now().Sub(cb.openedAt) < cb.openFor {
+			cb.mu.Unlock()
+			return errCircuitOpen
+		}
+		cb.state = breakerHalfOpen
+		cb.probing = true
+	case breakerHalfOpen:
+		if cb.probing {
+			cb.mu.Unlock()
+			return errCircuitOpen
+		}
+		cb.probing = true
+	}
+
+	to := cb.state
+	cb.mu.Unlock()
+
+	cb.transitioned(from, to)
+
+	return nil
+}
+
+// record updates the breaker with the outcome of an allowed request.
+func (cb *circuitBreaker) record(outcome breakerOutcome) {
+	cb.mu.Lock()
+
+	from := cb.state
+	switch cb.state {
+	case breakerClosed:
+		switch outcome {
+		case breakerSuccess:
+			cb.consecutive = 0
+		case breakerFailure:
+			cb.consecutive++
+			if cb.consecutive >= cb.threshold {
+				cb.state = breakerOpen
+				cb.openedAt = cb.now()
+			}
+		}
+	case breakerHalfOpen:
+		cb.probing = false
+		switch outcome {
+		case breakerSuccess:
+			cb.state = breakerClosed
+			cb.consecutive = 0
+		case breakerFailure:
+			cb.state = breakerOpen
+			cb.openedAt = cb.now()
+		}
+	}
+
+	to := cb.state
+	cb.mu.Unlock()
+
+	cb.transitioned(from, to)
+}
+
+func (cb *circuitBreaker) transitioned(from, to breakerState) {
+	if from != to && cb.notify != nil {
+		cb.notify(cb.upstream, from, to)
+	}
+}
+
+// transport wraps next so requests fail fast while the breaker is open.
+func (cb *circuitBreaker) transport(next http.RoundTripper) http.RoundTripper {
+	if cb == nil {
+		return next
+	}
+
+	return &breakerTransport{next: next, cb: cb}
+}
+
+type breakerTransport struct {
+	next http.RoundTripper
+	cb   *circuitBreaker
+}
+
+func (bt *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := bt.cb.allow(); err != nil {
+		return nil, err
+	}
+
+	resp, err := bt.next.RoundTrip(req)
+
+	switch {
+	case err != nil && (req.Context().Err() != nil || errors.Is(err, context.Canceled) || errors.As(err, new(*http.MaxBytesError))):
+		bt.cb.record(breakerIgnored)
+	case err != nil:
+		bt.cb.record(breakerFailure)
+	case resp.StatusCode == http.StatusBadGateway,
+		resp.StatusCode == http.StatusServiceUnavailable,
+		resp.StatusCode == http.StatusGatewayTimeout:
+		bt.cb.record(breakerFailure)
+	default:
+		bt.cb.record(breakerSuccess)
+	}
+
+	return resp, err
+}
+
+// circuitBreaker returns the breaker for the path's upstream, or nil when the
+// path does not configure one. Paths sharing an upstream share its breaker,
+// using the settings of the first path registered.
+func (r *Routy) circuitBreaker(path models.Path) *circuitBreaker {
+	if path.CircuitBreaker == nil {
+		return nil
+	}
+
+	upstream := path.Target
+	if u, err := url.Parse(path.Target); err == nil && u.Host != "" {
+		upstream = u.Host
+	}
+
+	r.breakersMu.Lock()
+	defer r.breakersMu.Unlock()
+
+	if r.breakers == nil {
+		r.breakers = make(map[string]*circuitBreaker)
+	}
+
+	cb, ok := r.breakers[upstream]
+	if !ok {
+		cb = newCircuitBreaker(upstream, path.CircuitBreaker, r.logBreakerTransition)
+		r.breakers[upstream] = cb
+	}
+
+	return cb
+}
+
+func (r *Routy) logBreakerTransition(upstream string, from, to breakerState) {
+	level := "INFO"
+	if to == breakerOpen {
+		level = "WARN"
+	}
+
+	r.EventLog <- logging.EventLogMessage{
+		Level:   level,
+		Caller:  "circuitBreaker()",
+		Message: fmt.Sprintf("circuit breaker for upstream %s changed from %s to %s", upstream, from, to),
+	}
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(0, 0)
+	var transitions []string
+
+	cb := newCircuitBreaker("upstream:80", &models.CircuitBreaker{Failures: 2, OpenFor: 1000}, func(_ string, from, to breakerState) {
+		transitions = append(transitions, from.String()+"->"+to.String())
+	})
+	cb.now = func() time.Time { return now }
+
+	fail := true
+	next := roundTripFunc(func(*http.Request) (*http.Response, error) {
+		if fail {
+			return nil, errors.New("connection refused")
+		}
+		return statusResponse(http.StatusOK), nil
+	})
+	rt := cb.transport(next)
+
+	send := func() error {
+		_, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, "http://upstream/", nil))
+		return err
+	}
+
+	_ = send()
+	_ = send()
+	if err := send(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("request after %d failures error = %v, want errCircuitOpen", 2, err)
+	}
+
+	now = now.Add(time.Second)
+	if err := send(); errors.Is(err, errCircuitOpen) {
+		t.Fatal("probe after the open period was not allowed")
+	}
+	if err := send(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("request after a failed probe error = %v, want errCircuitOpen", err)
+	}
+
+	now = now.Add(time.Second)
+	fail = false
+	if err := send(); err != nil {
+		t.Fatalf("successful probe error = %v", err)
+	}
+	if err := send(); err != nil {
+		t.Fatalf("request after the breaker closed error = %v", err)
+	}
+
+	want := []string{"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed"}
+	if len(transitions) != len(want) {
+		t.Fatalf("transitions = %v, want %v", transitions, want)
+	}
+	for i := range want {
+		if transitions[i] != want[i] {
+			t.Fatalf("transitions = %v, want %v", transitions, want)
+		}
+	}
+}
+
+func TestUpstreamErrorStatus(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "circuit open", err: errCircuitOpen, want: http.StatusServiceUnavailable},
+		{name: "timeout", err: &timeoutError{}, want: http.StatusGatewayTimeout},
+		{name: "other", err: errors.New("connection refused"), want: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := upstreamErrorStatus(tt.err); got != tt.want {
+				t.Fatalf("upstreamErrorStatus() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
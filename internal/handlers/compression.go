@@ -0,0 +1,372 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+const defaultCompressionMinSize = 1024
+
+var defaultCompressionEncodings = []string{"zstd", "br", "gzip"}
+
+var defaultCompressionTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/manifest+json",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// streamingTypes are never compressed because clients expect each write to
+// arrive as soon as it is flushed.
+var streamingTypes = []string{
+	"text/event-stream",
+	"application/grpc",
+	"multipart/x-mixed-replace",
+}
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	"gzip": {New: func() any {
+		return gzip.NewWriter(io.Discard)
+	}},
+	"br": {New: func() any {
+		return brotli.NewWriterLevel(io.Discard, 5)
+	}},
+	"zstd": {New: func() any {
+		enc, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<22))
+		return enc
+	}},
+}
+
+type compressor struct {
+	encodings []string
+	types     []string
+	minSize   int
+}
+
+// compressionConfig returns the most specific compression settings for a path.
+func compressionConfig(domain models.Domain, sd models.Subdomain, path models.Path) *models.Compression {
+	switch {
+	case path.Compression != nil:
+		return path.Compression
+	case sd.Compression != nil:
+		return sd.Compression
+	default:
+		return domain.Compression
+	}
+}
+
+// newCompressor returns nil when compression is not enabled by cfg.
+func newCompressor(cfg *models.Compression) (*compressor, error) {
+	if cfg == nil || cfg.Disabled {
+		return nil, nil
+	}
+
+	c := &compressor{
+		encodings: defaultCompressionEncodings,
+		types:     defaultCompressionTypes,
+		minSize:   defaultCompressionMinSize,
+	}
+
+	if len(cfg.Encodings) > 0 {
+		c.encodings = nil
+		for _, e := range cfg.Encodings {
+			e = strings.ToLower(e)
+			if _, ok := encoderPools[e]; !ok {
+				return nil, fmt.Errorf("unsupported compression encoding %q", e)
+			}
+			c.encodings = append(c.encodings, e)
+		}
+	}
+
+	if len(cfg.Types) > 0 {
+		c.types = cfg.Types
+	}
+
+	if cfg.MinSize > 0 {
+		c.minSize = cfg.MinSize
+	}
+
+	return c, nil
+}
+
+// handler compresses the responses of next when the client accepts one of the
+// configured encodings.
+func (c *compressor) handler(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"), c.encodings)
+
+		// ranges refer to the uncompressed representation the upstream sent
+		if req.Header.Get("Range") != "" {
+			encoding = ""
+		}
+
+		cw := &compressWriter{ResponseWriter: w, c: c, encoding: encoding}
+		defer cw.finish()
+
+		next.ServeHTTP(cw, req)
+	})
+}
+
+// negotiateEncoding picks the supported encoding with the highest q-value in
+// the Accept-Encoding header. Ties go to the earlier entry in supported.
+func negotiateEncoding(header string, supported []string) string {
+	if header == "" {
+		return ""
+	}
+
+	qs := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		qs[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, e := range supported {
+		q, ok := qs[e]
+		if !ok {
+			q, ok = qs["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+
+	return best
+}
+
+// compressible reports whether a response with these headers may be compressed.
+func (c *compressor) compressible(h http.Header, status int) bool {
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+
+	if h.Get("Content-Encoding") != "" || strings.Contains(h.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	for _, t := range streamingTypes {
+		if strings.HasPrefix(mediaType, t) {
+			return false
+		}
+	}
+
+	for _, t := range c.types {
+		if strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+		if mediaType == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compressWriter holds back the status line until it knows whether the body
+// will be compressed. Bodies of unknown length are buffered up to the minimum
+// size before deciding.
+type compressWriter struct {
+	http.ResponseWriter
+	c        *compressor
+	encoding string
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buffering   bool
+	buf         []byte
+	enc         encoder
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+
+	// informational responses are sent straight through
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	cw.status = code
+	cw.wroteHeader = true
+
+	if code == http.StatusSwitchingProtocols {
+		cw.commit(false)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.decided && !cw.buffering {
+		h := cw.Header()
+		if h.Get("Content-Type") == "" && len(p) > 0 {
+			h.Set("Content-Type", http.DetectContentType(p))
+		}
+
+		if !cw.c.compressible(h, cw.status) {
+			cw.commit(false)
+		} else {
+			h.Add("Vary", "Accept-Encoding")
+
+			if cw.encoding == "" {
+				cw.commit(false)
+			} else if cl := h.Get("Content-Length"); cl != "" {
+				n, err := strconv.Atoi(cl)
+				cw.commit(err == nil && n >= cw.c.minSize)
+			} else {
+				cw.buffering = true
+			}
+		}
+	}
+
+	if cw.buffering {
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) >= cw.c.minSize {
+			if err := cw.commitBuffer(true); err != nil {
+				return 0, err
+			}
+		}
+
+		return len(p), nil
+	}
+
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+
+	return cw.ResponseWriter.Write(p)
+}
+
+// commit writes the status line, switching to the encoder if compress is set.
+func (cw *compressWriter) commit(compress bool) {
+	cw.decided = true
+	cw.buffering = false
+
+	if compress {
+		h := cw.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Accept-Ranges")
+
+		// the encoded bytes differ from the upstream's, so its ETag can only
+		// be kept as a weak validator
+		if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("Etag", "W/"+etag)
+		}
+
+		cw.enc = encoderPools[cw.encoding].Get().(encoder)
+		cw.enc.Reset(cw.ResponseWriter)
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+func (cw *compressWriter) commitBuffer(compress bool) error {
+	buf := cw.buf
+	cw.buf = nil
+	cw.commit(compress)
+
+	if len(buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+
+	return err
+}
+
+// Flush sends what has been written so far. A flush before the minimum size is
+// reached means the body is being streamed, so it is compressed without
+// waiting for more data.
+func (cw *compressWriter) Flush() {
+	if cw.buffering {
+		_ = cw.commitBuffer(true)
+	} else if cw.wroteHeader && !cw.decided {
+		_, _ = cw.Write(nil)
+		if cw.buffering {
+			_ = cw.commitBuffer(true)
+		}
+	}
+
+	if cw.enc != nil {
+		_ = cw.enc.Flush()
+	}
+
+	_ = http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// finish completes the response once the handler has returned.
+func (cw *compressWriter) finish() {
+	switch {
+	case cw.buffering:
+		_ = cw.commitBuffer(false)
+	case cw.wroteHeader && !cw.decided:
+		cw.commit(false)
+	}
+
+	if cw.enc != nil {
+		_ = cw.enc.Close()
+		cw.enc.Reset(io.Discard)
+		encoderPools[cw.encoding].Put(cw.enc)
+		cw.enc = nil
+	}
+}
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	t.Parallel()
+
+	supported := []string{"zstd", "br", "gzip"}
+
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{header: "", want: ""},
+		{header: "gzip, deflate, br", want: "br"},
+		{header: "gzip, deflate, br, zstd", want: "zstd"},
+		{header: "gzip;q=1.0, br;q=0.5", want: "gzip"},
+		{header: "identity", want: ""},
+		{header: "*", want: "zstd"},
+		{header: "*;q=0.1, gzip", want: "gzip"},
+		{header: "br;q=0, gzip;q=0", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.header, supported); got != tt.want {
+			t.Fatalf("negotiateEncoding(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func decodeBody(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+
+	var r io.Reader
+	switch encoding {
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("gzip reader: %v", err)
+		}
+		r = gr
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("zstd reader: %v", err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return string(body)
+	}
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("decode %s: %v", encoding, err)
+	}
+
+	return string(out)
+}
+
+func TestCompressorHandler(t *testing.T) {
+	t.Parallel()
+
+	large := strings.Repeat(`{"name":"routy","kind":"edge proxy"},`, 100)
+
+	tests := []struct {
+		name          string
+		accept        string
+		contentType   string
+		encoding      string
+		body          string
+		contentLength bool
+		flush         bool
+		wantEncoding  string
+		wantVary      bool
+	}{
+		{name: "gzip json", accept: "gzip", contentType: "application/json", body: large, wantEncoding: "gzip", wantVary: true},
+		{name: "brotli html", accept: "gzip, br", contentType: "text/html; charset=utf-8", body: large, wantEncoding: "br", wantVary: true},
+		{name: "zstd with content length", accept: "zstd", contentType: "text/plain", body: large, contentLength: true, wantEncoding: "zstd", wantVary: true},
+		{name: "sniffed content type", accept: "gzip", body: "<html>" + large, wantEncoding: "gzip", wantVary: true},
+		{name: "below minimum size", accept: "gzip", contentType: "application/json", body: `{"ok":true}`, wantVary: true},
+		{name: "below minimum size with content length", accept: "gzip", contentType: "application/json", body: `{"ok":true}`, contentLength: true, wantVary: true},
+		{name: "client does not accept", accept: "", contentType: "application/json", body: large, wantVary: true},
+		{name: "type not allowed", accept: "gzip", contentType: "image/png", body: large},
+		{name: "already encoded", accept: "gzip", contentType: "application/json", encoding: "br", body: large, wantEncoding: "br"},
+		{name: "server sent events", accept: "gzip", contentType: "text/event-stream", body: large, flush: true},
+	}
+
+	c, err := newCompressor(&models.Compression{})
+	if err != nil {
+		t.Fatalf("newCompressor: %v", err)
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			h := c.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				if tt.contentLength {
+					w.Header().Set("Content-Length", strconv.Itoa(len(tt.body)))
+				}
+				w.Header().Set("Etag", `"v1"`)
+				w.Header().Set("Accept-Ranges", "bytes")
+				w.WriteHeader(http.StatusOK)
+				half := len(tt.body) / 2
+				_, _ = w.Write([]byte(tt.body[:half]))
+				if tt.flush {
+					w.(http.Flusher).Flush()
+				}
+				_, _ = w.Write([]byte(tt.body[half:]))
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept-Encoding", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			gotEncoding := rec.Header().Get("Content-Encoding")
+			if gotEncoding != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", gotEncoding, tt.wantEncoding)
+			}
+			if gotVary := rec.Header().Get("Vary") == "Accept-Encoding"; gotVary != tt.wantVary {
+				t.Fatalf("Vary = %q, want Accept-Encoding: %v", rec.Header().Get("Vary"), tt.wantVary)
+			}
+			if tt.encoding == "" {
+				if got := decodeBody(t, gotEncoding, rec.Body.Bytes()); got != tt.body {
+					t.Fatalf("decoded body mismatch: got %d bytes, want %d", len(got), len(tt.body))
+				}
+			}
+			if gotEncoding != "" && tt.encoding == "" && rec.Header().Get("Content-Length") != "" {
+				t.Fatalf("Content-Length should be removed from compressed responses")
+			}
+
+			wantETag, wantRanges := `"v1"`, "bytes"
+			if gotEncoding != "" && tt.encoding == "" {
+				wantETag, wantRanges = `W/"v1"`, ""
+			}
+			if got := rec.Header().Get("Etag"); got != wantETag {
+				t.Fatalf("Etag = %q, want %q", got, wantETag)
+			}
+			if got := rec.Header().Get("Accept-Ranges"); got != wantRanges {
+				t.Fatalf("Accept-Ranges = %q, want %q", got, wantRanges)
+			}
+		})
+	}
+}
+
+func TestCompressorStreamingFlush(t *testing.T) {
+	t.Parallel()
+
+	c, err := newCompressor(&models.Compression{Encodings: []string{"gzip"}})
+	if err != nil {
+		t.Fatalf("newCompressor: %v", err)
+	}
+
+	h := c.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("chunk one "))
+		w.(http.Flusher).Flush()
+		_, _ = w.Write([]byte("chunk two"))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if !rec.Flushed {
+		t.Fatalf("flush was not passed through")
+	}
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", rec.Header().Get("Content-Encoding"))
+	}
+	if got := decodeBody(t, "gzip", rec.Body.Bytes()); got != "chunk one chunk two" {
+		t.Fatalf("decoded body = %q", got)
+	}
+}
+
+func TestNewCompressor(t *testing.T) {
+	t.Parallel()
+
+	if c, err := newCompressor(nil); c != nil || err != nil {
+		t.Fatalf("nil config should disable compression")
+	}
+	if c, err := newCompressor(&models.Compression{Disabled: true}); c != nil || err != nil {
+		t.Fatalf("disabled config should disable compression")
+	}
+	if _, err := newCompressor(&models.Compression{Encodings: []string{"deflate"}}); err == nil {
+		t.Fatalf("expected error for unsupported encoding")
+	}
+}
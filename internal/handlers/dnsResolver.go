@@ -2,83 +2,80 @@ package handlers
 
 import (
 	"context"
-	"fmt"
 	"net"
-	"net/http"
 	"net/url"
-	"sync"
+	"time"
 
-	"github.com/oorrwullie/routy/internal/logging"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const (
+	defaultDialTimeout           = 10 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = 60 * time.Second
+	defaultIdleConnTimeout       = 90 * time.Second
+)
+
+// resolver connects the transports to their upstreams. Proxies send requests
+// to the public host, so the transport, which is kept per upstream, dials the
+// upstream address instead of the one it is asked for. Paths sharing a host
+// and port can then still reach different upstreams.
 type resolver struct {
-	mu sync.Mutex
-	m  map[string]string
+	tracing *tracing
 }
 
-func (res *resolver) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
-	res.mu.Lock()
-	defer res.mu.Unlock()
-
-	host, _, _ := net.SplitHostPort(address)
+func newResolver(t *tracing) *resolver {
+	return &resolver{tracing: t}
+}
 
-	if resolvedAddr, ok := res.m[host]; ok {
-		return net.Dial(network, resolvedAddr)
+// dialUpstream returns a DialContext function that connects to upstream
+// whatever address it is asked to dial.
+func (res *resolver) dialUpstream(dialer *net.Dialer, upstream string) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return res.dial(ctx, dialer, network, upstream)
 	}
-	return net.Dial(network, address)
 }
 
-func (r *Routy) getDnsResolver() *http.Transport {
-	m := make(map[string]string)
-
-	for _, domain := range r.routes.Domains {
-		if len(domain.Paths) != 0 {
-			for _, path := range domain.Paths {
-				targetURL, err := url.Parse(path.Target)
-				if err != nil {
-					msg := fmt.Sprintf("failed to parse target URL for domain %s path %s: %v\n", domain.Name, path.Location, err)
-					r.EventLog <- logging.EventLogMessage{
-						Level:   "ERROR",
-						Caller:  "Route()->url.Parse()",
-						Message: msg,
-					}
-
-					continue
-				}
-
-				m[domain.Name] = targetURL.Host
-
-				break
-			}
-		}
+// dial connects to address, recording the dial as a span.
+func (res *resolver) dial(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	_, span := res.tracing.start(ctx, "upstream dial", trace.WithAttributes(
+		attribute.String("network.transport", network),
+		attribute.String("network.peer.address", address),
+	))
+	defer span.End()
+
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
 
-		for _, sd := range domain.Subdomains {
-			if len(sd.Paths) != 0 {
-				for _, path := range sd.Paths {
-					targetURL, err := url.Parse(path.Target)
-					if err != nil {
-						msg := fmt.Sprintf("failed to parse target URL for subdomain %s path %s: %v\n", sd.Name, path.Location, err)
-						r.EventLog <- logging.EventLogMessage{
-							Level:   "ERROR",
-							Caller:  "Route()->url.Parse()",
-							Message: msg,
-						}
+	return conn, err
+}
 
-						continue
-					}
+// timeoutOrDefault converts a timeout in milliseconds, using def when it is
+// not set.
+func timeoutOrDefault(ms int, def time.Duration) time.Duration {
+	if ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
 
-					dName := fmt.Sprintf("%s.%s", sd.Name, domain.Name)
-					m[dName] = targetURL.Host
+	return def
+}
 
-					break
-				}
-			}
-		}
+// upstreamAddress returns the host:port of u, filling in the default port for
+// its scheme.
+func upstreamAddress(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
 	}
 
-	t := &http.Transport{
-		DialContext: (&resolver{m: m}).DialContext,
+	port := "80"
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		port = "443"
 	}
 
-	return t
+	return net.JoinHostPort(u.Hostname(), port)
 }
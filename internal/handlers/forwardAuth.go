@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+const (
+	defaultForwardAuthTimeout = 5 * time.Second
+	maxForwardAuthCache       = 10000
+	maxForwardAuthBody        = 64 << 10
+)
+
+// forwardAuthHopHeaders are never copied between the auth service and the
+// client.
+var forwardAuthHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Content-Length",
+}
+
+// forwardAuth checks every request of a path with an external auth service.
+type forwardAuth struct {
+	address         string
+	headers         []string
+	responseHeaders []string
+	ttl             time.Duration
+	proxies         trustedProxies
+	client          *http.Client
+	eventLog        chan<- logging.EventLogMessage
+
+	mu      sync.Mutex
+	allowed map[string]forwardAuthDecision
+	now     func() time.Time
+}
+
+// forwardAuthDecision is a cached answer that allowed a request.
+type forwardAuthDecision struct {
+	headers http.Header
+	expires time.Time
+}
+
+// newForwardAuth returns nil when cfg is nil.
+func newForwardAuth(cfg *models.ForwardAuth, proxies trustedProxies, t *tracing, eventLog chan<- logging.EventLogMessage) (*forwardAuth, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	u, err := url.Parse(cfg.Address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid forward auth address %s", cfg.Address)
+	}
+
+	fa := &forwardAuth{
+		address:  cfg.Address,
+		ttl:      time.Duration(cfg.CacheTTL) * time.Millisecond,
+		proxies:  proxies,
+		eventLog: eventLog,
+		allowed:  make(map[string]forwardAuthDecision),
+		now:      time.Now,
+		client: &http.Client{
+			Timeout:   timeoutOrDefault(cfg.Timeout, defaultForwardAuthTimeout),
+			Transport: t.transport(http.DefaultTransport),
+			// redirects are answers meant for the client
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+
+	for _, h := range cfg.Headers {
+		fa.headers = append(fa.headers, http.CanonicalHeaderKey(h))
+	}
+	for _, h := range cfg.ResponseHeaders {
+		fa.responseHeaders = append(fa.responseHeaders, http.CanonicalHeaderKey(h))
+	}
+
+	return fa, nil
+}
+
+// authorize asks the auth service about req. When the request is allowed it
+// returns req with the auth service's response headers set; otherwise the
+// answer has been written to w and ok is false.
+func (fa *forwardAuth) authorize(w http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	key := fa.cacheKey(req)
+	if h, ok := fa.cached(key); ok {
+		return fa.allow(req, h), true
+	}
+
+	authReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, fa.address, nil)
+	if err != nil {
+		fa.fail(w, req, err)
+		return nil, false
+	}
+
+	fa.copyRequestHeaders(authReq.Header, req)
+
+	resp, err := fa.client.Do(authReq)
+	if err != nil {
+		fa.fail(w, req, err)
+		return nil, false
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		h := make(http.Header, len(fa.responseHeaders))
+		for _, k := range fa.responseHeaders {
+			if vs := resp.Header.Values(k); len(vs) > 0 {
+				h[k] = append([]string(nil), vs...)
+			}
+		}
+
+		fa.store(key, h)
+
+		return fa.allow(req, h), true
+	}
+
+	dst := w.Header()
+	for k, vs := range resp.Header {
+		dst[k] = append([]string(nil), vs...)
+	}
+	for _, k := range forwardAuthHopHeaders {
+		dst.Del(k)
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, io.LimitReader(resp.Body, maxForwardAuthBody))
+
+	return nil, false
+}
+
+// copyRequestHeaders sets the headers the auth service sees: the client's
+// headers, or those configured, and the original method and URL.
+func (fa *forwardAuth) copyRequestHeaders(dst http.Header, req *http.Request) {
+	if len(fa.headers) == 0 {
+		for k, vs := range req.Header {
+			dst[k] = append([]string(nil), vs...)
+		}
+		for _, k := range forwardAuthHopHeaders {
+			dst.Del(k)
+		}
+	} else {
+		for _, k := range fa.headers {
+			if vs := req.Header.Values(k); len(vs) > 0 {
+				dst[k] = append([]string(nil), vs...)
+			}
+		}
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	dst.Set("X-Forwarded-Method", req.Method)
+	dst.Set("X-Forwarded-Proto", proto)
+	dst.Set("X-Forwarded-Host", req.Host)
+	dst.Set("X-Forwarded-Uri", req.URL.RequestURI())
+	dst.Set("X-Forwarded-For", fa.proxies.clientAddress(req))
+	dst.Del("X-Real-Ip")
+}
+
+// allow returns req with the headers from the auth service. Client values of
+// those headers are dropped even when the service did not send them, so they
+// cannot be forged.
+func (fa *forwardAuth) allow(req *http.Request, h http.Header) *http.Request {
+	if len(fa.responseHeaders) == 0 {
+		return req
+	}
+
+	req = req.Clone(req.Context())
+	for _, k := range fa.responseHeaders {
+		req.Header.Del(k)
+		if vs, ok := h[k]; ok {
+			req.Header[k] = append([]string(nil), vs...)
+		}
+	}
+
+	return req
+}
+
+func (fa *forwardAuth) fail(w http.ResponseWriter, req *http.Request, err error) {
+	fa.eventLog <- logging.EventLogMessage{
+		Level:     "ERROR",
+		Caller:    "forwardAuth.authorize()",
+		Message:   fmt.Sprintf("forward auth request to %s failed: %v", fa.address, err),
+		RequestID: logging.RequestID(req.Context()),
+	}
+
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+// cacheKey identifies a request by its method, URL and the credentials it
+// carries. The credentials are the configured headers, or the Authorization
+// and Cookie headers.
+func (fa *forwardAuth) cacheKey(req *http.Request) string {
+	if fa.ttl <= 0 {
+		return ""
+	}
+
+	names := fa.headers
+	if len(names) == 0 {
+		names = []string{"Authorization", "Cookie"}
+	}
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%s\n%s\n%s\n%s\n", fa.proxies.clientAddress(req), req.Method, req.Host, req.URL.RequestURI())
+	for _, k := range names {
+		fmt.Fprintf(sum, "%s: %q\n", k, req.Header.Values(k))
+	}
+
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+func (fa *forwardAuth) cached(key string) (http.Header, bool) {
+	if key == "" {
+		return nil, false
+	}
+
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	d, ok := fa.allowed[key]
+	if !ok {
+		return nil, false
+	}
+
+	if !fa.now().Before(d.expires) {
+		delete(fa.allowed, key)
+		return nil, false
+	}
+
+	return d.headers, true
+}
+
+func (fa *forwardAuth) store(key string, h http.Header) {
+	if key == "" {
+		return
+	}
+
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	now := fa.now()
+	if len(fa.allowed) >= maxForwardAuthCache {
+		for k, d := range fa.allowed {
+			if !now.Before(d.expires) {
+				delete(fa.allowed, k)
+			}
+		}
+
+		// still full of live entries, so start over rather than grow
+		if len(fa.allowed) >= maxForwardAuthCache {
+			fa.allowed = make(map[string]forwardAuthDecision)
+		}
+	}
+
+	fa.allowed[key] = forwardAuthDecision{headers: h, expires: now.Add(fa.ttl)}
+}
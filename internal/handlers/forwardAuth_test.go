@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+// newTestAuthService answers with the user named in the Authorization header,
+// redirects requests without one to a login page and rejects any other.
+func newTestAuthService(t *testing.T, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+
+		if req.Header.Get("X-Forwarded-Method") == "" || req.Header.Get("X-Forwarded-Uri") == "" {
+			t.Errorf("auth request is missing the original method or URI: %v", req.Header)
+		}
+
+		switch req.Header.Get("Authorization") {
+		case "":
+			http.Redirect(w, req, "https://sso.example.com/login?rd="+req.Header.Get("X-Forwarded-Uri"), http.StatusFound)
+		case "Bearer alice":
+			w.Header().Set("X-Auth-User", "alice")
+			w.Header().Set("X-Auth-Groups", "admins")
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.Header().Set("Www-Authenticate", `Bearer realm="routy"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = io.WriteString(w, "denied")
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func echoAuthHeaders() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, req.Header.Get("X-Auth-User")+"|"+req.Header.Get("X-Auth-Groups"))
+	})
+}
+
+func TestForwardAuth(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	srv := newTestAuthService(t, &calls)
+
+	fa, err := newForwardAuth(&models.ForwardAuth{
+		Address:         srv.URL,
+		ResponseHeaders: []string{"x-auth-user", "x-auth-groups"},
+	}, nil, nil, make(chan logging.EventLogMessage, 1))
+	if err != nil {
+		t.Fatalf("newForwardAuth() error = %v", err)
+	}
+	handler := authHandler([]authorizer{fa}, echoAuthHeaders())
+
+	tests := []struct {
+		name          string
+		authorization string
+		forgedUser    string
+		wantStatus    int
+		wantBody      string
+		wantHeader    string
+		wantValue     string
+	}{
+		{
+			name:          "allowed",
+			authorization: "Bearer alice",
+			wantStatus:    http.StatusOK,
+			wantBody:      "alice|admins",
+		},
+		{
+			name:          "forged identity is replaced",
+			authorization: "Bearer alice",
+			forgedUser:    "mallory",
+			wantStatus:    http.StatusOK,
+			wantBody:      "alice|admins",
+		},
+		{
+			name:       "redirect to login",
+			wantStatus: http.StatusFound,
+			wantHeader: "Location",
+			wantValue:  "https://sso.example.com/login?rd=/private?x=1",
+		},
+		{
+			name:          "rejected",
+			authorization: "Bearer mallory",
+			wantStatus:    http.StatusUnauthorized,
+			wantBody:      "denied",
+			wantHeader:    "Www-Authenticate",
+			wantValue:     `Bearer realm="routy"`,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "https://app.example.com/private?x=1", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.forgedUser != "" {
+				req.Header.Set("X-Auth-User", tt.forgedUser)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Fatalf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+			if tt.wantHeader != "" && rec.Header().Get(tt.wantHeader) != tt.wantValue {
+				t.Fatalf("%s = %q, want %q", tt.wantHeader, rec.Header().Get(tt.wantHeader), tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestForwardAuthClientAddress(t *testing.T) {
+	t.Parallel()
+
+	seen := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen <- req.Header.Clone()
+	}))
+	t.Cleanup(srv.Close)
+
+	proxies, err := newTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("newTrustedProxies() error = %v", err)
+	}
+
+	fa, err := newForwardAuth(&models.ForwardAuth{Address: srv.URL}, proxies, nil, make(chan logging.EventLogMessage, 1))
+	if err != nil {
+		t.Fatalf("newForwardAuth() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       string
+	}{
+		{name: "spoofed by the client", remoteAddr: "198.51.100.7:1234", want: "198.51.100.7"},
+		{name: "from a trusted proxy", remoteAddr: "10.0.0.1:1234", want: "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		req.Header.Set("X-Real-Ip", "192.0.2.1")
+
+		if _, ok := fa.authorize(httptest.NewRecorder(), req); !ok {
+			t.Fatalf("%s: authorize() = false, want true", tt.name)
+		}
+
+		h := <-seen
+		if got := h.Values("X-Forwarded-For"); len(got) != 1 || got[0] != tt.want {
+			t.Fatalf("%s: X-Forwarded-For = %v, want %q", tt.name, got, tt.want)
+		}
+		if got := h.Get("X-Real-Ip"); got != "" {
+			t.Fatalf("%s: X-Real-Ip = %q, want it removed", tt.name, got)
+		}
+	}
+}
+
+func TestForwardAuthCache(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	srv := newTestAuthService(t, &calls)
+
+	fa, err := newForwardAuth(&models.ForwardAuth{
+		Address:         srv.URL,
+		ResponseHeaders: []string{"X-Auth-User"},
+		CacheTTL:        1000,
+	}, nil, nil, make(chan logging.EventLogMessage, 1))
+	if err != nil {
+		t.Fatalf("newForwardAuth() error = %v", err)
+	}
+
+	now := time.Now()
+	fa.now = func() time.Time { return now }
+
+	handler := authHandler([]authorizer{fa}, echoAuthHeaders())
+
+	serve := func(authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+		req.Header.Set("Authorization", authorization)
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		if rec := serve("Bearer alice"); rec.Body.String() != "alice|" {
+			t.Fatalf("body = %q, want %q", rec.Body.String(), "alice|")
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("auth calls = %d, want 1", got)
+	}
+
+	// rejections are never cached
+	serve("Bearer mallory")
+	serve("Bearer mallory")
+	if got := calls.Load(); got != 3 {
+		t.Fatalf("auth calls = %d, want 3", got)
+	}
+
+	now = now.Add(time.Second)
+	serve("Bearer alice")
+	if got := calls.Load(); got != 4 {
+		t.Fatalf("auth calls after expiry = %d, want 4", got)
+	}
+}
+
+func TestForwardAuthUnavailable(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	address := srv.URL
+	srv.Close()
+
+	eventLog := make(chan logging.EventLogMessage, 1)
+	fa, err := newForwardAuth(&models.ForwardAuth{Address: address}, nil, nil, eventLog)
+	if err != nil {
+		t.Fatalf("newForwardAuth() error = %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	authHandler([]authorizer{fa}, echoAuthHeaders()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if msg := <-eventLog; msg.Level != "ERROR" {
+		t.Fatalf("event level = %q, want %q", msg.Level, "ERROR")
+	}
+}
+
+func TestNewForwardAuthInvalidAddress(t *testing.T) {
+	t.Parallel()
+
+	for _, address := range []string{"", "auth.example.com", "ftp://auth.example.com"} {
+		if _, err := newForwardAuth(&models.ForwardAuth{Address: address}, nil, nil, nil); err == nil {
+			t.Fatalf("newForwardAuth(%q) error = nil, want an error", address)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// geoIPCheckInterval is how often the databases are checked for changes.
+const geoIPCheckInterval = 5 * time.Second
+
+// geoIP finds the country and autonomous system of clients.
+type geoIP struct {
+	dbs           []*geoDB
+	proxies       trustedProxies
+	countryHeader string
+	asnHeader     string
+}
+
+// geoDB is a database file, which is read again when it changes.
+type geoDB struct {
+	file     string
+	now      func() time.Time
+	eventLog chan<- logging.EventLogMessage
+
+	mu        sync.Mutex
+	reader    *maxminddb.Reader
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// geoRecord holds the fields routy reads from country and ASN databases.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// newGeoIP returns nil when cfg is nil. Clients are located by their
+// connection address, or by the forwarding headers set by proxies.
+func newGeoIP(cfg *models.GeoIPConfig, proxies trustedProxies, eventLog chan<- logging.EventLogMessage) (*geoIP, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	if len(cfg.Databases) == 0 {
+		return nil, fmt.Errorf("geoIP needs at least one database")
+	}
+
+	g := &geoIP{proxies: proxies}
+	if cfg.CountryHeader != "" {
+		g.countryHeader = http.CanonicalHeaderKey(cfg.CountryHeader)
+	}
+	if cfg.ASNHeader != "" {
+		g.asnHeader = http.CanonicalHeaderKey(cfg.ASNHeader)
+	}
+
+	for _, name := range cfg.Databases {
+		file, err := dataFilePath(name)
+		if err != nil {
+			return nil, err
+		}
+
+		db := &geoDB{file: file, now: time.Now, eventLog: eventLog}
+		if err := db.load(); err != nil {
+			return nil, err
+		}
+
+		g.dbs = append(g.dbs, db)
+	}
+
+	return g, nil
+}
+
+// annotate stores the client's location in the request context for the
+// access log and geo rules, and sets the configured headers. Headers the
+// client sent under those names are always removed.
+func (g *geoIP) annotate(req *http.Request) *http.Request {
+	if g == nil {
+		return req
+	}
+
+	geo := g.lookup(g.proxies.clientAddress(req))
+
+	req = req.WithContext(logging.WithGeo(req.Context(), geo))
+
+	if g.countryHeader != "" || g.asnHeader != "" {
+		req.Header = req.Header.Clone()
+		if g.countryHeader != "" {
+			req.Header.Del(g.countryHeader)
+			if geo.Country != "" {
+				req.Header.Set(g.countryHeader, geo.Country)
+			}
+		}
+		if g.asnHeader != "" {
+			req.Header.Del(g.asnHeader)
+			if geo.ASN != 0 {
+				req.Header.Set(g.asnHeader, strconv.FormatUint(uint64(geo.ASN), 10))
+			}
+		}
+	}
+
+	return req
+}
+
+// lookup merges what every database knows about addr.
+func (g *geoIP) lookup(addr string) logging.Geo {
+	var geo logging.Geo
+
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return geo
+	}
+	ip = ip.Unmap()
+
+	for _, db := range g.dbs {
+		var rec geoRecord
+		if err := db.current().Lookup(ip).Decode(&rec); err != nil {
+			continue
+		}
+
+		if geo.Country == "" {
+			geo.Country = rec.Country.ISOCode
+		}
+		if geo.ASN == 0 {
+			geo.ASN = rec.ASN
+		}
+	}
+
+	return geo
+}
+
+// current returns the reader, reading the file again first when it has
+// changed. A file that cannot be read leaves the previous data in place.
+func (db *geoDB) current() *maxminddb.Reader {
+	db.mu.Lock()
+	if db.now().Sub(db.checkedAt) < geoIPCheckInterval {
+		defer db.mu.Unlock()
+		return db.reader
+	}
+	db.checkedAt = db.now()
+	modTime := db.modTime
+	db.mu.Unlock()
+
+	if fi, err := os.Stat(db.file); err == nil && !fi.ModTime().Equal(modTime) {
+		if err := db.load(); err != nil {
+			db.eventLog <- logging.EventLogMessage{
+				Level:   "ERROR",
+				Caller:  "geoDB.current()->db.load()",
+				Message: err.Error(),
+			}
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.reader
+}
+
+// load reads the whole file into memory, so replacing the reader never
+// affects lookups still using the previous one.
+func (db *geoDB) load() error {
+	fi, err := os.Stat(db.file)
+	if err != nil {
+		return fmt.Errorf("failed to read geoIP database: %v", err)
+	}
+
+	data, err := os.ReadFile(db.file)
+	if err != nil {
+		return fmt.Errorf("failed to read geoIP database: %v", err)
+	}
+
+	reader, err := maxminddb.OpenBytes(data)
+	if err != nil {
+		return fmt.Errorf("invalid geoIP database %s: %v", db.file, err)
+	}
+
+	db.mu.Lock()
+	db.reader = reader
+	db.modTime = fi.ModTime()
+	db.checkedAt = db.now()
+	db.mu.Unlock()
+
+	return nil
+}
+
+// geoRules allow or deny clients of a path by their location.
+type geoRules struct {
+	allowCountries []string
+	denyCountries  []string
+	allowASNs      []uint
+	denyASNs       []uint
+}
+
+// newGeoRules returns nil when cfg is nil. The rules need the client's
+// location, so a geoIP database must be configured.
+func newGeoRules(cfg *models.GeoRules, g *geoIP) (*geoRules, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	if g == nil {
+		return nil, fmt.Errorf("geo rules need a geoIP database")
+	}
+
+	upper := func(codes []string) []string {
+		out := make([]string, len(codes))
+		for i, c := range codes {
+			out[i] = strings.ToUpper(c)
+		}
+		return out
+	}
+
+	return &geoRules{
+		allowCountries: upper(cfg.AllowCountries),
+		denyCountries:  upper(cfg.DenyCountries),
+		allowASNs:      cfg.AllowASNs,
+		denyASNs:       cfg.DenyASNs,
+	}, nil
+}
+
+// allow answers 403 and returns false when the client may not use the path.
+func (gr *geoRules) allow(w http.ResponseWriter, req *http.Request) bool {
+	if gr == nil {
+		return true
+	}
+
+	if !gr.allows(req) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+func (gr *geoRules) allows(req *http.Request) bool {
+	geo, _ := logging.GeoFrom(req.Context())
+
+	if geo.Country != "" && slices.Contains(gr.denyCountries, geo.Country) {
+		return false
+	}
+	if geo.ASN != 0 && slices.Contains(gr.denyASNs, geo.ASN) {
+		return false
+	}
+
+	if len(gr.allowCountries) == 0 && len(gr.allowASNs) == 0 {
+		return true
+	}
+
+	return (geo.Country != "" && slices.Contains(gr.allowCountries, geo.Country)) ||
+		(geo.ASN != 0 && slices.Contains(gr.allowASNs, geo.ASN))
+}
@@ -0,0 +1,391 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+// mmdbNode is a node of an IPv4 search tree. Children are nodes, data
+// offsets or nil.
+type mmdbNode struct {
+	children [2]any
+}
+
+// writeTestMMDB writes a MaxMind format database mapping IPv4 networks to
+// records.
+func writeTestMMDB(t *testing.T, file string, records map[string]map[string]any) {
+	t.Helper()
+
+	var data bytes.Buffer
+	root := &mmdbNode{}
+
+	networks := make([]string, 0, len(records))
+	for n := range records {
+		networks = append(networks, n)
+	}
+	sort.Strings(networks)
+
+	for _, n := range networks {
+		prefix := netip.MustParsePrefix(n)
+		offset := data.Len()
+		data.Write(mmdbEncode(records[n]))
+
+		ip := prefix.Addr().As4()
+		node := root
+		for i := 0; i < prefix.Bits(); i++ {
+			bit := (ip[i/8] >> (7 - i%8)) & 1
+			if i == prefix.Bits()-1 {
+				node.children[bit] = offset
+				break
+			}
+
+			child, ok := node.children[bit].(*mmdbNode)
+			if !ok {
+				child = &mmdbNode{}
+				node.children[bit] = child
+			}
+			node = child
+		}
+	}
+
+	// number the nodes breadth first
+	nodes := []*mmdbNode{root}
+	index := map[*mmdbNode]int{root: 0}
+	for i := 0; i < len(nodes); i++ {
+		for _, c := range nodes[i].children {
+			if child, ok := c.(*mmdbNode); ok {
+				index[child] = len(nodes)
+				nodes = append(nodes, child)
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	for _, n := range nodes {
+		for _, c := range n.children {
+			record := len(nodes)
+			switch v := c.(type) {
+			case *mmdbNode:
+				record = index[v]
+			case int:
+				record = len(nodes) + 16 + v
+			}
+			out.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+		}
+	}
+
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.WriteString("\xab\xcd\xefMaxMind.com")
+	out.Write(mmdbEncode(map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+		"database_type":               "Routy-Test",
+		"description":                 map[string]any{"en": "test"},
+		"ip_version":                  uint16(4),
+		"languages":                   []any{"en"},
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(24),
+	}))
+
+	if err := os.WriteFile(file, out.Bytes(), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+}
+
+// mmdbEncode encodes the value types the tests need in the MaxMind data
+// section format.
+func mmdbEncode(v any) []byte {
+	var buf bytes.Buffer
+
+	control := func(typ byte, size int) {
+		extended := typ > 7
+		first := typ << 5
+		if extended {
+			first = 0
+		}
+
+		switch {
+		case size < 29:
+			buf.WriteByte(first | byte(size))
+			if extended {
+				buf.WriteByte(typ - 7)
+			}
+		default:
+			buf.WriteByte(first | 29)
+			if extended {
+				buf.WriteByte(typ - 7)
+			}
+			buf.WriteByte(byte(size - 29))
+		}
+	}
+
+	uintBytes := func(n uint64) []byte {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, n)
+		return bytes.TrimLeft(b, "\x00")
+	}
+
+	switch v := v.(type) {
+	case string:
+		control(2, len(v))
+		buf.WriteString(v)
+	case uint16:
+		b := uintBytes(uint64(v))
+		control(5, len(b))
+		buf.Write(b)
+	case uint32:
+		b := uintBytes(uint64(v))
+		control(6, len(b))
+		buf.Write(b)
+	case uint64:
+		b := uintBytes(v)
+		control(9, len(b))
+		buf.Write(b)
+	case map[string]any:
+		control(7, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			buf.Write(mmdbEncode(k))
+			buf.Write(mmdbEncode(v[k]))
+		}
+	case []any:
+		control(11, len(v))
+		for _, e := range v {
+			buf.Write(mmdbEncode(e))
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func writeTestGeoDatabases(t *testing.T) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	country := filepath.Join(dir, "country.mmdb")
+	asn := filepath.Join(dir, "asn.mmdb")
+
+	writeTestMMDB(t, country, map[string]map[string]any{
+		"192.0.2.0/24":    {"country": map[string]any{"iso_code": "DE"}},
+		"198.51.100.0/24": {"country": map[string]any{"iso_code": "US"}},
+	})
+	writeTestMMDB(t, asn, map[string]map[string]any{
+		"192.0.2.0/25":    {"autonomous_system_number": uint32(64500), "autonomous_system_organization": "Example"},
+		"198.51.100.0/24": {"autonomous_system_number": uint32(64501)},
+	})
+
+	return country, asn
+}
+
+func TestGeoIPAnnotate(t *testing.T) {
+	t.Parallel()
+
+	country, asn := writeTestGeoDatabases(t)
+
+	g, err := newGeoIP(&models.GeoIPConfig{Databases: []string{country, asn}, CountryHeader: "X-Country", ASNHeader: "X-ASN"}, nil, nil)
+	if err != nil {
+		t.Fatalf("newGeoIP() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		remoteAddr  string
+		wantGeo     logging.Geo
+		wantCountry string
+		wantASN     string
+	}{
+		{name: "both databases", remoteAddr: "192.0.2.10:1234", wantGeo: logging.Geo{Country: "DE", ASN: 64500}, wantCountry: "DE", wantASN: "64500"},
+		{name: "country only", remoteAddr: "192.0.2.200:1234", wantGeo: logging.Geo{Country: "DE"}, wantCountry: "DE"},
+		{name: "unknown", remoteAddr: "203.0.113.1:1234"},
+		{name: "ipv6 in ipv4 databases", remoteAddr: "[2001:db8::1]:1234"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Country", "forged")
+
+			req = g.annotate(req)
+
+			geo, ok := logging.GeoFrom(req.Context())
+			if !ok || geo != tt.wantGeo {
+				t.Fatalf("geo = %+v, want %+v", geo, tt.wantGeo)
+			}
+			if got := req.Header.Get("X-Country"); got != tt.wantCountry {
+				t.Fatalf("X-Country = %q, want %q", got, tt.wantCountry)
+			}
+			if got := req.Header.Get("X-Asn"); got != tt.wantASN {
+				t.Fatalf("X-Asn = %q, want %q", got, tt.wantASN)
+			}
+		})
+	}
+}
+
+func TestGeoRules(t *testing.T) {
+	t.Parallel()
+
+	country, asn := writeTestGeoDatabases(t)
+
+	g, err := newGeoIP(&models.GeoIPConfig{Databases: []string{country, asn}}, nil, nil)
+	if err != nil {
+		t.Fatalf("newGeoIP() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		rules      models.GeoRules
+		remoteAddr string
+		want       bool
+	}{
+		{name: "allowed country", rules: models.GeoRules{AllowCountries: []string{"de"}}, remoteAddr: "192.0.2.10:1", want: true},
+		{name: "other country", rules: models.GeoRules{AllowCountries: []string{"DE"}}, remoteAddr: "198.51.100.1:1", want: false},
+		{name: "unknown country", rules: models.GeoRules{AllowCountries: []string{"DE"}}, remoteAddr: "203.0.113.1:1", want: false},
+		{name: "denied country", rules: models.GeoRules{DenyCountries: []string{"US"}}, remoteAddr: "198.51.100.1:1", want: false},
+		{name: "unknown passes deny", rules: models.GeoRules{DenyCountries: []string{"US"}}, remoteAddr: "203.0.113.1:1", want: true},
+		{name: "allowed asn", rules: models.GeoRules{AllowCountries: []string{"FR"}, AllowASNs: []uint{64501}}, remoteAddr: "198.51.100.1:1", want: true},
+		{name: "denied asn wins", rules: models.GeoRules{AllowCountries: []string{"DE"}, DenyASNs: []uint{64500}}, remoteAddr: "192.0.2.10:1", want: false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			gr, err := newGeoRules(&tt.rules, g)
+			if err != nil {
+				t.Fatalf("newGeoRules() error = %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+			req.RemoteAddr = tt.remoteAddr
+
+			rec := httptest.NewRecorder()
+			if got := gr.allow(rec, g.annotate(req)); got != tt.want {
+				t.Fatalf("allow() = %v, want %v", got, tt.want)
+			}
+			if !tt.want && rec.Code != http.StatusForbidden {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusForbidden)
+			}
+		})
+	}
+
+	if _, err := newGeoRules(&models.GeoRules{DenyCountries: []string{"US"}}, nil); err == nil {
+		t.Fatalf("newGeoRules() without a database error = nil, want an error")
+	}
+}
+
+func TestGeoRulesForwardedAddress(t *testing.T) {
+	t.Parallel()
+
+	country, _ := writeTestGeoDatabases(t)
+
+	proxies, err := newTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("newTrustedProxies() error = %v", err)
+	}
+
+	g, err := newGeoIP(&models.GeoIPConfig{Databases: []string{country}}, proxies, nil)
+	if err != nil {
+		t.Fatalf("newGeoIP() error = %v", err)
+	}
+
+	gr, err := newGeoRules(&models.GeoRules{AllowCountries: []string{"DE"}}, g)
+	if err != nil {
+		t.Fatalf("newGeoRules() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		value      string
+		want       bool
+	}{
+		{name: "spoofed forwarded for", remoteAddr: "198.51.100.1:1", header: "X-Forwarded-For", value: "192.0.2.10", want: false},
+		{name: "spoofed real ip", remoteAddr: "198.51.100.1:1", header: "X-Real-Ip", value: "192.0.2.10", want: false},
+		{name: "trusted proxy", remoteAddr: "10.0.0.1:1", header: "X-Forwarded-For", value: "192.0.2.10", want: true},
+		{name: "spoofed entry behind a trusted proxy", remoteAddr: "10.0.0.1:1", header: "X-Forwarded-For", value: "192.0.2.10, 198.51.100.1", want: false},
+		{name: "chain of trusted proxies", remoteAddr: "10.0.0.1:1", header: "X-Forwarded-For", value: "192.0.2.10, 10.0.0.2", want: true},
+		{name: "real ip from a trusted proxy", remoteAddr: "10.0.0.1:1", header: "X-Real-Ip", value: "192.0.2.10", want: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set(tt.header, tt.value)
+
+			if got := gr.allow(httptest.NewRecorder(), g.annotate(req)); got != tt.want {
+				t.Fatalf("allow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeoIPReload(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "country.mmdb")
+	writeTestMMDB(t, file, map[string]map[string]any{"192.0.2.0/24": {"country": map[string]any{"iso_code": "DE"}}})
+
+	g, err := newGeoIP(&models.GeoIPConfig{Databases: []string{file}}, nil, make(chan logging.EventLogMessage, 1))
+	if err != nil {
+		t.Fatalf("newGeoIP() error = %v", err)
+	}
+
+	now := time.Now()
+	g.dbs[0].now = func() time.Time { return now }
+
+	writeTestMMDB(t, file, map[string]map[string]any{"192.0.2.0/24": {"country": map[string]any{"iso_code": "NL"}}})
+	if err := os.Chtimes(file, now, now.Add(time.Minute)); err != nil {
+		t.Fatalf("Chtimes() error = %v", err)
+	}
+
+	if got := g.lookup("192.0.2.1").Country; got != "DE" {
+		t.Fatalf("country before the check interval = %q, want %q", got, "DE")
+	}
+
+	now = now.Add(geoIPCheckInterval)
+
+	if got := g.lookup("192.0.2.1").Country; got != "NL" {
+		t.Fatalf("country after reload = %q, want %q", got, "NL")
+	}
+
+	// a broken file keeps the previous data
+	if err := os.WriteFile(file, []byte("garbage"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := os.Chtimes(file, now, now.Add(2*time.Minute)); err != nil {
+		t.Fatalf("Chtimes() error = %v", err)
+	}
+
+	now = now.Add(geoIPCheckInterval)
+
+	if got := g.lookup("192.0.2.1").Country; got != "NL" {
+		t.Fatalf("country after a broken update = %q, want %q", got, "NL")
+	}
+}
@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	grpcStatusDeadlineExceeded = 4
+	grpcStatusUnavailable      = 14
+
+	grpcWebTrailerFlag = 0x80
+)
+
+// upstreamProtocols are the values accepted for a path's protocol.
+var upstreamProtocols = []string{"", "http1", "h2", "h2c"}
+
+// checkUpstreamProtocol reports whether protocol can be used with target.
+func checkUpstreamProtocol(protocol string, target *url.URL) error {
+	if !containsString(upstreamProtocols, protocol) {
+		return fmt.Errorf("unsupported upstream protocol %q", protocol)
+	}
+
+	switch {
+	case protocol == "h2" && target.Scheme != "https":
+		return fmt.Errorf("protocol h2 requires an https target")
+	case protocol == "h2c" && target.Scheme != "http":
+		return fmt.Errorf("protocol h2c requires an http target")
+	}
+
+	return nil
+}
+
+// setUpstreamProtocol configures t for the path's upstream protocol.
+func setUpstreamProtocol(t *http.Transport, protocol string) {
+	switch protocol {
+	case "h2":
+		t.ForceAttemptHTTP2 = true
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetHTTP2(true)
+	case "h2c":
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetUnencryptedHTTP2(true)
+	}
+}
+
+func isGRPC(req *http.Request) bool {
+	ct := req.Header.Get("Content-Type")
+	return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+")
+}
+
+func isGRPCWeb(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc-web")
+}
+
+// grpcHandler applies the client's grpc-timeout as a deadline on gRPC calls
+// and, when grpcWeb is set, translates gRPC-Web calls to gRPC.
+func grpcHandler(next http.Handler, grpcWeb bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if grpcWeb && isGRPCWeb(req) {
+			var gw *grpcWebWriter
+			w, req, gw = translateGRPCWeb(w, req)
+			defer gw.finish()
+		}
+
+		if isGRPC(req) {
+			if timeout, ok := parseGRPCTimeout(req.Header.Get("Grpc-Timeout")); ok {
+				ctx, cancel := context.WithTimeout(req.Context(), timeout)
+				defer cancel()
+				req = req.WithContext(ctx)
+			}
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// parseGRPCTimeout parses a grpc-timeout header value such as 100m or 5S.
+func parseGRPCTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+
+	unit, ok := units[v[len(v)-1]]
+	if !ok {
+		return 0, false
+	}
+
+	return time.Duration(n) * unit, true
+}
+
+// writeGRPCError answers a gRPC call that could not reach the upstream with a
+// trailers-only response, as gRPC clients ignore the HTTP status.
+func writeGRPCError(w http.ResponseWriter, err error) {
+	code := grpcStatusUnavailable
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		code = grpcStatusDeadlineExceeded
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(code))
+	h.Set("Grpc-Message", url.PathEscape(err.Error()))
+	w.WriteHeader(http.StatusOK)
+}
+
+// translateGRPCWeb turns a gRPC-Web request into a gRPC request and returns a
+// writer that turns the gRPC response back into gRPC-Web.
+func translateGRPCWeb(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, *http.Request, *grpcWebWriter) {
+	ct := req.Header.Get("Content-Type")
+	text := strings.HasPrefix(ct, "application/grpc-web-text")
+
+	suffix := ""
+	if i := strings.Index(ct, "+"); i >= 0 {
+		suffix = ct[i:]
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Content-Type", "application/grpc"+suffix)
+	req.Header.Set("Te", "trailers")
+	req.Header.Del("Content-Length")
+	req.ContentLength = -1
+
+	if text && req.Body != nil {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{base64.NewDecoder(base64.StdEncoding, req.Body), req.Body}
+	}
+
+	responseType := "application/grpc-web" + suffix
+	if text {
+		responseType = "application/grpc-web-text" + suffix
+	}
+
+	gw := &grpcWebWriter{ResponseWriter: w, text: text, contentType: responseType}
+
+	return gw, req, gw
+}
+
+// grpcWebWriter rewrites a gRPC response as gRPC-Web: trailers are sent as a
+// final length-prefixed frame in the body, and the body is base64 encoded for
+// the text variant.
+type grpcWebWriter struct {
+	http.ResponseWriter
+	text        bool
+	contentType string
+
+	wroteHeader bool
+	headerKeys  map[string]bool
+	enc         io.WriteCloser
+}
+
+func (gw *grpcWebWriter) WriteHeader(code int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+
+	h := gw.Header()
+	h.Set("Content-Type", gw.contentType)
+	h.Del("Content-Length")
+
+	// trailers are sent in the body, so only the headers present now go out
+	// as headers
+	declared := h.Values("Trailer")
+	h.Del("Trailer")
+	gw.headerKeys = make(map[string]bool, len(h))
+	for k := range h {
+		gw.headerKeys[k] = true
+	}
+	for _, d := range declared {
+		for _, k := range strings.Split(d, ",") {
+			delete(gw.headerKeys, http.CanonicalHeaderKey(strings.TrimSpace(k)))
+		}
+	}
+
+	gw.ResponseWriter.WriteHeader(code)
+}
+
+func (gw *grpcWebWriter) Write(p []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+
+	if !gw.text {
+		return gw.ResponseWriter.Write(p)
+	}
+
+	if gw.enc == nil {
+		gw.enc = base64.NewEncoder(base64.StdEncoding, gw.ResponseWriter)
+	}
+
+	return gw.enc.Write(p)
+}
+
+// Flush ends the current base64 chunk so what has been written so far can be
+// decoded by the client.
+func (gw *grpcWebWriter) Flush() {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+
+	if gw.enc != nil {
+		_ = gw.enc.Close()
+		gw.enc = nil
+	}
+
+	_ = http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+func (gw *grpcWebWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+// finish writes the trailers frame once the upstream response is complete.
+func (gw *grpcWebWriter) finish() {
+	if !gw.wroteHeader {
+		return
+	}
+
+	h := gw.Header()
+	trailers := make(map[string]string)
+	for k, vs := range h {
+		name := strings.TrimPrefix(k, http.TrailerPrefix)
+		if name != k {
+			// the frame replaces the trailers net/http would send
+			h.Del(k)
+		} else if gw.headerKeys[k] {
+			continue
+		}
+
+		if len(vs) > 0 {
+			trailers[strings.ToLower(name)] = strings.Join(vs, ", ")
+		}
+	}
+
+	if len(trailers) == 0 {
+		if gw.enc != nil {
+			_ = gw.enc.Close()
+		}
+		return
+	}
+
+	names := make([]string, 0, len(trailers))
+	for k := range trailers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var block bytes.Buffer
+	for _, k := range names {
+		fmt.Fprintf(&block, "%s: %s\r\n", k, trailers[k])
+	}
+
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	frame = append(frame, block.Bytes()...)
+
+	_, _ = gw.Write(frame)
+	if gw.enc != nil {
+		_ = gw.enc.Close()
+		gw.enc = nil
+	}
+}
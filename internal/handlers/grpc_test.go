@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+func TestParseGRPCTimeout(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{value: "100m", want: 100 * time.Millisecond, wantOK: true},
+		{value: "5S", want: 5 * time.Second, wantOK: true},
+		{value: "1H", want: time.Hour, wantOK: true},
+		{value: "250u", want: 250 * time.Microsecond, wantOK: true},
+		{value: "", wantOK: false},
+		{value: "10x", wantOK: false},
+		{value: "123456789S", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.value, func(t *testing.T) {
+			t.Parallel()
+
+			got, ok := parseGRPCTimeout(tt.value)
+			if ok != tt.wantOK || got != tt.want {
+				t.Fatalf("parseGRPCTimeout(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCheckUpstreamProtocol(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		protocol string
+		target   string
+		wantErr  bool
+	}{
+		{protocol: "", target: "http://127.0.0.1"},
+		{protocol: "http1", target: "https://127.0.0.1"},
+		{protocol: "h2", target: "https://127.0.0.1"},
+		{protocol: "h2", target: "http://127.0.0.1", wantErr: true},
+		{protocol: "h2c", target: "http://127.0.0.1"},
+		{protocol: "h2c", target: "https://127.0.0.1", wantErr: true},
+		{protocol: "spdy", target: "https://127.0.0.1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.protocol+" "+tt.target, func(t *testing.T) {
+			t.Parallel()
+
+			u, _ := url.Parse(tt.target)
+			if err := checkUpstreamProtocol(tt.protocol, u); (err != nil) != tt.wantErr {
+				t.Fatalf("checkUpstreamProtocol() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func newTestProxyRouty() *Routy {
+	return &Routy{
+		routes:     &models.Routes{},
+		transports: newTransportRegistry(newResolver(nil)),
+	}
+}
+
+func TestGRPCOverH2C(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 {
+			t.Errorf("upstream protocol = %s, want HTTP/2", req.Proto)
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("\x00\x00\x00\x00\x02hi"))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "")
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+
+	r := newTestProxyRouty()
+	proxy, err := r.newProxy(models.Domain{}, models.Subdomain{}, models.Path{Location: "/", Target: upstream.URL, Protocol: "h2c"})
+	if err != nil {
+		t.Fatalf("newProxy() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/pkg.Service/Method", bytes.NewReader([]byte("\x00\x00\x00\x00\x00")))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Grpc-Timeout", "5S")
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+
+	resp := rec.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Fatalf("grpc-status trailer = %q, want %q", got, "0")
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "\x00\x00\x00\x00\x02hi" {
+		t.Fatalf("body = %q", body)
+	}
+}
+
+func TestGRPCUpstreamDown(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	target := upstream.URL
+	upstream.Close()
+
+	r := newTestProxyRouty()
+	r.EventLog = make(chan logging.EventLogMessage, 1)
+
+	proxy, err := r.newProxy(models.Domain{}, models.Subdomain{}, models.Path{Location: "/", Target: target, Protocol: "h2c"})
+	if err != nil {
+		t.Fatalf("newProxy() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/pkg.Service/Method", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("Grpc-Status"); got != "14" {
+		t.Fatalf("grpc-status = %q, want %q", got, "14")
+	}
+}
+
+func TestGRPCDeadline(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer upstream.Close()
+
+	r := newTestProxyRouty()
+	r.EventLog = make(chan logging.EventLogMessage, 1)
+
+	proxy, err := r.newProxy(models.Domain{}, models.Subdomain{}, models.Path{Location: "/", Target: upstream.URL})
+	if err != nil {
+		t.Fatalf("newProxy() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/pkg.Service/Method", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Grpc-Timeout", "50m")
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Grpc-Status"); got != "4" {
+		t.Fatalf("grpc-status = %q, want %q", got, "4")
+	}
+}
+
+func TestGRPCWebTranslation(t *testing.T) {
+	t.Parallel()
+
+	message := []byte("\x00\x00\x00\x00\x02hi")
+	trailerFrame := []byte("\x80\x00\x00\x00\x22grpc-message: ok\r\ngrpc-status: 0\r\n")
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ct := req.Header.Get("Content-Type"); ct != "application/grpc+proto" {
+			t.Errorf("upstream content type = %q, want application/grpc+proto", ct)
+		}
+		if body, _ := io.ReadAll(req.Body); !bytes.Equal(body, message) {
+			t.Errorf("upstream body = %q, want %q", body, message)
+		}
+
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(message)
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	})
+
+	tests := []struct {
+		name        string
+		contentType string
+		encode      func([]byte) []byte
+	}{
+		{
+			name:        "binary",
+			contentType: "application/grpc-web+proto",
+			encode:      func(b []byte) []byte { return b },
+		},
+		{
+			name:        "text",
+			contentType: "application/grpc-web-text+proto",
+			encode: func(b []byte) []byte {
+				return []byte(base64.StdEncoding.EncodeToString(b))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodPost, "https://example.com/pkg.Service/Method", bytes.NewReader(tt.encode(message)))
+			req.Header.Set("Content-Type", tt.contentType)
+
+			rec := httptest.NewRecorder()
+			grpcHandler(upstream, true).ServeHTTP(rec, req)
+
+			if ct := rec.Header().Get("Content-Type"); ct != tt.contentType {
+				t.Fatalf("content type = %q, want %q", ct, tt.contentType)
+			}
+
+			want := tt.encode(append(append([]byte{}, message...), trailerFrame...))
+			if got := rec.Body.Bytes(); !bytes.Equal(got, want) {
+				t.Fatalf("body = %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+// securityHeaders are added to responses when the securityHeaders preset is
+// enabled and the upstream has not set them itself.
+var securityHeaders = map[string]string{
+	"Content-Security-Policy": "frame-ancestors 'self'",
+	"X-Frame-Options":         "SAMEORIGIN",
+	"X-Content-Type-Options":  "nosniff",
+	"Referrer-Policy":         "strict-origin-when-cross-origin",
+}
+
+// headerRules applies the header settings of a domain, subdomain and path.
+type headerRules struct {
+	route    string
+	proxies  trustedProxies
+	levels   []*models.Headers
+	request  bool
+	response bool
+}
+
+// newHeaderRules returns nil when none of the levels change any headers.
+func newHeaderRules(route string, proxies trustedProxies, levels ...*models.Headers) *headerRules {
+	hr := &headerRules{route: route, proxies: proxies}
+
+	for _, l := range levels {
+		if l == nil {
+			continue
+		}
+
+		hr.levels = append(hr.levels, l)
+		hr.request = hr.request || l.Request != nil
+		hr.response = hr.response || l.Response != nil || l.SecurityHeaders
+	}
+
+	if len(hr.levels) == 0 {
+		return nil
+	}
+
+	return hr
+}
+
+// applyRequest changes the headers that will be sent to the upstream.
+func (hr *headerRules) applyRequest(req *http.Request) {
+	if hr == nil || !hr.request {
+		return
+	}
+
+	for _, l := range hr.levels {
+		hr.applyRules(req.Header, l.Request, req)
+	}
+}
+
+// applyResponse changes the headers that will be sent to the client.
+func (hr *headerRules) applyResponse(h http.Header, req *http.Request) {
+	if hr == nil || !hr.response {
+		return
+	}
+
+	for _, l := range hr.levels {
+		if l.SecurityHeaders {
+			for k, v := range securityHeaders {
+				if h.Get(k) == "" {
+					h.Set(k, v)
+				}
+			}
+		}
+
+		hr.applyRules(h, l.Response, req)
+	}
+}
+
+func (hr *headerRules) applyRules(h http.Header, rules *models.HeaderRules, req *http.Request) {
+	if rules == nil {
+		return
+	}
+
+	for _, name := range rules.Remove {
+		h.Del(name)
+	}
+
+	for name, v := range rules.Set {
+		h.Set(name, hr.expand(v, req))
+	}
+
+	for name, v := range rules.Add {
+		h.Add(name, hr.expand(v, req))
+	}
+}
+
+// expand fills the placeholders in a header value from req.
+func (hr *headerRules) expand(v string, req *http.Request) string {
+	if !strings.Contains(v, "{") {
+		return v
+	}
+
+	scheme := "http"
+	var tlsVersion, tlsCipher, tlsSNI string
+	if req.TLS != nil {
+		scheme = "https"
+		tlsVersion = tls.VersionName(req.TLS.Version)
+		tlsCipher = tls.CipherSuiteName(req.TLS.CipherSuite)
+		tlsSNI = req.TLS.ServerName
+	}
+
+	return strings.NewReplacer(
+		"{client_ip}", hr.proxies.clientAddress(req),
+		"{request_id}", logging.RequestID(req.Context()),
+		"{host}", hostWithoutPort(req.Host),
+		"{method}", req.Method,
+		"{path}", req.URL.Path,
+		"{scheme}", scheme,
+		"{route}", hr.route,
+		"{tls_version}", tlsVersion,
+		"{tls_cipher}", tlsCipher,
+		"{tls_sni}", tlsSNI,
+	).Replace(v)
+}
+
+// handler applies the request rules before next runs and the response rules
+// when next writes its headers.
+func (hr *headerRules) handler(next http.Handler) http.Handler {
+	if hr == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if hr.request {
+			req = req.Clone(req.Context())
+			hr.applyRequest(req)
+		}
+
+		if !hr.response {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		hw := &headerWriter{ResponseWriter: w, apply: func(h http.Header) {
+			hr.applyResponse(h, req)
+		}}
+		next.ServeHTTP(hw, req)
+	})
+}
+
+// headerWriter calls apply on the response headers just before they are sent.
+type headerWriter struct {
+	http.ResponseWriter
+	apply       func(http.Header)
+	wroteHeader bool
+}
+
+func (hw *headerWriter) WriteHeader(code int) {
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		hw.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	if !hw.wroteHeader {
+		hw.wroteHeader = true
+		hw.apply(hw.Header())
+	}
+
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+func (hw *headerWriter) Write(p []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+
+	return hw.ResponseWriter.Write(p)
+}
+
+func (hw *headerWriter) Flush() {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+
+	_ = http.NewResponseController(hw.ResponseWriter).Flush()
+}
+
+func (hw *headerWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+func TestHeaderRulesHandler(t *testing.T) {
+	t.Parallel()
+
+	domain := &models.Headers{
+		Request: &models.HeaderRules{
+			Set:    map[string]string{"X-Edge": "routy", "X-Client": "{client_ip}"},
+			Remove: []string{"X-Internal"},
+		},
+		Response: &models.HeaderRules{
+			Set: map[string]string{"X-Served-By": "domain"},
+		},
+		SecurityHeaders: true,
+	}
+	path := &models.Headers{
+		Request: &models.HeaderRules{
+			Set: map[string]string{"X-Edge": "path", "X-Route": "{route}", "X-TLS": "{tls_version}"},
+			Add: map[string]string{"X-Tag": "b"},
+		},
+		Response: &models.HeaderRules{
+			Set:    map[string]string{"X-Served-By": "path", "X-Frame-Options": "DENY"},
+			Remove: []string{"Server"},
+		},
+	}
+
+	hr := newHeaderRules("foo.example.com/api", nil, domain, nil, path)
+
+	var upstream http.Header
+	h := hr.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstream = req.Header.Clone()
+		w.Header().Set("Server", "backend/1.0")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "https://foo.example.com/api/x", nil)
+	req.RemoteAddr = "203.0.113.7:5555"
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13}
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("X-Internal", "secret")
+	req.Header.Set("X-Tag", "a")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	wantUpstream := map[string]string{
+		"X-Edge":     "path",
+		"X-Client":   "203.0.113.7",
+		"X-Route":    "foo.example.com/api",
+		"X-TLS":      "TLS 1.3",
+		"X-Internal": "",
+	}
+	for k, want := range wantUpstream {
+		if got := upstream.Get(k); got != want {
+			t.Fatalf("upstream %s = %q, want %q", k, got, want)
+		}
+	}
+	if tags := upstream.Values("X-Tag"); len(tags) != 2 {
+		t.Fatalf("upstream X-Tag = %v, want two values", tags)
+	}
+	if req.Header.Get("X-Internal") != "secret" {
+		t.Fatalf("original request headers were modified")
+	}
+
+	wantResponse := map[string]string{
+		"X-Served-By":            "path",
+		"X-Frame-Options":        "DENY",
+		"X-Content-Type-Options": "nosniff",
+		"Referrer-Policy":        "no-referrer",
+		"Server":                 "",
+	}
+	for k, want := range wantResponse {
+		if got := rec.Header().Get(k); got != want {
+			t.Fatalf("response %s = %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestNewHeaderRulesEmpty(t *testing.T) {
+	t.Parallel()
+
+	if hr := newHeaderRules("/", nil, nil, nil, nil); hr != nil {
+		t.Fatalf("expected nil rules when no level sets headers")
+	}
+
+	next := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	var hr *headerRules
+	if hr.handler(next) == nil {
+		t.Fatalf("nil rules should return the next handler")
+	}
+}
+
+func TestWebSocketHeaderRules(t *testing.T) {
+	t.Parallel()
+
+	upgrader := websocket.Upgrader{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(req.Header.Get("X-Edge")+" "+req.Header.Get("X-Route")))
+	}))
+	t.Cleanup(upstream.Close)
+
+	r := newTestProxyRouty()
+	r.EventLog = make(chan logging.EventLogMessage, 16)
+	r.accessLog = make(chan *http.Request, 1)
+	r.denyList = &models.DenyList{}
+
+	domain := &models.Headers{Request: &models.HeaderRules{Set: map[string]string{"X-Edge": "domain", "X-Route": "{route}"}}}
+	sd := &models.Headers{Request: &models.HeaderRules{Set: map[string]string{"X-Edge": "subdomain"}}}
+	path := models.Path{Location: "/ws", Target: "ws" + strings.TrimPrefix(upstream.URL, "http") + "/ws", Upgrade: true}
+
+	matcher, err := newRouteMatcher(path, nil)
+	if err != nil {
+		t.Fatalf("newRouteMatcher() error = %v", err)
+	}
+
+	headers := newHeaderRules("app.example.com/ws", nil, domain, sd, path.Headers)
+	proxy := httptest.NewServer(http.HandlerFunc(r.wsHandleFunc(path, websocket.DefaultDialer, path.Target, nil, matcher, nil, nil, headers)))
+	t.Cleanup(proxy.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if got, want := string(msg), "subdomain app.example.com/ws"; got != want {
+		t.Fatalf("upstream headers = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/oorrwullie/routy/internal/models"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const defaultHTTP3Listen = ":https"
+
+// newHTTP3Server returns the QUIC listener for handler, or nil when HTTP/3 is
+// not enabled. It serves the same certificates as the TCP listener.
+func newHTTP3Server(cfg *models.HTTP3Config, tlsConfig *tls.Config, handler http.Handler) *http3.Server {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+
+	listen := cfg.Listen
+	if listen == "" {
+		listen = defaultHTTP3Listen
+	}
+
+	return &http3.Server{
+		Addr:      listen,
+		Port:      cfg.AdvertisePort,
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+	}
+}
+
+// altSvcHandler advertises the HTTP/3 listener on responses sent over
+// HTTP/1.1 and HTTP/2.
+func altSvcHandler(h3 *http3.Server, next http.Handler) http.Handler {
+	if h3 == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor < 3 {
+			// fails until the QUIC listener is up, in which case nothing is
+			// advertised yet
+			_ = h3.SetQUICHeaders(w.Header())
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/models"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func newTestCertificate(t *testing.T, host string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestNewHTTP3ServerDisabled(t *testing.T) {
+	t.Parallel()
+
+	if s := newHTTP3Server(nil, &tls.Config{}, http.NotFoundHandler()); s != nil {
+		t.Fatal("newHTTP3Server(nil) should not create a server")
+	}
+	if s := newHTTP3Server(&models.HTTP3Config{}, &tls.Config{}, http.NotFoundHandler()); s != nil {
+		t.Fatal("newHTTP3Server() without enabled should not create a server")
+	}
+}
+
+func TestHTTP3Loopback(t *testing.T) {
+	t.Parallel()
+
+	cert, roots := newTestCertificate(t, "example.com")
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s %s", req.Proto, req.Host)
+	})
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("udp loopback unavailable: %v", err)
+	}
+
+	h3 := newHTTP3Server(&models.HTTP3Config{Enabled: true}, tlsConfig, handler)
+	go func() {
+		_ = h3.Serve(conn)
+	}()
+	defer func() {
+		_ = h3.Close()
+	}()
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	client := &http.Client{
+		Transport: &http3.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "example.com"},
+		},
+		Timeout: 5 * time.Second,
+	}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/", port))
+	if err != nil {
+		t.Fatalf("GET over HTTP/3 error = %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.ProtoMajor != 3 || string(body) != fmt.Sprintf("HTTP/3.0 127.0.0.1:%d", port) {
+		t.Fatalf("response = %s %q, want an HTTP/3 response", resp.Proto, body)
+	}
+
+	rec := httptest.NewRecorder()
+	altSvcHandler(h3, handler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	want := fmt.Sprintf(`h3=":%d"; ma=2592000`, port)
+	if got := rec.Header().Get("Alt-Svc"); got != want {
+		t.Fatalf("Alt-Svc = %q, want %q", got, want)
+	}
+}
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -15,41 +17,28 @@ import (
 )
 
 func (r *Routy) handleHttp(router *mux.Router, domain models.Domain, sd models.Subdomain, path models.Path) {
-	targetURL, err := url.Parse(path.Target)
+	matcher, err := newRouteMatcher(path, r.proxies)
 	if err != nil {
-		msg := fmt.Sprintf("failed to parse target URL for subdomain %s path %s: %v\n", sd.Name, path.Location, err)
+		msg := fmt.Sprintf("failed to configure matcher for subdomain %s path %s: %v\n", sd.Name, path.Location, err)
 		r.EventLog <- logging.EventLogMessage{
 			Level:   "ERROR",
-			Caller:  "Route()->url.Parse()",
+			Caller:  "Route()->newRouteMatcher()",
 			Message: msg,
 		}
 
 		return
 	}
 
-	_, port, _ := net.SplitHostPort(targetURL.Host)
-
-	var h string
-	if sd.Name == domain.Name {
-		h = domain.Name
-	} else {
-		h = fmt.Sprintf("%s.%s", sd.Name, domain.Name)
-	}
-
-	targetURL.Host = net.JoinHostPort(h, port)
+	handler, err := r.pathHandler(domain, sd, path)
+	if err != nil {
+		msg := fmt.Sprintf("failed to configure subdomain %s path %s: %v\n", sd.Name, path.Location, err)
+		r.EventLog <- logging.EventLogMessage{
+			Level:   "ERROR",
+			Caller:  "Route()->r.pathHandler()",
+			Message: msg,
+		}
 
-	proxy := &httputil.ReverseProxy{
-		Rewrite: func(req *httputil.ProxyRequest) {
-			req.Out.Header["X-Forwarded"] = req.In.Header["X-Forwarded"]
-			req.Out.Header["X-Forwarded-For"] = req.In.Header["X-Forwarded-For"]
-			req.Out.Header["X-Forwarded-Host"] = req.In.Header["X-Forwarded-Host"]
-			req.Out.Header["X-Forwarded-Proto"] = req.In.Header["X-Forwarded-Proto"]
-			req.SetXForwarded()
-			req.SetURL(targetURL)
-			host, _, _ := net.SplitHostPort(targetURL.Host)
-			req.Out.Host = host
-		},
-		Transport: r.getDnsResolver(),
+		return
 	}
 
 	var host string
@@ -60,15 +49,102 @@ func (r *Routy) handleHttp(router *mux.Router, domain models.Domain, sd models.S
 		host = fmt.Sprintf("%s.%s", sd.Name, domain.Name)
 	}
 
+	mirror, err := r.newMirror(host+path.Location, path)
+	if err != nil {
+		msg := fmt.Sprintf("failed to configure mirror for subdomain %s path %s: %v\n", sd.Name, path.Location, err)
+		r.EventLog <- logging.EventLogMessage{
+			Level:   "ERROR",
+			Caller:  "Route()->r.newMirror()",
+			Message: msg,
+		}
+
+		return
+	}
+
+	handler = mirror.handler(handler)
+	handler = newResponseCache(r.cacheStore, path.Cache).handler(handler)
+
+	compressor, err := newCompressor(compressionConfig(domain, sd, path))
+	if err != nil {
+		msg := fmt.Sprintf("failed to configure compression for subdomain %s path %s: %v\n", sd.Name, path.Location, err)
+		r.EventLog <- logging.EventLogMessage{
+			Level:   "ERROR",
+			Caller:  "Route()->newCompressor()",
+			Message: msg,
+		}
+
+		return
+	}
+
+	handler = compressor.handler(handler)
+
+	headers := newHeaderRules(host+path.Location, r.proxies, domain.Headers, sd.Headers, path.Headers)
+	handler = headers.handler(handler)
+
+	auths, err := r.pathAuthorizers(host, oidcConfig(domain, sd), path)
+	if err != nil {
+		msg := fmt.Sprintf("failed to configure authentication for subdomain %s path %s: %v\n", sd.Name, path.Location, err)
+		r.EventLog <- logging.EventLogMessage{
+			Level:   "ERROR",
+			Caller:  "Route()->r.pathAuthorizers()",
+			Message: msg,
+		}
+
+		return
+	}
+
+	handler = authHandler(auths, handler)
+
+	geo, err := newGeoRules(path.Geo, r.geoIP)
+	if err != nil {
+		msg := fmt.Sprintf("failed to configure geo rules for subdomain %s path %s: %v\n", sd.Name, path.Location, err)
+		r.EventLog <- logging.EventLogMessage{
+			Level:   "ERROR",
+			Caller:  "Route()->newGeoRules()",
+			Message: msg,
+		}
+
+		return
+	}
+
+	limits := r.limits.requestLimits(path.Limits)
+
 	subdomainRouter := router.Host(host).Subrouter()
-	subdomainRouter.PathPrefix(path.Location).HandlerFunc(
+	route := subdomainRouter.NewRoute()
+	if matcher.matchType == matchPrefix {
+		route = route.PathPrefix(path.Location)
+	}
+
+	route.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+		return matcher.match(req)
+	}).HandlerFunc(
 		func(w http.ResponseWriter, req *http.Request) {
-			if r.denyList.IsDenied(logging.GetRequestRemoteAddress(req)) {
+			req = r.requestIDs.assign(w, req)
+
+			req, span := r.tracing.startRequest(req, host+path.Location)
+			defer span.End()
+			w = r.tracing.writer(w, span)
+
+			if r.isDenied(req) {
 				return
 			}
 
+			req = r.geoIP.annotate(req)
 			r.accessLog <- req
 
+			if !geo.allow(w, req) {
+				return
+			}
+
+			if !limits.apply(w, req) {
+				return
+			}
+
+			req, ok := r.waf.inspect(w, req)
+			if !ok {
+				return
+			}
+
 			if sd.CORS != nil {
 				applyCORSHeaders(w, req, sd.CORS)
 				if req.Method == http.MethodOptions {
@@ -76,11 +152,131 @@ func (r *Routy) handleHttp(router *mux.Router, domain models.Domain, sd models.S
 					return
 				}
 			}
-			proxy.ServeHTTP(w, req)
+			handler.ServeHTTP(w, req)
 		},
 	)
 }
 
+// pathHandler returns the handler for the action configured on path. Paths
+// without a redirect, respond, static or split action are proxied to their
+// target.
+func (r *Routy) pathHandler(domain models.Domain, sd models.Subdomain, path models.Path) (http.Handler, error) {
+	switch {
+	case path.Redirect != nil:
+		return newRedirectHandler(path.Redirect)
+	case path.Respond != nil:
+		return newRespondHandler(path.Respond), nil
+	case path.Static != nil:
+		return newStaticHandler(path)
+	case path.Split != nil:
+		return r.newSplitter(domain, sd, path)
+	default:
+		return r.newProxy(domain, sd, path)
+	}
+}
+
+// newProxy returns a reverse proxy to the path's target. The target host is
+// replaced by the public hostname, and the transport dials the target
+// address. Paths outside any domain, such as the fallback, keep their target
+// host.
+func (r *Routy) newProxy(domain models.Domain, sd models.Subdomain, path models.Path) (http.Handler, error) {
+	var h string
+	if sd.Name == domain.Name {
+		h = domain.Name
+	} else if domain.Name != "" {
+		h = fmt.Sprintf("%s.%s", sd.Name, domain.Name)
+	}
+
+	socket, prefix, isUnix, err := parseUnixTarget(path.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	var targetURL *url.URL
+	if isUnix {
+		targetURL = unixTargetURL("http", h, prefix)
+	} else {
+		targetURL, err = url.Parse(path.Target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse target URL: %v", err)
+		}
+	}
+
+	if err := checkUpstreamProtocol(path.Protocol, targetURL); err != nil {
+		return nil, err
+	}
+
+	upstream := upstreamAddress(targetURL)
+
+	if isUnix {
+		upstream = unixUpstreamPrefix + socket
+	} else if domain.Name != "" {
+		_, port, _ := net.SplitHostPort(upstream)
+		targetURL.Host = net.JoinHostPort(h, port)
+	}
+
+	rewriter, err := newPathRewriter(path)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(req *httputil.ProxyRequest) {
+			req.Out.Header["X-Forwarded"] = req.In.Header["X-Forwarded"]
+			req.Out.Header["X-Forwarded-For"] = req.In.Header["X-Forwarded-For"]
+			req.Out.Header["X-Forwarded-Host"] = req.In.Header["X-Forwarded-Host"]
+			req.Out.Header["X-Forwarded-Proto"] = req.In.Header["X-Forwarded-Proto"]
+			req.SetXForwarded()
+			if prefix := rewriter.rewriteURL(req.Out.URL); prefix != "" {
+				req.Out.Header.Set("X-Forwarded-Prefix", prefix)
+			}
+			req.SetURL(targetURL)
+			host, _, err := net.SplitHostPort(targetURL.Host)
+			if err != nil {
+				host = targetURL.Host
+			}
+			req.Out.Host = host
+		},
+		Transport: newRetryTransport(path.Retry, r.circuitBreaker(path).transport(
+			r.tracing.transport(r.transports.get(upstream, path.Protocol, path.Timeouts, poolConfig(r.routes, path))),
+		)),
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			r.EventLog <- logging.EventLogMessage{
+				Level:     "ERROR",
+				Caller:    "newProxy()->ReverseProxy",
+				Message:   fmt.Sprintf("upstream request to %s failed: %v", path.Target, err),
+				RequestID: logging.RequestID(req.Context()),
+			}
+
+			if isGRPC(req) {
+				writeGRPCError(w, err)
+				return
+			}
+
+			w.WriteHeader(upstreamErrorStatus(err))
+		},
+	}
+
+	return grpcHandler(proxy, path.GRPCWeb), nil
+}
+
+// upstreamErrorStatus picks the status returned to the client when the
+// upstream could not be reached.
+func upstreamErrorStatus(err error) int {
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		return http.StatusServiceUnavailable
+	case errors.As(err, new(*http.MaxBytesError)):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
 func applyCORSHeaders(w http.ResponseWriter, req *http.Request, cfg *models.CORSConfig) {
 	if cfg == nil {
 		return
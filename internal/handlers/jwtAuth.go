@@ -0,0 +1,561 @@
+package handlers
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+const (
+	// jwksRefreshInterval is how long fetched keys are used before they are
+	// fetched again.
+	jwksRefreshInterval = time.Hour
+
+	// jwksMinRefreshInterval limits how often a token with an unknown key id
+	// can cause the keys to be fetched.
+	jwksMinRefreshInterval = time.Minute
+
+	jwksFetchTimeout = 10 * time.Second
+	maxJWKSBytes     = 1 << 20
+)
+
+// defaultJWTAlgorithms are the signing algorithms accepted unless a path
+// lists its own. Only public key algorithms are accepted.
+var defaultJWTAlgorithms = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+// jwtAuth accepts requests carrying a valid bearer token.
+type jwtAuth struct {
+	parser       *jwt.Parser
+	keyfunc      jwt.Keyfunc
+	claims       map[string][]string
+	claimHeaders map[string]string
+}
+
+// newJWTAuth returns nil when cfg is nil.
+func newJWTAuth(cfg *models.JWTAuth) (*jwtAuth, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	keyfunc, err := jwtKeyfunc(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ja := &jwtAuth{
+		parser:       newJWTParser(cfg.Algorithms, cfg.Issuer, cfg.Audience, cfg.Leeway),
+		keyfunc:      keyfunc,
+		claims:       cfg.Claims,
+		claimHeaders: make(map[string]string, len(cfg.ClaimHeaders)),
+	}
+
+	for claim, header := range cfg.ClaimHeaders {
+		ja.claimHeaders[claim] = http.CanonicalHeaderKey(header)
+	}
+
+	return ja, nil
+}
+
+// newJWTParser returns a parser that checks the signing algorithm, issuer,
+// audience and expiry of tokens. Leeway is in milliseconds.
+func newJWTParser(algorithms []string, issuer string, audience []string, leeway int) *jwt.Parser {
+	if len(algorithms) == 0 {
+		algorithms = defaultJWTAlgorithms
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(algorithms),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Duration(leeway) * time.Millisecond),
+	}
+
+	if issuer != "" {
+		opts = append(opts, jwt.WithIssuer(issuer))
+	}
+	if len(audience) > 0 {
+		opts = append(opts, jwt.WithAudience(audience...))
+	}
+
+	return jwt.NewParser(opts...)
+}
+
+// jwtKeyfunc returns the function that finds the key a token was signed with.
+func jwtKeyfunc(cfg *models.JWTAuth) (jwt.Keyfunc, error) {
+	switch {
+	case cfg.JWKSURL != "" && len(cfg.Keys) > 0:
+		return nil, fmt.Errorf("jwt auth takes either a jwks url or keys, not both")
+	case cfg.JWKSURL != "":
+		return newJWKS(cfg.JWKSURL).keyfunc, nil
+	case len(cfg.Keys) > 0:
+		set := jwt.VerificationKeySet{}
+		for _, name := range cfg.Keys {
+			file, err := dataFilePath(name)
+			if err != nil {
+				return nil, err
+			}
+
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read jwt key: %v", err)
+			}
+
+			keys, err := parsePublicKeys(data)
+			if err != nil {
+				return nil, fmt.Errorf("invalid jwt key %s: %v", file, err)
+			}
+
+			set.Keys = append(set.Keys, keys...)
+		}
+
+		return func(*jwt.Token) (any, error) {
+			return set, nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("jwt auth needs a jwks url or keys")
+	}
+}
+
+func (ja *jwtAuth) authorize(w http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	raw, ok := bearerToken(req)
+	if !ok {
+		w.Header().Set("Www-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil, false
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := ja.parser.ParseWithClaims(raw, claims, ja.keyfunc); err != nil {
+		w.Header().Set("Www-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil, false
+	}
+
+	if !claimsMatch(claims, ja.claims) {
+		w.Header().Set("Www-Authenticate", `Bearer error="insufficient_scope"`)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, false
+	}
+
+	return setClaimHeaders(req, claims, ja.claimHeaders), true
+}
+
+// bearerToken returns the token from the Authorization header.
+func bearerToken(req *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	token = strings.TrimSpace(token)
+
+	return token, token != ""
+}
+
+// claimsMatch reports whether every claim in rules has one of the allowed
+// values.
+func claimsMatch(claims jwt.MapClaims, rules map[string][]string) bool {
+	for name, allowed := range rules {
+		found := false
+		for _, v := range claimValues(claims, name) {
+			if containsString(allowed, v) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// setClaimHeaders returns req with the claims copied to headers. Headers the
+// client sent under those names are removed first so they cannot be forged.
+func setClaimHeaders(req *http.Request, claims jwt.MapClaims, headers map[string]string) *http.Request {
+	if len(headers) == 0 {
+		return req
+	}
+
+	req = req.Clone(req.Context())
+	for claim, header := range headers {
+		req.Header.Del(header)
+		if vs := claimValues(claims, claim); len(vs) > 0 {
+			req.Header.Set(header, strings.Join(vs, ","))
+		}
+	}
+
+	return req
+}
+
+// claimValues returns the values of a claim as strings. Nested claims are
+// named with dots. The scope and scp claims are split on spaces as OAuth
+// sends them as a single string.
+func claimValues(claims jwt.MapClaims, name string) []string {
+	var v any = map[string]any(claims)
+	for _, part := range strings.Split(name, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+
+		if v, ok = m[part]; !ok {
+			return nil
+		}
+	}
+
+	switch val := v.(type) {
+	case []any:
+		var out []string
+		for _, item := range val {
+			if s, ok := claimString(item); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	case string:
+		if name == "scope" || name == "scp" {
+			return strings.Fields(val)
+		}
+		return []string{val}
+	default:
+		if s, ok := claimString(val); ok {
+			return []string{s}
+		}
+		return nil
+	}
+}
+
+func claimString(v any) (string, bool) {
+	switch val := v.(type) {
+	case string:
+		return val, true
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(val), true
+	default:
+		return "", false
+	}
+}
+
+// jwks holds the keys published at a JWKS URL. Keys are fetched on first use,
+// refreshed periodically and fetched again when a token names an unknown key.
+// One caller fetches at a time, without holding mu; callers that have a key
+// for their token keep using the current keys meanwhile.
+type jwks struct {
+	url    string
+	client *http.Client
+	now    func() time.Time
+
+	mu         sync.Mutex
+	keys       map[string]jwt.VerificationKey
+	fetchedAt  time.Time
+	triedAt    time.Time
+	fetchErr   error
+	refreshing chan struct{}
+}
+
+func newJWKS(url string) *jwks {
+	return &jwks{
+		url:    url,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+		now:    time.Now,
+	}
+}
+
+func (j *jwks) keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	keys, err := j.current(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if kid != "" {
+		key, ok := keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %s", kid)
+		}
+		return key, nil
+	}
+
+	set := jwt.VerificationKeySet{}
+	ids := make([]string, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		set.Keys = append(set.Keys, keys[id])
+	}
+
+	return set, nil
+}
+
+// current returns the keys to look kid up in, refreshing them when they are
+// old or do not have kid. The returned map is replaced, never changed, by
+// later refreshes.
+func (j *jwks) current(kid string) (map[string]jwt.VerificationKey, error) {
+	j.mu.Lock()
+
+	now := j.now()
+	_, known := j.keys[kid]
+	stale := now.Sub(j.fetchedAt) >= jwksRefreshInterval
+	unknown := kid != "" && !known
+	keys := j.keys
+
+	if !stale && !unknown {
+		j.mu.Unlock()
+		return keys, nil
+	}
+
+	if j.refreshing == nil && now.Sub(j.triedAt) >= jwksMinRefreshInterval {
+		j.triedAt = now
+		done := make(chan struct{})
+		j.refreshing = done
+		j.mu.Unlock()
+
+		fetched, err := j.fetch()
+
+		j.mu.Lock()
+		if err == nil {
+			j.keys = fetched
+			j.fetchedAt = j.now()
+		}
+		j.fetchErr = err
+		j.refreshing = nil
+		keys = j.keys
+		j.mu.Unlock()
+		close(done)
+
+		if err != nil && len(keys) == 0 {
+			return nil, err
+		}
+		return keys, nil
+	}
+
+	wait := j.refreshing
+	j.mu.Unlock()
+
+	// only a token the current keys cannot check waits for the refresh
+	if usable := known || (kid == "" && len(keys) > 0); wait == nil || usable {
+		return keys, nil
+	}
+
+	<-wait
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.keys) == 0 && j.fetchErr != nil {
+		return nil, j.fetchErr
+	}
+
+	return j.keys, nil
+}
+
+// fetch returns the keys currently published.
+func (j *jwks) fetch() (map[string]jwt.VerificationKey, error) {
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch jwks: %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch jwks: status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch jwks: %v", err)
+	}
+
+	return parseJWKS(data)
+}
+
+// jsonWebKey is a public key in JWK form.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the signing keys of a JWK set by key id. Keys of unknown
+// types are skipped.
+func parseJWKS(data []byte) (map[string]jwt.VerificationKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid jwks: %v", err)
+	}
+
+	keys := make(map[string]jwt.VerificationKey)
+	for _, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			if errors.Is(err, errUnsupportedJWK) {
+				continue
+			}
+			return nil, fmt.Errorf("invalid jwks key %s: %v", k.Kid, err)
+		}
+
+		keys[k.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("jwks has no usable keys")
+	}
+
+	return keys, nil
+}
+
+var errUnsupportedJWK = errors.New("unsupported key type")
+
+func (k jsonWebKey) publicKey() (jwt.VerificationKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid rsa key")
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		var point ecdh.Curve
+		switch k.Crv {
+		case "P-256":
+			curve, point = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, point = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, point = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, errUnsupportedJWK
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		// ecdh rejects points that are not on the curve
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, fmt.Errorf("invalid ec key")
+		}
+		if _, err := point.NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errUnsupportedJWK
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 key")
+		}
+
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, errUnsupportedJWK
+	}
+}
+
+// parsePublicKeys reads the public keys and certificates in PEM data.
+func parsePublicKeys(data []byte) ([]jwt.VerificationKey, error) {
+	var keys []jwt.VerificationKey
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var key any
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys found")
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,411 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+func newTestECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+
+	return key
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(x),
+		"y":   base64.RawURLEncoding.EncodeToString(y),
+	}
+}
+
+// testJWKSServer publishes a changeable set of keys and counts fetches.
+type testJWKSServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    []map[string]string
+	fetches atomic.Int32
+}
+
+func newTestJWKSServer(t *testing.T, keys ...map[string]string) *testJWKSServer {
+	t.Helper()
+
+	s := &testJWKSServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.fetches.Add(1)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": s.keys})
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func signTestToken(t *testing.T, key *ecdsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("SignedString() error = %v", err)
+	}
+
+	return signed
+}
+
+func TestJWTAuth(t *testing.T) {
+	t.Parallel()
+
+	key := newTestECKey(t)
+	other := newTestECKey(t)
+	jwks := newTestJWKSServer(t, ecJWK("k1", &key.PublicKey))
+
+	ja, err := newJWTAuth(&models.JWTAuth{
+		JWKSURL:  jwks.URL,
+		Issuer:   "https://sso.example.com",
+		Audience: []string{"routy"},
+		Claims: map[string][]string{
+			"realm_access.roles": {"admin", "ops"},
+		},
+		ClaimHeaders: map[string]string{
+			"sub":                "X-Auth-User",
+			"realm_access.roles": "X-Auth-Roles",
+		},
+	})
+	if err != nil {
+		t.Fatalf("newJWTAuth() error = %v", err)
+	}
+
+	handler := authHandler([]authorizer{ja}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, req.Header.Get("X-Auth-User")+"|"+req.Header.Get("X-Auth-Roles"))
+	}))
+
+	claims := func(changes jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"iss":          "https://sso.example.com",
+			"aud":          []string{"routy", "other"},
+			"sub":          "alice",
+			"exp":          time.Now().Add(time.Hour).Unix(),
+			"realm_access": map[string]any{"roles": []string{"user", "ops"}},
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "valid",
+			token:      signTestToken(t, key, "k1", claims(nil)),
+			wantStatus: http.StatusOK,
+			wantBody:   "alice|user,ops",
+		},
+		{
+			name:       "missing token",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "expired",
+			token:      signTestToken(t, key, "k1", claims(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()})),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "no expiry",
+			token:      signTestToken(t, key, "k1", claims(jwt.MapClaims{"exp": nil})),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "wrong issuer",
+			token:      signTestToken(t, key, "k1", claims(jwt.MapClaims{"iss": "https://evil.example.com"})),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "wrong audience",
+			token:      signTestToken(t, key, "k1", claims(jwt.MapClaims{"aud": "other"})),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "signed with another key",
+			token:      signTestToken(t, other, "k1", claims(nil)),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing role",
+			token:      signTestToken(t, key, "k1", claims(jwt.MapClaims{"realm_access": map[string]any{"roles": []string{"user"}}})),
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+			req.Header.Set("X-Auth-User", "mallory")
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Fatalf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+			if tt.wantStatus != http.StatusOK && rec.Header().Get("Www-Authenticate") == "" {
+				t.Fatalf("Www-Authenticate is not set")
+			}
+		})
+	}
+}
+
+func TestJWKSKeyRotation(t *testing.T) {
+	t.Parallel()
+
+	oldKey := newTestECKey(t)
+	newKey := newTestECKey(t)
+	server := newTestJWKSServer(t, ecJWK("old", &oldKey.PublicKey))
+
+	set := newJWKS(server.URL)
+	now := time.Now()
+	set.now = func() time.Time { return now }
+
+	ja := &jwtAuth{parser: newJWTParser(nil, "", nil, 0), keyfunc: set.keyfunc}
+
+	serve := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rec := httptest.NewRecorder()
+		authHandler([]authorizer{ja}, http.NotFoundHandler()).ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	exp := jwt.MapClaims{"exp": now.Add(time.Hour).Unix()}
+
+	if code := serve(signTestToken(t, oldKey, "old", exp)); code != http.StatusNotFound {
+		t.Fatalf("status with the old key = %d, want %d", code, http.StatusNotFound)
+	}
+
+	server.mu.Lock()
+	server.keys = append(server.keys, ecJWK("new", &newKey.PublicKey))
+	server.mu.Unlock()
+
+	// an unknown key id only causes a fetch once the minimum interval passed
+	if code := serve(signTestToken(t, newKey, "new", exp)); code != http.StatusUnauthorized {
+		t.Fatalf("status with the new key before refresh = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	now = now.Add(jwksMinRefreshInterval)
+	if code := serve(signTestToken(t, newKey, "new", exp)); code != http.StatusNotFound {
+		t.Fatalf("status with the new key = %d, want %d", code, http.StatusNotFound)
+	}
+
+	if got := server.fetches.Load(); got != 2 {
+		t.Fatalf("jwks fetches = %d, want 2", got)
+	}
+}
+
+func TestJWKSRefreshDoesNotBlock(t *testing.T) {
+	t.Parallel()
+
+	key := newTestECKey(t)
+	body, err := json.Marshal(map[string]any{"keys": []map[string]string{ecJWK("k1", &key.PublicKey)}})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	fetching := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if fetches.Add(1) > 1 {
+			fetching <- struct{}{}
+			<-release
+		}
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	set := newJWKS(server.URL)
+	now := time.Now()
+	set.now = func() time.Time { return now }
+
+	token := &jwt.Token{Header: map[string]any{"kid": "k1"}}
+	if _, err := set.keyfunc(token); err != nil {
+		t.Fatalf("keyfunc() error = %v", err)
+	}
+
+	// the keys are due for a refresh, which hangs
+	now = now.Add(jwksRefreshInterval)
+	go func() {
+		_, _ = set.keyfunc(token)
+	}()
+	<-fetching
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := set.keyfunc(token)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("keyfunc() during a refresh error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("keyfunc() waited for the refresh")
+	}
+}
+
+func TestJWTAuthLocalKeys(t *testing.T) {
+	t.Parallel()
+
+	key := newTestECKey(t)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey() error = %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "jwt.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	ja, err := newJWTAuth(&models.JWTAuth{Keys: []string{file}})
+	if err != nil {
+		t.Fatalf("newJWTAuth() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+	req.Header.Set("Authorization", "bearer "+signTestToken(t, key, "", jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}))
+
+	if _, ok := ja.authorize(httptest.NewRecorder(), req); !ok {
+		t.Fatalf("authorize() = false, want true")
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	t.Parallel()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+
+	ec := newTestECKey(t)
+	badPoint := ecJWK("bad", &ec.PublicKey)
+	badPoint["y"] = badPoint["x"]
+
+	tests := []struct {
+		name     string
+		keys     []map[string]string
+		wantKids []string
+		wantErr  bool
+	}{
+		{
+			name: "ec and ed25519",
+			keys: []map[string]string{
+				ecJWK("ec", &ec.PublicKey),
+				{"kty": "OKP", "crv": "Ed25519", "kid": "ed", "x": base64.RawURLEncoding.EncodeToString(pub)},
+			},
+			wantKids: []string{"ec", "ed"},
+		},
+		{
+			name: "encryption and unknown keys are skipped",
+			keys: []map[string]string{
+				ecJWK("ec", &ec.PublicKey),
+				{"kty": "oct", "kid": "secret", "k": "c2VjcmV0"},
+				{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+			},
+			wantKids: []string{"ec"},
+		},
+		{
+			name:    "point not on curve",
+			keys:    []map[string]string{badPoint},
+			wantErr: true,
+		},
+		{
+			name:    "no usable keys",
+			keys:    []map[string]string{{"kty": "oct", "kid": "secret"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			data, _ := json.Marshal(map[string]any{"keys": tt.keys})
+			keys, err := parseJWKS(data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseJWKS() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if len(keys) != len(tt.wantKids) {
+				t.Fatalf("parseJWKS() returned %d keys, want %d", len(keys), len(tt.wantKids))
+			}
+			for _, kid := range tt.wantKids {
+				if _, ok := keys[kid]; !ok {
+					t.Fatalf("parseJWKS() is missing key %q", kid)
+				}
+			}
+		})
+	}
+}
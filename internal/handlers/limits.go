@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/models"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+)
+
+// serverLimits are the limits applied to every listener.
+type serverLimits struct {
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+	maxBodyBytes      int64
+	maxConnsPerIP     int
+}
+
+func newServerLimits(cfg *models.ServerLimits) serverLimits {
+	if cfg == nil {
+		cfg = &models.ServerLimits{}
+	}
+
+	l := serverLimits{
+		readHeaderTimeout: timeoutOrDefault(cfg.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		readTimeout:       time.Duration(cfg.ReadTimeout) * time.Millisecond,
+		writeTimeout:      time.Duration(cfg.WriteTimeout) * time.Millisecond,
+		idleTimeout:       timeoutOrDefault(cfg.IdleTimeout, defaultIdleTimeout),
+		maxHeaderBytes:    http.DefaultMaxHeaderBytes,
+		maxBodyBytes:      cfg.MaxBodyBytes,
+		maxConnsPerIP:     cfg.MaxConnsPerIP,
+	}
+	if cfg.MaxHeaderBytes > 0 {
+		l.maxHeaderBytes = cfg.MaxHeaderBytes
+	}
+
+	return l
+}
+
+// newServer returns a server for handler with the timeouts and header limit
+// applied.
+func (l serverLimits) newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: l.readHeaderTimeout,
+		ReadTimeout:       l.readTimeout,
+		WriteTimeout:      l.writeTimeout,
+		IdleTimeout:       l.idleTimeout,
+		MaxHeaderBytes:    l.maxHeaderBytes,
+	}
+}
+
+// configureHTTP3 applies the limits that exist for QUIC connections.
+func (l serverLimits) configureHTTP3(s *http3.Server) {
+	if s == nil {
+		return
+	}
+
+	s.IdleTimeout = l.idleTimeout
+	s.MaxHeaderBytes = l.maxHeaderBytes
+}
+
+// listenAndServe serves srv on its address, capping the connections of each
+// client.
+func (l serverLimits) listenAndServe(srv *http.Server) error {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+
+	return srv.Serve(l.listener(ln))
+}
+
+// listener caps the concurrent connections of each client address when a
+// cap is configured.
+func (l serverLimits) listener(ln net.Listener) net.Listener {
+	if l.maxConnsPerIP <= 0 {
+		return ln
+	}
+
+	return &connLimitListener{Listener: ln, max: l.maxConnsPerIP, conns: make(map[string]int)}
+}
+
+// connLimitListener closes connections from clients that already hold the
+// maximum number of connections.
+type connLimitListener struct {
+	net.Listener
+	max int
+
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func (cl *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := cl.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := remoteIP(conn.RemoteAddr())
+
+		cl.mu.Lock()
+		if cl.conns[ip] >= cl.max {
+			cl.mu.Unlock()
+			_ = conn.Close()
+			continue
+		}
+		cl.conns[ip]++
+		cl.mu.Unlock()
+
+		return &limitedConn{Conn: conn, release: func() { cl.release(ip) }}, nil
+	}
+}
+
+func (cl *connLimitListener) release(ip string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.conns[ip]--; cl.conns[ip] <= 0 {
+		delete(cl.conns, ip)
+	}
+}
+
+// limitedConn gives its slot back when it is closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+
+	return c.Conn.Close()
+}
+
+// requestLimits are the limits checked once a request reached its path.
+type requestLimits struct {
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	maxHeaderBytes int
+	maxBodyBytes   int64
+}
+
+// requestLimits combines the server limits with those of a path.
+func (l serverLimits) requestLimits(cfg *models.RequestLimits) requestLimits {
+	rl := requestLimits{maxBodyBytes: l.maxBodyBytes}
+	if cfg == nil {
+		return rl
+	}
+
+	rl.readTimeout = time.Duration(cfg.ReadTimeout) * time.Millisecond
+	rl.writeTimeout = time.Duration(cfg.WriteTimeout) * time.Millisecond
+	rl.maxHeaderBytes = cfg.MaxHeaderBytes
+	if cfg.MaxBodyBytes > 0 {
+		rl.maxBodyBytes = cfg.MaxBodyBytes
+	}
+
+	return rl
+}
+
+// apply checks the request against the limits and caps its body. When the
+// request is already too large it answers the client and returns false.
+func (rl requestLimits) apply(w http.ResponseWriter, req *http.Request) bool {
+	if rl.maxHeaderBytes > 0 && headerSize(req) > rl.maxHeaderBytes {
+		http.Error(w, http.StatusText(http.StatusRequestHeaderFieldsTooLarge), http.StatusRequestHeaderFieldsTooLarge)
+		return false
+	}
+
+	if rl.maxBodyBytes > 0 {
+		if req.ContentLength > rl.maxBodyBytes {
+			w.Header().Set("Connection", "close")
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return false
+		}
+
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = http.MaxBytesReader(w, req.Body, rl.maxBodyBytes)
+		}
+	}
+
+	// the connection deadlines are set when the request starts and may be
+	// moved for this request; protocols without deadlines keep theirs
+	rc := http.NewResponseController(w)
+	if rl.readTimeout > 0 {
+		_ = rc.SetReadDeadline(time.Now().Add(rl.readTimeout))
+	}
+	if rl.writeTimeout > 0 {
+		_ = rc.SetWriteDeadline(time.Now().Add(rl.writeTimeout))
+	}
+
+	return true
+}
+
+// headerSize approximates the size of the request line and headers as sent.
+func headerSize(req *http.Request) int {
+	size := len(req.Method) + len(req.RequestURI) + len(req.Proto) + 4
+	for k, vs := range req.Header {
+		for _, v := range vs {
+			size += len(k) + len(v) + 4
+		}
+	}
+
+	return size
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+func TestRequestLimits(t *testing.T) {
+	t.Parallel()
+
+	limits := newServerLimits(&models.ServerLimits{MaxBodyBytes: 16})
+
+	tests := []struct {
+		name     string
+		path     *models.RequestLimits
+		body     string
+		header   string
+		wantCode int
+	}{
+		{name: "small body", body: "hello", wantCode: http.StatusOK},
+		{name: "body over the server limit", body: strings.Repeat("x", 17), wantCode: http.StatusRequestEntityTooLarge},
+		{name: "path allows more", path: &models.RequestLimits{MaxBodyBytes: 64}, body: strings.Repeat("x", 17), wantCode: http.StatusOK},
+		{name: "path allows less", path: &models.RequestLimits{MaxBodyBytes: 4}, body: "hello", wantCode: http.StatusRequestEntityTooLarge},
+		{name: "headers within limit", path: &models.RequestLimits{MaxHeaderBytes: 256}, header: "short", wantCode: http.StatusOK},
+		{name: "headers over limit", path: &models.RequestLimits{MaxHeaderBytes: 256}, header: strings.Repeat("x", 256), wantCode: http.StatusRequestHeaderFieldsTooLarge},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodPost, "https://app.example.com/upload", strings.NewReader(tt.body))
+			if tt.header != "" {
+				req.Header.Set("X-Large", tt.header)
+			}
+
+			rec := httptest.NewRecorder()
+			if limits.requestLimits(tt.path).apply(rec, req) {
+				rec.WriteHeader(http.StatusOK)
+			}
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestRequestLimitsStreamedBody(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.Copy(io.Discard, req.Body)
+	}))
+	defer upstream.Close()
+
+	r := newTestProxyRouty()
+	r.EventLog = make(chan logging.EventLogMessage, 16)
+
+	proxy, err := r.newProxy(models.Domain{}, models.Subdomain{}, models.Path{Location: "/", Target: upstream.URL})
+	if err != nil {
+		t.Fatalf("newProxy() error = %v", err)
+	}
+
+	limits := newServerLimits(&models.ServerLimits{MaxBodyBytes: 1024}).requestLimits(nil)
+
+	// without a content length the limit is only noticed while proxying
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/upload", bytes.NewReader(make([]byte, 4096)))
+	req.ContentLength = -1
+
+	rec := httptest.NewRecorder()
+	if limits.apply(rec, req) {
+		proxy.ServeHTTP(rec, req)
+	}
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestConnLimitListener(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	limited := newServerLimits(&models.ServerLimits{MaxConnsPerIP: 2}).listener(ln)
+	defer limited.Close()
+
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := limited.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+
+	waitAccepted := func() net.Conn {
+		select {
+		case conn := <-accepted:
+			return conn
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection was not accepted")
+			return nil
+		}
+	}
+
+	dial()
+	first := waitAccepted()
+	dial()
+	waitAccepted()
+
+	// a third connection is closed straight away
+	third := dial()
+	_ = third.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := third.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read() on the third connection error = %v, want EOF", err)
+	}
+
+	// closing a connection frees its slot
+	_ = first.Close()
+	_ = first.Close()
+	dial()
+	waitAccepted()
+
+	select {
+	case <-accepted:
+		t.Fatalf("more connections accepted than allowed")
+	default:
+	}
+}
+
+func TestNewServerDefaults(t *testing.T) {
+	t.Parallel()
+
+	srv := newServerLimits(nil).newServer(":https", http.NotFoundHandler())
+
+	if srv.ReadHeaderTimeout != defaultReadHeaderTimeout || srv.IdleTimeout != defaultIdleTimeout {
+		t.Fatalf("timeouts = %v/%v, want %v/%v", srv.ReadHeaderTimeout, srv.IdleTimeout, defaultReadHeaderTimeout, defaultIdleTimeout)
+	}
+	if srv.MaxHeaderBytes != http.DefaultMaxHeaderBytes {
+		t.Fatalf("MaxHeaderBytes = %d, want %d", srv.MaxHeaderBytes, http.DefaultMaxHeaderBytes)
+	}
+	if srv.ReadTimeout != 0 || srv.WriteTimeout != 0 {
+		t.Fatalf("read and write timeouts are set without configuration")
+	}
+}
@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+const (
+	matchPrefix = "prefix"
+	matchExact  = "exact"
+	matchRegex  = "regex"
+)
+
+// routeMatcher checks the parts of a path's match rules that go beyond the
+// host and path prefix.
+type routeMatcher struct {
+	matchType string
+	location  string
+	regex     *regexp.Regexp
+	methods   map[string]bool
+	headers   map[string]string
+	query     map[string]string
+	cidrs     []*net.IPNet
+	proxies   trustedProxies
+}
+
+// routeEntry is a single path together with the domain and subdomain it is
+// configured under.
+type routeEntry struct {
+	domain    models.Domain
+	subdomain models.Subdomain
+	path      models.Path
+}
+
+func newRouteMatcher(path models.Path, proxies trustedProxies) (*routeMatcher, error) {
+	m := &routeMatcher{
+		matchType: matchType(path),
+		location:  path.Location,
+		proxies:   proxies,
+	}
+
+	switch m.matchType {
+	case matchPrefix, matchExact, matchRegex:
+	default:
+		return nil, fmt.Errorf("unknown match type %q", m.matchType)
+	}
+
+	if m.matchType == matchRegex {
+		re, err := regexp.Compile(path.Location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid location pattern %q: %v", path.Location, err)
+		}
+		m.regex = re
+	}
+
+	if path.Match == nil {
+		return m, nil
+	}
+
+	if len(path.Match.Methods) > 0 {
+		m.methods = make(map[string]bool)
+		for _, method := range path.Match.Methods {
+			m.methods[strings.ToUpper(method)] = true
+		}
+	}
+
+	m.headers = path.Match.Headers
+	m.query = path.Match.Query
+
+	for _, c := range path.Match.ClientCIDRs {
+		if !strings.Contains(c, "/") {
+			if strings.Contains(c, ":") {
+				c += "/128"
+			} else {
+				c += "/32"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client CIDR %q: %v", c, err)
+		}
+		m.cidrs = append(m.cidrs, ipNet)
+	}
+
+	return m, nil
+}
+
+func matchType(path models.Path) string {
+	if path.Match == nil || path.Match.Type == "" {
+		return matchPrefix
+	}
+
+	return strings.ToLower(path.Match.Type)
+}
+
+// match reports whether req satisfies every configured rule. Prefix locations
+// are matched by the router itself and are not checked here.
+func (m *routeMatcher) match(req *http.Request) bool {
+	switch m.matchType {
+	case matchExact:
+		if req.URL.Path != m.location {
+			return false
+		}
+	case matchRegex:
+		if !m.regex.MatchString(req.URL.Path) {
+			return false
+		}
+	}
+
+	if m.methods != nil && !m.methods[req.Method] {
+		return false
+	}
+
+	for name, want := range m.headers {
+		values, ok := req.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (want != "" && !containsString(values, want)) {
+			return false
+		}
+	}
+
+	if len(m.query) > 0 {
+		q := req.URL.Query()
+		for name, want := range m.query {
+			values, ok := q[name]
+			if !ok || (want != "" && !containsString(values, want)) {
+				return false
+			}
+		}
+	}
+
+	if len(m.cidrs) > 0 {
+		ip := net.ParseIP(m.proxies.clientAddress(req))
+		if ip == nil {
+			return false
+		}
+
+		found := false
+		for _, c := range m.cidrs {
+			if c.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsString(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+
+	return false
+}
+
+// routeEntries lists every path of routes in the order it is registered on
+// the router. Paths configured directly on a domain are listed under a
+// subdomain named after the domain.
+func routeEntries(routes *models.Routes) []routeEntry {
+	var entries []routeEntry
+
+	for _, domain := range routes.Domains {
+		if len(domain.Paths) != 0 {
+			sd := models.Subdomain{
+				Name:  domain.Name,
+				Paths: domain.Paths,
+			}
+
+			domain.Subdomains = append(domain.Subdomains, sd)
+		}
+
+		for _, sd := range domain.Subdomains {
+			for _, path := range sd.Paths {
+				entries = append(entries, routeEntry{domain: domain, subdomain: sd, path: path})
+			}
+		}
+	}
+
+	// gorilla mux tries routes in the order they are registered
+	orderRoutes(entries)
+
+	return entries
+}
+
+// orderRoutes sorts routes into the order they are registered on the router,
+// which is the order they are tried in. Higher priorities come first, then
+// exact locations, regex locations and prefixes, with longer locations before
+// shorter ones. Routes that are still equal keep their cfg.yaml order.
+func orderRoutes(routes []routeEntry) {
+	rank := map[string]int{matchExact: 2, matchRegex: 1, matchPrefix: 0}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i].path, routes[j].path
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+
+		if ra, rb := rank[matchType(a)], rank[matchType(b)]; ra != rb {
+			return ra > rb
+		}
+
+		return len(a.Location) > len(b.Location)
+	})
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+func TestRouteMatcherMatch(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		path       models.Path
+		method     string
+		target     string
+		headers    map[string]string
+		remoteAddr string
+		want       bool
+	}{
+		{
+			name:   "prefix without rules",
+			path:   models.Path{Location: "/api"},
+			method: "GET",
+			target: "/api/users",
+			want:   true,
+		},
+		{
+			name:   "exact match",
+			path:   models.Path{Location: "/healthz", Match: &models.RouteMatch{Type: "exact"}},
+			method: "GET",
+			target: "/healthz",
+			want:   true,
+		},
+		{
+			name:   "exact mismatch",
+			path:   models.Path{Location: "/healthz", Match: &models.RouteMatch{Type: "exact"}},
+			method: "GET",
+			target: "/healthz/deep",
+			want:   false,
+		},
+		{
+			name:   "regex match",
+			path:   models.Path{Location: `^/users/\d+$`, Match: &models.RouteMatch{Type: "regex"}},
+			method: "GET",
+			target: "/users/12",
+			want:   true,
+		},
+		{
+			name:   "method mismatch",
+			path:   models.Path{Location: "/", Match: &models.RouteMatch{Methods: []string{"get", "head"}}},
+			method: "POST",
+			target: "/",
+			want:   false,
+		},
+		{
+			name:    "header presence",
+			path:    models.Path{Location: "/", Match: &models.RouteMatch{Headers: map[string]string{"x-canary": ""}}},
+			method:  "GET",
+			target:  "/",
+			headers: map[string]string{"X-Canary": "anything"},
+			want:    true,
+		},
+		{
+			name:    "header value mismatch",
+			path:    models.Path{Location: "/", Match: &models.RouteMatch{Headers: map[string]string{"X-Canary": "1"}}},
+			method:  "GET",
+			target:  "/",
+			headers: map[string]string{"X-Canary": "0"},
+			want:    false,
+		},
+		{
+			name:   "query value",
+			path:   models.Path{Location: "/", Match: &models.RouteMatch{Query: map[string]string{"debug": "1"}}},
+			method: "GET",
+			target: "/?debug=1",
+			want:   true,
+		},
+		{
+			name:   "query missing",
+			path:   models.Path{Location: "/", Match: &models.RouteMatch{Query: map[string]string{"debug": ""}}},
+			method: "GET",
+			target: "/",
+			want:   false,
+		},
+		{
+			name:       "client cidr match",
+			path:       models.Path{Location: "/", Match: &models.RouteMatch{ClientCIDRs: []string{"10.0.0.0/8", "192.168.1.5"}}},
+			method:     "GET",
+			target:     "/",
+			remoteAddr: "192.168.1.5:4000",
+			want:       true,
+		},
+		{
+			name:       "client cidr mismatch",
+			path:       models.Path{Location: "/", Match: &models.RouteMatch{ClientCIDRs: []string{"10.0.0.0/8"}}},
+			method:     "GET",
+			target:     "/",
+			remoteAddr: "192.168.1.5:4000",
+			want:       false,
+		},
+		{
+			name:       "client cidr in a spoofed header",
+			path:       models.Path{Location: "/", Match: &models.RouteMatch{ClientCIDRs: []string{"10.0.0.0/8"}}},
+			method:     "GET",
+			target:     "/",
+			headers:    map[string]string{"X-Forwarded-For": "10.1.2.3", "X-Real-Ip": "10.1.2.3"},
+			remoteAddr: "192.168.1.5:4000",
+			want:       false,
+		},
+		{
+			name:       "client cidr forwarded by a trusted proxy",
+			path:       models.Path{Location: "/", Match: &models.RouteMatch{ClientCIDRs: []string{"10.0.0.0/8"}}},
+			method:     "GET",
+			target:     "/",
+			headers:    map[string]string{"X-Forwarded-For": "10.1.2.3"},
+			remoteAddr: "127.0.0.1:4000",
+			want:       true,
+		},
+	}
+
+	proxies, err := newTrustedProxies([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatalf("newTrustedProxies() error = %v", err)
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			m, err := newRouteMatcher(tt.path, proxies)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(tt.method, "http://example.com"+tt.target, nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+
+			if got := m.match(req); got != tt.want {
+				t.Fatalf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRouteMatcherErrors(t *testing.T) {
+	t.Parallel()
+
+	paths := []models.Path{
+		{Location: "/", Match: &models.RouteMatch{Type: "glob"}},
+		{Location: "(", Match: &models.RouteMatch{Type: "regex"}},
+		{Location: "/", Match: &models.RouteMatch{ClientCIDRs: []string{"not-an-ip"}}},
+	}
+
+	for _, p := range paths {
+		if _, err := newRouteMatcher(p, nil); err == nil {
+			t.Fatalf("expected error for %+v", p.Match)
+		}
+	}
+}
+
+func TestOrderRoutes(t *testing.T) {
+	t.Parallel()
+
+	entries := []routeEntry{
+		{path: models.Path{Location: "/"}},
+		{path: models.Path{Location: "/ws"}},
+		{path: models.Path{Location: `^/x/\d+$`, Match: &models.RouteMatch{Type: "regex"}}},
+		{path: models.Path{Location: "/status", Match: &models.RouteMatch{Type: "exact"}}},
+		{path: models.Path{Location: "/low", Priority: -1}},
+		{path: models.Path{Location: "/", Priority: 10}},
+		{path: models.Path{Location: "/a"}},
+		{path: models.Path{Location: "/b"}},
+	}
+
+	orderRoutes(entries)
+
+	want := []string{"/", "/status", `^/x/\d+$`, "/ws", "/a", "/b", "/", "/low"}
+	for i, e := range entries {
+		if e.path.Location != want[i] {
+			t.Fatalf("entry %d = %q, want %q", i, e.path.Location, want[i])
+		}
+	}
+	if entries[0].path.Priority != 10 {
+		t.Fatalf("highest priority route was not first")
+	}
+}
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+const (
+	defaultMirrorBodyLimit = 1 << 20
+	defaultMirrorTimeout   = 10 * time.Second
+	maxMirrorsInFlight     = 100
+)
+
+// mirrorHopHeaders are not copied to mirrored requests.
+var mirrorHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// mirror copies requests to a second upstream without waiting for it.
+type mirror struct {
+	name      string
+	target    *url.URL
+	percent   float64
+	bodyLimit int64
+	timeout   time.Duration
+	rewriter  *pathRewriter
+	client    *http.Client
+	inFlight  chan struct{}
+	sample    func() float64
+
+	requests atomic.Int64
+	errors   atomic.Int64
+	skipped  atomic.Int64
+}
+
+// mirrorStatus is reported by the status server.
+type mirrorStatus struct {
+	Path     string `json:"path"`
+	Target   string `json:"target"`
+	Requests int64  `json:"requests"`
+	Errors   int64  `json:"errors"`
+	Skipped  int64  `json:"skipped"`
+}
+
+// newMirror returns nil when the path does not mirror its requests. The
+// mirror is listed on the status server under name.
+func (r *Routy) newMirror(name string, path models.Path) (*mirror, error) {
+	cfg := path.Mirror
+	if cfg == nil {
+		return nil, nil
+	}
+
+	target, err := url.Parse(cfg.Target)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("invalid mirror target %s", cfg.Target)
+	}
+
+	if cfg.Percent < 0 || cfg.Percent > 100 {
+		return nil, fmt.Errorf("mirror percent must be between 0 and 100")
+	}
+
+	rewriter, err := newPathRewriter(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mirror{
+		name:      name,
+		target:    target,
+		percent:   cfg.Percent,
+		bodyLimit: cfg.BodyLimit,
+		timeout:   timeoutOrDefault(cfg.Timeout, defaultMirrorTimeout),
+		rewriter:  rewriter,
+		inFlight:  make(chan struct{}, maxMirrorsInFlight),
+		sample:    rand.Float64,
+		client: &http.Client{
+			Transport: r.tracing.transport(r.transports.get(upstreamAddress(target), "", nil, poolConfig(r.routes, path))),
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	if m.percent == 0 {
+		m.percent = 100
+	}
+	if m.bodyLimit <= 0 {
+		m.bodyLimit = defaultMirrorBodyLimit
+	}
+
+	r.mirrorsMu.Lock()
+	r.mirrors = append(r.mirrors, m)
+	r.mirrorsMu.Unlock()
+
+	return m, nil
+}
+
+// handler serves requests with next and then sends a sampled copy to the
+// mirror. The body is kept as next reads it, so the client never waits on
+// the mirror.
+func (m *mirror) handler(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if m.sample()*100 >= m.percent {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if req.ContentLength > m.bodyLimit {
+			m.skipped.Add(1)
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		var body *mirrorBody
+		if req.Body != nil && req.Body != http.NoBody {
+			body = &mirrorBody{ReadCloser: req.Body, limit: m.bodyLimit}
+			req.Body = body
+		}
+
+		out := m.request(req)
+
+		next.ServeHTTP(w, req)
+
+		if body != nil {
+			data, ok := body.bytes()
+			if !ok {
+				m.skipped.Add(1)
+				return
+			}
+			out.Body = io.NopCloser(bytes.NewReader(data))
+			out.ContentLength = int64(len(data))
+		}
+
+		select {
+		case m.inFlight <- struct{}{}:
+		default:
+			m.skipped.Add(1)
+			return
+		}
+
+		go func() {
+			defer func() { <-m.inFlight }()
+			m.send(out)
+		}()
+	})
+}
+
+// request prepares the copy of req before next can change it.
+func (m *mirror) request(req *http.Request) *http.Request {
+	u := *req.URL
+	m.rewriter.rewriteURL(&u)
+	u.Scheme = m.target.Scheme
+	u.Host = m.target.Host
+	u.User = nil
+
+	out, _ := http.NewRequest(req.Method, u.String(), http.NoBody)
+	out.Header = req.Header.Clone()
+	for _, h := range mirrorHopHeaders {
+		out.Header.Del(h)
+	}
+	out.Header.Set("X-Forwarded-Host", req.Host)
+	out.Header.Set("X-Forwarded-Proto", "https")
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior := out.Header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		out.Header.Set("X-Forwarded-For", ip)
+	}
+
+	return out
+}
+
+// send delivers a copy and discards the answer.
+func (m *mirror) send(out *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	m.requests.Add(1)
+
+	resp, err := m.client.Do(out.WithContext(ctx))
+	if err != nil {
+		m.errors.Add(1)
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		m.errors.Add(1)
+	}
+}
+
+func (m *mirror) status() mirrorStatus {
+	return mirrorStatus{
+		Path:     m.name,
+		Target:   m.target.String(),
+		Requests: m.requests.Load(),
+		Errors:   m.errors.Load(),
+		Skipped:  m.skipped.Load(),
+	}
+}
+
+// mirrorBody keeps what the upstream reads of a request body, up to a limit.
+// The transport may still be reading when the response has been served.
+type mirrorBody struct {
+	io.ReadCloser
+	limit int64
+
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	over bool
+	eof  bool
+}
+
+func (mb *mirrorBody) Read(p []byte) (int, error) {
+	n, err := mb.ReadCloser.Read(p)
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if !mb.over {
+		if int64(mb.buf.Len()+n) > mb.limit {
+			mb.over = true
+			mb.buf = bytes.Buffer{}
+		} else {
+			mb.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		mb.eof = true
+	}
+
+	return n, err
+}
+
+// bytes returns the body when it was read completely within the limit.
+func (mb *mirrorBody) bytes() ([]byte, bool) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if !mb.eof || mb.over {
+		return nil, false
+	}
+
+	return bytes.Clone(mb.buf.Bytes()), true
+}
+
+// mirrorsStatusHandler lists the requests copied to each mirror.
+func (r *Routy) mirrorsStatusHandler(w http.ResponseWriter, _ *http.Request) {
+	r.mirrorsMu.Lock()
+	entries := make([]mirrorStatus, 0, len(r.mirrors))
+	for _, m := range r.mirrors {
+		entries = append(entries, m.status())
+	}
+	r.mirrorsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+// mirroredRequest is what the mirror upstream received.
+type mirroredRequest struct {
+	method string
+	uri    string
+	body   string
+	header http.Header
+}
+
+func newTestMirror(t *testing.T, cfg models.Mirror, path models.Path) (*Routy, *mirror) {
+	t.Helper()
+
+	r := newTestProxyRouty()
+	path.Mirror = &cfg
+
+	m, err := r.newMirror("app.example.com"+path.Location, path)
+	if err != nil {
+		t.Fatalf("newMirror() error = %v", err)
+	}
+
+	return r, m
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	received := make(chan mirroredRequest, 1)
+
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		received <- mirroredRequest{method: req.Method, uri: req.RequestURI, body: string(body), header: req.Header}
+		<-release
+		_, _ = io.WriteString(w, "shadow")
+	}))
+	defer shadow.Close()
+	defer close(release)
+
+	_, m := newTestMirror(t, models.Mirror{Target: shadow.URL}, models.Path{Location: "/api", StripPrefix: "/api"})
+
+	handler := m.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		_, _ = io.WriteString(w, "primary:"+string(body))
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "https://app.example.com/api/orders?id=7", strings.NewReader("order"))
+	req.Header.Set("X-Test", "yes")
+	req.Header.Set("Connection", "keep-alive")
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	// the primary answer does not wait for the mirror, which is blocked
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Body.String() != "primary:order" {
+		t.Fatalf("primary body = %q, want %q", rec.Body.String(), "primary:order")
+	}
+
+	var got mirroredRequest
+	select {
+	case got = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the mirror did not receive the request")
+	}
+
+	if got.method != http.MethodPost || got.uri != "/orders?id=7" || got.body != "order" {
+		t.Fatalf("mirrored request = %s %s %q, want POST /orders?id=7 %q", got.method, got.uri, got.body, "order")
+	}
+	if got.header.Get("X-Test") != "yes" || got.header.Get("X-Forwarded-Host") != "app.example.com" || got.header.Get("X-Forwarded-For") != "192.0.2.1" {
+		t.Fatalf("mirrored headers = %v", got.header)
+	}
+	if got.header.Get("Connection") == "keep-alive" {
+		t.Fatalf("hop by hop headers were mirrored")
+	}
+}
+
+func TestMirrorSkips(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		cfg         models.Mirror
+		sample      float64
+		body        string
+		wantSkipped int64
+		wantSent    bool
+	}{
+		{name: "sampled", cfg: models.Mirror{Percent: 50}, sample: 0.2, wantSent: true},
+		{name: "not sampled", cfg: models.Mirror{Percent: 50}, sample: 0.7},
+		{name: "body over the limit", cfg: models.Mirror{BodyLimit: 4}, body: "too long", wantSkipped: 1},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			received := make(chan struct{}, 1)
+			shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				received <- struct{}{}
+			}))
+			defer shadow.Close()
+
+			tt.cfg.Target = shadow.URL
+			_, m := newTestMirror(t, tt.cfg, models.Path{Location: "/"})
+			m.sample = func() float64 { return tt.sample }
+
+			handler := m.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, _ := io.ReadAll(req.Body)
+				_, _ = w.Write(body)
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "https://app.example.com/", strings.NewReader(tt.body))
+			req.ContentLength = -1
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Body.String() != tt.body {
+				t.Fatalf("primary body = %q, want %q", rec.Body.String(), tt.body)
+			}
+
+			if tt.wantSent {
+				waitFor(t, func() bool { return m.requests.Load() == 1 })
+			} else if m.requests.Load() != 0 {
+				t.Fatalf("requests = %d, want 0", m.requests.Load())
+			}
+
+			if got := m.skipped.Load(); got != tt.wantSkipped {
+				t.Fatalf("skipped = %d, want %d", got, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestMirrorErrors(t *testing.T) {
+	t.Parallel()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := down.URL
+	down.Close()
+
+	r := newTestProxyRouty()
+	for _, target := range []string{failing.URL, downURL} {
+		if _, err := r.newMirror("app.example.com/", models.Path{Location: "/", Mirror: &models.Mirror{Target: target}}); err != nil {
+			t.Fatalf("newMirror() error = %v", err)
+		}
+	}
+
+	primary := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for _, m := range r.mirrors {
+		rec := httptest.NewRecorder()
+		m.handler(primary).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil))
+
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("primary status = %d, want %d", rec.Code, http.StatusNoContent)
+		}
+
+		waitFor(t, func() bool { return m.errors.Load() == 1 })
+	}
+
+	rec := httptest.NewRecorder()
+	r.mirrorsStatusHandler(rec, httptest.NewRequest(http.MethodGet, "/mirrors", nil))
+
+	var entries []mirrorStatus
+	if err := json.NewDecoder(rec.Body).Decode(&entries); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if len(entries) != 2 || entries[0].Requests != 1 || entries[0].Errors != 1 || entries[1].Errors != 1 {
+		t.Fatalf("status = %+v, want one failed request per mirror", entries)
+	}
+}
+
+func TestNewMirrorErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []models.Mirror{
+		{Target: "ftp://shadow.example.com"},
+		{Target: "http://"},
+		{Target: "http://shadow.example.com", Percent: 101},
+	}
+
+	r := newTestProxyRouty()
+	for _, cfg := range tests {
+		cfg := cfg
+		if _, err := r.newMirror("app.example.com/", models.Path{Location: "/", Mirror: &cfg}); err == nil {
+			t.Fatalf("newMirror(%+v) error = nil, want an error", cfg)
+		}
+	}
+}
@@ -0,0 +1,736 @@
+package handlers
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+const (
+	defaultOIDCCallbackPath = "/oauth2/callback"
+	defaultOIDCLogoutPath   = "/oauth2/logout"
+	defaultOIDCCookieName   = "_routy_session"
+	defaultOIDCSessionTTL   = 24 * time.Hour
+	defaultOIDCGroupsClaim  = "groups"
+
+	oidcStateTTL       = 10 * time.Minute
+	oidcRequestTimeout = 10 * time.Second
+
+	// oidcDiscoveryRetry limits how often a failed discovery is retried.
+	oidcDiscoveryRetry = 10 * time.Second
+
+	// browsers drop cookies over 4096 bytes, so larger sessions are split
+	// over several cookies
+	maxOIDCCookieChunk  = 3800
+	maxOIDCCookieChunks = 8
+
+	maxOIDCResponseBytes = 1 << 20
+)
+
+// oidcIdentityHeaders carry the signed in user to the upstream. The names
+// match those set by oauth2-proxy.
+var oidcIdentityHeaders = []string{
+	"X-Auth-Request-User",
+	"X-Auth-Request-Email",
+	"X-Auth-Request-Groups",
+}
+
+var defaultOIDCScopes = []string{"openid", "email", "profile"}
+
+// oidcAuth signs browser users in with an OpenID Connect provider using the
+// authorization code flow with PKCE, and keeps them signed in with an
+// encrypted session cookie.
+type oidcAuth struct {
+	cfg        models.OIDC
+	sessionTTL time.Duration
+	aead       cipher.AEAD
+	client     *http.Client
+	eventLog   chan<- logging.EventLogMessage
+	now        func() time.Time
+
+	mu       sync.Mutex
+	provider *oidcProvider
+	triedAt  time.Time
+	lastErr  error
+}
+
+// oidcProvider is the part of the provider's discovery document routy uses.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+
+	keys   *jwks
+	parser *jwt.Parser
+}
+
+// oidcSession is stored encrypted in the session cookie.
+type oidcSession struct {
+	Subject      string   `json:"sub"`
+	User         string   `json:"user"`
+	Email        string   `json:"email,omitempty"`
+	Groups       []string `json:"groups,omitempty"`
+	AccessToken  string   `json:"at,omitempty"`
+	RefreshToken string   `json:"rt,omitempty"`
+	Expiry       int64    `json:"exp,omitempty"`
+	Created      int64    `json:"iat"`
+}
+
+// oidcLoginState ties a callback to the browser that started the sign in.
+type oidcLoginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"returnTo"`
+	Expires  int64  `json:"expires"`
+}
+
+type oidcTokens struct {
+	AccessToken  string `json:"access_token"`
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// oidcConfig returns the most specific of the domain and subdomain settings.
+func oidcConfig(domain models.Domain, sd models.Subdomain) *models.OIDC {
+	if sd.OIDC != nil {
+		return sd.OIDC
+	}
+
+	return domain.OIDC
+}
+
+// oidcLogin returns the sign in handler for host, creating it on first use so
+// every path of the host shares one session. It returns nil when cfg is nil.
+func (r *Routy) oidcLogin(host string, cfg *models.OIDC) (*oidcAuth, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	if oa, ok := r.oidcLogins[host]; ok {
+		return oa, nil
+	}
+
+	oa, err := newOIDCAuth(cfg, r.tracing, r.EventLog)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.oidcLogins == nil {
+		r.oidcLogins = make(map[string]*oidcAuth)
+	}
+	r.oidcLogins[host] = oa
+
+	return oa, nil
+}
+
+func newOIDCAuth(cfg *models.OIDC, t *tracing, eventLog chan<- logging.EventLogMessage) (*oidcAuth, error) {
+	u, err := url.Parse(cfg.Issuer)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid oidc issuer %s", cfg.Issuer)
+	}
+
+	if cfg.ClientID == "" {
+		return nil, fmt.Errorf("oidc client id is required")
+	}
+
+	if len(cfg.CookieSecret) < 16 {
+		return nil, fmt.Errorf("oidc cookie secret must be at least 16 characters")
+	}
+
+	oa := &oidcAuth{
+		cfg:        *cfg,
+		sessionTTL: timeoutOrDefault(cfg.SessionTTL, defaultOIDCSessionTTL),
+		eventLog:   eventLog,
+		now:        time.Now,
+		client: &http.Client{
+			Timeout:   oidcRequestTimeout,
+			Transport: t.transport(http.DefaultTransport),
+		},
+	}
+
+	if oa.cfg.CallbackPath == "" {
+		oa.cfg.CallbackPath = defaultOIDCCallbackPath
+	}
+	if oa.cfg.LogoutPath == "" {
+		oa.cfg.LogoutPath = defaultOIDCLogoutPath
+	}
+	if oa.cfg.CookieName == "" {
+		oa.cfg.CookieName = defaultOIDCCookieName
+	}
+	if oa.cfg.GroupsClaim == "" {
+		oa.cfg.GroupsClaim = defaultOIDCGroupsClaim
+	}
+	if len(oa.cfg.Scopes) == 0 {
+		oa.cfg.Scopes = defaultOIDCScopes
+	}
+
+	key := sha256.Sum256([]byte(cfg.CookieSecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	oa.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return oa, nil
+}
+
+// ownsPath reports whether req is for the callback or logout path.
+func (oa *oidcAuth) ownsPath(req *http.Request) bool {
+	return req.URL.Path == oa.cfg.CallbackPath || req.URL.Path == oa.cfg.LogoutPath
+}
+
+func (oa *oidcAuth) authorize(w http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	switch req.URL.Path {
+	case oa.cfg.CallbackPath:
+		oa.callback(w, req)
+		return nil, false
+	case oa.cfg.LogoutPath:
+		oa.logout(w, req)
+		return nil, false
+	}
+
+	sess := oa.session(req)
+
+	if sess != nil && sess.RefreshToken != "" && sess.Expiry != 0 && oa.now().Unix() >= sess.Expiry {
+		refreshed, err := oa.refresh(req.Context(), sess)
+		if err != nil {
+			oa.log("WARN", req, fmt.Sprintf("failed to refresh oidc session for %s: %v", sess.User, err))
+			sess = nil
+		} else {
+			sess = refreshed
+			oa.writeCookie(w, req, oa.cfg.CookieName, sess, int(oa.sessionTTL.Seconds()))
+		}
+	}
+
+	if sess == nil {
+		oa.login(w, req)
+		return nil, false
+	}
+
+	if !oa.allowed(sess) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, false
+	}
+
+	req = req.Clone(req.Context())
+	for _, h := range oidcIdentityHeaders {
+		req.Header.Del(h)
+	}
+
+	req.Header.Set("X-Auth-Request-User", sess.User)
+	if sess.Email != "" {
+		req.Header.Set("X-Auth-Request-Email", sess.Email)
+	}
+	if len(sess.Groups) > 0 {
+		req.Header.Set("X-Auth-Request-Groups", strings.Join(sess.Groups, ","))
+	}
+	if oa.cfg.PassAccessToken && sess.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+sess.AccessToken)
+	}
+
+	return req, true
+}
+
+// login sends the browser to the provider. Requests a browser cannot follow a
+// redirect for get a 401 instead.
+func (oa *oidcAuth) login(w http.ResponseWriter, req *http.Request) {
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || req.Header.Get("Upgrade") != "" {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	provider, err := oa.discover(req.Context())
+	if err != nil {
+		oa.log("ERROR", req, fmt.Sprintf("oidc discovery for %s failed: %v", oa.cfg.Issuer, err))
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	state := oidcLoginState{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		ReturnTo: req.URL.RequestURI(),
+		Expires:  oa.now().Add(oidcStateTTL).Unix(),
+	}
+
+	authURL, err := url.Parse(provider.AuthorizationEndpoint)
+	if err != nil {
+		oa.log("ERROR", req, fmt.Sprintf("invalid oidc authorization endpoint: %v", err))
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+
+	q := authURL.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", oa.cfg.ClientID)
+	q.Set("redirect_uri", oa.redirectURI(req))
+	q.Set("scope", strings.Join(oa.cfg.Scopes, " "))
+	q.Set("state", state.State)
+	q.Set("nonce", state.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	authURL.RawQuery = q.Encode()
+
+	oa.writeCookie(w, req, oa.stateCookieName(), state, int(oidcStateTTL.Seconds()))
+	http.Redirect(w, req, authURL.String(), http.StatusFound)
+}
+
+// callback completes the sign in when the provider sends the browser back.
+func (oa *oidcAuth) callback(w http.ResponseWriter, req *http.Request) {
+	var state oidcLoginState
+	ok := oa.readCookie(req, oa.stateCookieName(), &state)
+	oa.clearCookie(w, req, oa.stateCookieName())
+
+	q := req.URL.Query()
+	if !ok || oa.now().Unix() > state.Expires ||
+		subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state.State)) != 1 {
+		http.Error(w, "sign in expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	if e := q.Get("error"); e != "" {
+		oa.log("WARN", req, fmt.Sprintf("oidc provider refused sign in: %s %s", e, q.Get("error_description")))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	provider, err := oa.discover(req.Context())
+	if err != nil {
+		oa.log("ERROR", req, fmt.Sprintf("oidc discovery for %s failed: %v", oa.cfg.Issuer, err))
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	tokens, err := oa.exchange(req.Context(), provider, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {q.Get("code")},
+		"redirect_uri":  {oa.redirectURI(req)},
+		"code_verifier": {state.Verifier},
+	})
+	if err != nil {
+		oa.log("ERROR", req, fmt.Sprintf("oidc code exchange failed: %v", err))
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	claims, err := provider.verify(tokens.IDToken)
+	if err == nil {
+		if nonce, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(nonce), []byte(state.Nonce)) != 1 {
+			err = fmt.Errorf("nonce does not match")
+		}
+	}
+	if err != nil {
+		oa.log("WARN", req, fmt.Sprintf("invalid oidc id token: %v", err))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	sess := &oidcSession{Created: oa.now().Unix()}
+	oa.updateSession(sess, claims, tokens)
+
+	if !oa.allowed(sess) {
+		oa.log("INFO", req, fmt.Sprintf("oidc user %s is not allowed on %s", sess.User, req.Host))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	oa.writeCookie(w, req, oa.cfg.CookieName, sess, int(oa.sessionTTL.Seconds()))
+
+	returnTo := state.ReturnTo
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		returnTo = "/"
+	}
+
+	http.Redirect(w, req, returnTo, http.StatusFound)
+}
+
+// logout ends the session and, when the provider supports it, the provider
+// session too.
+func (oa *oidcAuth) logout(w http.ResponseWriter, req *http.Request) {
+	oa.clearCookie(w, req, oa.cfg.CookieName)
+
+	target := "/"
+	if provider, err := oa.discover(req.Context()); err == nil && provider.EndSessionEndpoint != "" {
+		if u, err := url.Parse(provider.EndSessionEndpoint); err == nil {
+			q := u.Query()
+			q.Set("client_id", oa.cfg.ClientID)
+			q.Set("post_logout_redirect_uri", "https://"+req.Host+"/")
+			u.RawQuery = q.Encode()
+			target = u.String()
+		}
+	}
+
+	http.Redirect(w, req, target, http.StatusFound)
+}
+
+// refresh returns sess with new tokens from the provider.
+func (oa *oidcAuth) refresh(ctx context.Context, sess *oidcSession) (*oidcSession, error) {
+	provider, err := oa.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := oa.exchange(ctx, provider, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {sess.RefreshToken},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var claims jwt.MapClaims
+	if tokens.IDToken != "" {
+		if claims, err = provider.verify(tokens.IDToken); err != nil {
+			return nil, err
+		}
+	}
+
+	refreshed := *sess
+	oa.updateSession(&refreshed, claims, tokens)
+
+	return &refreshed, nil
+}
+
+// updateSession copies the user's identity from claims, when there are any,
+// and the tokens to sess.
+func (oa *oidcAuth) updateSession(sess *oidcSession, claims jwt.MapClaims, tokens *oidcTokens) {
+	if claims != nil {
+		sess.Subject, _ = claims["sub"].(string)
+		sess.Email, _ = claims["email"].(string)
+		if verified, ok := claims["email_verified"].(bool); ok && !verified {
+			sess.Email = ""
+		}
+
+		sess.User, _ = claims["preferred_username"].(string)
+		if sess.User == "" {
+			sess.User = sess.Email
+		}
+		if sess.User == "" {
+			sess.User = sess.Subject
+		}
+
+		sess.Groups = claimValues(claims, oa.cfg.GroupsClaim)
+	}
+
+	sess.AccessToken = tokens.AccessToken
+	if tokens.RefreshToken != "" {
+		sess.RefreshToken = tokens.RefreshToken
+	}
+
+	sess.Expiry = 0
+	if tokens.ExpiresIn > 0 {
+		sess.Expiry = oa.now().Unix() + tokens.ExpiresIn
+	}
+}
+
+// allowed applies the group and email domain restrictions.
+func (oa *oidcAuth) allowed(sess *oidcSession) bool {
+	if len(oa.cfg.AllowedEmailDomains) > 0 {
+		at := strings.LastIndex(sess.Email, "@")
+		if at < 0 {
+			return false
+		}
+
+		domain := sess.Email[at+1:]
+		found := false
+		for _, d := range oa.cfg.AllowedEmailDomains {
+			if strings.EqualFold(d, domain) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if len(oa.cfg.AllowedGroups) > 0 {
+		for _, g := range sess.Groups {
+			if containsString(oa.cfg.AllowedGroups, g) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// session returns the session from the request's cookie, or nil when there is
+// no valid session.
+func (oa *oidcAuth) session(req *http.Request) *oidcSession {
+	var sess oidcSession
+	if !oa.readCookie(req, oa.cfg.CookieName, &sess) {
+		return nil
+	}
+
+	if oa.now().Sub(time.Unix(sess.Created, 0)) >= oa.sessionTTL {
+		return nil
+	}
+
+	if sess.RefreshToken == "" && sess.Expiry != 0 && oa.cfg.PassAccessToken && oa.now().Unix() >= sess.Expiry {
+		return nil
+	}
+
+	return &sess
+}
+
+// discover fetches the provider's discovery document on first use.
+func (oa *oidcAuth) discover(ctx context.Context) (*oidcProvider, error) {
+	oa.mu.Lock()
+	defer oa.mu.Unlock()
+
+	if oa.provider != nil {
+		return oa.provider, nil
+	}
+
+	if oa.lastErr != nil && oa.now().Sub(oa.triedAt) < oidcDiscoveryRetry {
+		return nil, oa.lastErr
+	}
+	oa.triedAt = oa.now()
+
+	provider, err := oa.fetchProvider(ctx)
+	if err != nil {
+		oa.lastErr = err
+		return nil, err
+	}
+
+	oa.provider = provider
+	oa.lastErr = nil
+
+	return provider, nil
+}
+
+func (oa *oidcAuth) fetchProvider(ctx context.Context) (*oidcProvider, error) {
+	issuer := strings.TrimSuffix(oa.cfg.Issuer, "/")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := oa.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery returned status %d", resp.StatusCode)
+	}
+
+	var p oidcProvider
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponseBytes)).Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid discovery document: %v", err)
+	}
+
+	if strings.TrimSuffix(p.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %s", p.Issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document is missing endpoints")
+	}
+
+	p.keys = newJWKS(p.JWKSURI)
+	p.parser = newJWTParser(nil, p.Issuer, []string{oa.cfg.ClientID}, 0)
+
+	return &p, nil
+}
+
+// verify checks an ID token and returns its claims.
+func (p *oidcProvider) verify(idToken string) (jwt.MapClaims, error) {
+	if idToken == "" {
+		return nil, fmt.Errorf("no id token")
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := p.parser.ParseWithClaims(idToken, claims, p.keys.keyfunc); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// exchange sends a token request to the provider.
+func (oa *oidcAuth) exchange(ctx context.Context, provider *oidcProvider, form url.Values) (*oidcTokens, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(oa.cfg.ClientID), url.QueryEscape(oa.cfg.ClientSecret))
+
+	resp, err := oa.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxOIDCResponseBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		_ = json.Unmarshal(body, &e)
+
+		return nil, fmt.Errorf("token endpoint returned status %d %s", resp.StatusCode, e.Error)
+	}
+
+	var tokens oidcTokens
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("invalid token response: %v", err)
+	}
+
+	return &tokens, nil
+}
+
+func (oa *oidcAuth) redirectURI(req *http.Request) string {
+	return "https://" + req.Host + oa.cfg.CallbackPath
+}
+
+func (oa *oidcAuth) stateCookieName() string {
+	return oa.cfg.CookieName + "_state"
+}
+
+// writeCookie encrypts v into the named cookie, split over numbered cookies
+// when it is too large for one.
+func (oa *oidcAuth) writeCookie(w http.ResponseWriter, req *http.Request, name string, v any, maxAge int) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	nonce := make([]byte, oa.aead.NonceSize())
+	_, _ = rand.Read(nonce)
+	value := base64.RawURLEncoding.EncodeToString(oa.aead.Seal(nonce, nonce, data, []byte(name)))
+
+	var chunks []string
+	for len(value) > maxOIDCCookieChunk {
+		chunks = append(chunks, value[:maxOIDCCookieChunk])
+		value = value[maxOIDCCookieChunk:]
+	}
+	chunks = append(chunks, value)
+
+	for i, chunk := range chunks {
+		http.SetCookie(w, oa.cookie(cookieChunkName(name, i), chunk, maxAge))
+	}
+
+	// drop chunks left over from a larger value
+	for i := len(chunks); i < maxOIDCCookieChunks; i++ {
+		if _, err := req.Cookie(cookieChunkName(name, i)); err != nil {
+			break
+		}
+		http.SetCookie(w, oa.cookie(cookieChunkName(name, i), "", -1))
+	}
+}
+
+// readCookie decrypts the named cookie into v.
+func (oa *oidcAuth) readCookie(req *http.Request, name string, v any) bool {
+	var value strings.Builder
+	for i := 0; i < maxOIDCCookieChunks; i++ {
+		c, err := req.Cookie(cookieChunkName(name, i))
+		if err != nil {
+			break
+		}
+		value.WriteString(c.Value)
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(value.String())
+	if err != nil || len(sealed) < oa.aead.NonceSize() {
+		return false
+	}
+
+	nonce, sealed := sealed[:oa.aead.NonceSize()], sealed[oa.aead.NonceSize():]
+	data, err := oa.aead.Open(nil, nonce, sealed, []byte(name))
+	if err != nil {
+		return false
+	}
+
+	return json.Unmarshal(data, v) == nil
+}
+
+func (oa *oidcAuth) clearCookie(w http.ResponseWriter, req *http.Request, name string) {
+	for i := 0; i < maxOIDCCookieChunks; i++ {
+		if _, err := req.Cookie(cookieChunkName(name, i)); err != nil {
+			break
+		}
+		http.SetCookie(w, oa.cookie(cookieChunkName(name, i), "", -1))
+	}
+}
+
+func (oa *oidcAuth) cookie(name, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func cookieChunkName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+
+	return name + "_" + strconv.Itoa(i)
+}
+
+func (oa *oidcAuth) log(level string, req *http.Request, msg string) {
+	oa.eventLog <- logging.EventLogMessage{
+		Level:     level,
+		Caller:    "oidcAuth.authorize()",
+		Message:   msg,
+		RequestID: logging.RequestID(req.Context()),
+	}
+}
+
+// randomToken returns 32 random bytes, base64url encoded.
+func randomToken() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,493 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+const testOIDCClientID = "routy"
+
+// mockIdP is a minimal OpenID Connect provider that signs in one user
+// without asking.
+type mockIdP struct {
+	*httptest.Server
+	t         *testing.T
+	key       *ecdsa.PrivateKey
+	email     string
+	groups    []string
+	expiresIn int64
+
+	mu        sync.Mutex
+	codes     map[string]url.Values
+	authorize atomic.Int32
+	refreshes atomic.Int32
+	issued    atomic.Int32
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+
+	idp := &mockIdP{
+		t:         t,
+		key:       newTestECKey(t),
+		email:     "alice@example.com",
+		groups:    []string{"admins"},
+		expiresIn: 3600,
+		codes:     make(map[string]url.Values),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+			"end_session_endpoint":   idp.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []any{ecJWK("idp", &idp.key.PublicKey)}})
+	})
+	mux.HandleFunc("/authorize", idp.handleAuthorize)
+	mux.HandleFunc("/token", idp.handleToken)
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	return idp
+}
+
+func (idp *mockIdP) handleAuthorize(w http.ResponseWriter, req *http.Request) {
+	idp.authorize.Add(1)
+
+	q := req.URL.Query()
+	if q.Get("client_id") != testOIDCClientID || q.Get("code_challenge_method") != "S256" || q.Get("response_type") != "code" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := randomToken()
+	idp.mu.Lock()
+	idp.codes[code] = q
+	idp.mu.Unlock()
+
+	redirect, _ := url.Parse(q.Get("redirect_uri"))
+	rq := redirect.Query()
+	rq.Set("code", code)
+	rq.Set("state", q.Get("state"))
+	redirect.RawQuery = rq.Encode()
+
+	http.Redirect(w, req, redirect.String(), http.StatusFound)
+}
+
+func (idp *mockIdP) handleToken(w http.ResponseWriter, req *http.Request) {
+	if id, secret, ok := req.BasicAuth(); !ok || id != testOIDCClientID || secret != "secret" {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	_ = req.ParseForm()
+
+	nonce := ""
+	switch req.PostForm.Get("grant_type") {
+	case "authorization_code":
+		idp.mu.Lock()
+		auth, ok := idp.codes[req.PostForm.Get("code")]
+		delete(idp.codes, req.PostForm.Get("code"))
+		idp.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(req.PostForm.Get("code_verifier")))
+		if !ok || auth.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(sum[:]) ||
+			auth.Get("redirect_uri") != req.PostForm.Get("redirect_uri") {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		nonce = auth.Get("nonce")
+	case "refresh_token":
+		if req.PostForm.Get("refresh_token") != "refresh" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		idp.refreshes.Add(1)
+	default:
+		http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":            idp.URL,
+		"aud":            testOIDCClientID,
+		"sub":            "user-1",
+		"email":          idp.email,
+		"email_verified": true,
+		"groups":         idp.groups,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"access_token":  fmt.Sprintf("access-%d", idp.issued.Add(1)),
+		"id_token":      signTestToken(idp.t, idp.key, "idp", claims),
+		"refresh_token": "refresh",
+		"expires_in":    idp.expiresIn,
+	})
+}
+
+func newTestOIDCAuth(t *testing.T, idp *mockIdP, change func(*models.OIDC)) *oidcAuth {
+	t.Helper()
+
+	cfg := &models.OIDC{
+		Issuer:          idp.URL,
+		ClientID:        testOIDCClientID,
+		ClientSecret:    "secret",
+		CookieSecret:    "0123456789abcdef0123456789abcdef",
+		PassAccessToken: true,
+	}
+	if change != nil {
+		change(cfg)
+	}
+
+	oa, err := newOIDCAuth(cfg, nil, make(chan logging.EventLogMessage, 16))
+	if err != nil {
+		t.Fatalf("newOIDCAuth() error = %v", err)
+	}
+
+	return oa
+}
+
+// startOIDCApp serves an upstream behind oa that echoes the identity headers.
+func startOIDCApp(t *testing.T, oa *oidcAuth) (*httptest.Server, *http.Client) {
+	t.Helper()
+
+	app := httptest.NewTLSServer(authHandler([]authorizer{oa}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s|%s|%s",
+			req.Header.Get("X-Auth-Request-User"),
+			req.Header.Get("X-Auth-Request-Email"),
+			req.Header.Get("X-Auth-Request-Groups"),
+			req.Header.Get("Authorization"),
+			req.URL.RequestURI(),
+		)
+	})))
+	t.Cleanup(app.Close)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("cookiejar.New() error = %v", err)
+	}
+
+	client := app.Client()
+	client.Jar = jar
+
+	return app, client
+}
+
+func getBody(t *testing.T, client *http.Client, target string, header http.Header) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Get(%s) error = %v", target, err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	return resp.StatusCode, string(body)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	t.Parallel()
+
+	idp := newMockIdP(t)
+	oa := newTestOIDCAuth(t, idp, nil)
+	app, client := startOIDCApp(t, oa)
+
+	forged := http.Header{"X-Auth-Request-User": {"mallory"}}
+
+	code, body := getBody(t, client, app.URL+"/private?x=1", forged)
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", code, http.StatusOK, body)
+	}
+	if want := "alice@example.com|alice@example.com|admins|Bearer access-1|/private?x=1"; body != want {
+		t.Fatalf("body = %q, want %q", body, want)
+	}
+
+	// the session cookie keeps the user signed in
+	code, body = getBody(t, client, app.URL+"/other", forged)
+	if code != http.StatusOK || !strings.HasPrefix(body, "alice@example.com|") {
+		t.Fatalf("second request = %d %q, want the signed in user", code, body)
+	}
+	if got := idp.authorize.Load(); got != 1 {
+		t.Fatalf("authorization requests = %d, want 1", got)
+	}
+}
+
+func TestOIDCRestrictions(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		change   func(*models.OIDC)
+		wantCode int
+	}{
+		{name: "allowed group", change: func(c *models.OIDC) { c.AllowedGroups = []string{"ops", "admins"} }, wantCode: http.StatusOK},
+		{name: "other group", change: func(c *models.OIDC) { c.AllowedGroups = []string{"ops"} }, wantCode: http.StatusForbidden},
+		{name: "allowed domain", change: func(c *models.OIDC) { c.AllowedEmailDomains = []string{"Example.com"} }, wantCode: http.StatusOK},
+		{name: "other domain", change: func(c *models.OIDC) { c.AllowedEmailDomains = []string{"example.org"} }, wantCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			idp := newMockIdP(t)
+			app, client := startOIDCApp(t, newTestOIDCAuth(t, idp, tt.change))
+
+			if code, body := getBody(t, client, app.URL+"/", nil); code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", code, tt.wantCode, body)
+			}
+		})
+	}
+}
+
+func TestOIDCRefresh(t *testing.T) {
+	t.Parallel()
+
+	idp := newMockIdP(t)
+	idp.expiresIn = 60
+
+	oa := newTestOIDCAuth(t, idp, nil)
+
+	var mu sync.Mutex
+	now := time.Now()
+	oa.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	app, client := startOIDCApp(t, oa)
+
+	if _, body := getBody(t, client, app.URL+"/", nil); !strings.Contains(body, "Bearer access-1") {
+		t.Fatalf("body = %q, want the first access token", body)
+	}
+
+	mu.Lock()
+	now = now.Add(2 * time.Minute)
+	mu.Unlock()
+
+	if _, body := getBody(t, client, app.URL+"/", nil); !strings.Contains(body, "Bearer access-2") {
+		t.Fatalf("body = %q, want the refreshed access token", body)
+	}
+	if got := idp.refreshes.Load(); got != 1 {
+		t.Fatalf("refreshes = %d, want 1", got)
+	}
+	if got := idp.authorize.Load(); got != 1 {
+		t.Fatalf("authorization requests = %d, want 1", got)
+	}
+
+	// the refreshed session was stored
+	if _, body := getBody(t, client, app.URL+"/", nil); !strings.Contains(body, "Bearer access-2") {
+		t.Fatalf("body = %q, want the stored access token", body)
+	}
+	if got := idp.refreshes.Load(); got != 1 {
+		t.Fatalf("refreshes = %d, want 1", got)
+	}
+}
+
+func TestOIDCUnauthenticated(t *testing.T) {
+	t.Parallel()
+
+	idp := newMockIdP(t)
+	oa := newTestOIDCAuth(t, idp, nil)
+
+	tests := []struct {
+		name     string
+		method   string
+		cookie   *http.Cookie
+		wantCode int
+	}{
+		{name: "navigation redirects", method: http.MethodGet, wantCode: http.StatusFound},
+		{name: "post is rejected", method: http.MethodPost, wantCode: http.StatusUnauthorized},
+		{name: "tampered cookie", method: http.MethodGet, cookie: &http.Cookie{Name: defaultOIDCCookieName, Value: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}, wantCode: http.StatusFound},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(tt.method, "https://app.example.com/private", nil)
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+
+			rec := httptest.NewRecorder()
+			if _, ok := oa.authorize(rec, req); ok {
+				t.Fatalf("authorize() = true, want false")
+			}
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusFound && !strings.HasPrefix(rec.Header().Get("Location"), idp.URL+"/authorize?") {
+				t.Fatalf("Location = %q, want the authorization endpoint", rec.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestOIDCWebSocketUpgrade(t *testing.T) {
+	t.Parallel()
+
+	idp := newMockIdP(t)
+
+	r := newTestProxyRouty()
+	r.EventLog = make(chan logging.EventLogMessage, 16)
+	r.accessLog = make(chan *http.Request, 1)
+	r.denyList = &models.DenyList{}
+
+	domain := models.Domain{Name: "example.com"}
+	sd := models.Subdomain{Name: "app", OIDC: &models.OIDC{
+		Issuer:       idp.URL,
+		ClientID:     testOIDCClientID,
+		ClientSecret: "secret",
+		CookieSecret: "0123456789abcdef0123456789abcdef",
+	}}
+	path := models.Path{Location: "/ws", Target: "ws://127.0.0.1:1/ws", Upgrade: true}
+
+	matcher, err := newRouteMatcher(path, nil)
+	if err != nil {
+		t.Fatalf("newRouteMatcher() error = %v", err)
+	}
+
+	auths, err := r.pathAuthorizers("app.example.com", oidcConfig(domain, sd), path)
+	if err != nil {
+		t.Fatalf("pathAuthorizers() error = %v", err)
+	}
+
+	handler := r.wsHandleFunc(path, websocket.DefaultDialer, path.Target, nil, matcher, auths, nil, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "https://app.example.com/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-Websocket-Version", "13")
+	req.Header.Set("Sec-Websocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if got := idp.authorize.Load(); got != 0 {
+		t.Fatalf("authorization requests = %d, want 0", got)
+	}
+}
+
+func TestOIDCCallbackRejectsUnknownState(t *testing.T) {
+	t.Parallel()
+
+	idp := newMockIdP(t)
+	oa := newTestOIDCAuth(t, idp, nil)
+
+	rec := httptest.NewRecorder()
+	oa.authorize(rec, httptest.NewRequest(http.MethodGet, "https://app.example.com/oauth2/callback?code=x&state=y", nil))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOIDCLogout(t *testing.T) {
+	t.Parallel()
+
+	idp := newMockIdP(t)
+	oa := newTestOIDCAuth(t, idp, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "https://app.example.com/oauth2/logout", nil)
+	req.AddCookie(&http.Cookie{Name: defaultOIDCCookieName, Value: "session"})
+
+	rec := httptest.NewRecorder()
+	oa.authorize(rec, req)
+
+	if rec.Code != http.StatusFound {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusFound)
+	}
+	if loc := rec.Header().Get("Location"); !strings.HasPrefix(loc, idp.URL+"/logout?") {
+		t.Fatalf("Location = %q, want the end session endpoint", loc)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != defaultOIDCCookieName || cookies[0].MaxAge >= 0 {
+		t.Fatalf("cookies = %v, want the session cookie cleared", cookies)
+	}
+}
+
+func TestOIDCCookieChunks(t *testing.T) {
+	t.Parallel()
+
+	idp := newMockIdP(t)
+	oa := newTestOIDCAuth(t, idp, nil)
+
+	sess := oidcSession{User: "alice", AccessToken: strings.Repeat("a", 3*maxOIDCCookieChunk), Created: time.Now().Unix()}
+
+	rec := httptest.NewRecorder()
+	oa.writeCookie(rec, httptest.NewRequest(http.MethodGet, "/", nil), "s", sess, 60)
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) < 3 {
+		t.Fatalf("cookies = %d, want the session split over at least 3", len(cookies))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range cookies {
+		if len(c.Value) > maxOIDCCookieChunk {
+			t.Fatalf("cookie %s is %d bytes, want at most %d", c.Name, len(c.Value), maxOIDCCookieChunk)
+		}
+		req.AddCookie(c)
+	}
+
+	var got oidcSession
+	if !oa.readCookie(req, "s", &got) {
+		t.Fatalf("readCookie() = false, want true")
+	}
+	if got.AccessToken != sess.AccessToken {
+		t.Fatalf("access token was not restored")
+	}
+
+	// a cookie sealed under another name does not decrypt
+	if oa.readCookie(req, "t", &got) {
+		t.Fatalf("readCookie() under another name = true, want false")
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+const (
+	defaultRequestIDHeader = "X-Request-Id"
+	maxRequestIDLength     = 128
+)
+
+// requestIDs assigns every request an ID that is forwarded upstream, echoed to
+// the client and attached to the logs. IDs sent by trusted proxies are kept.
+type requestIDs struct {
+	header  string
+	trusted trustedProxies
+}
+
+func newRequestIDs(cfg *models.RequestIDConfig, proxies trustedProxies) *requestIDs {
+	ri := &requestIDs{header: defaultRequestIDHeader, trusted: proxies}
+	if cfg != nil && cfg.Header != "" {
+		ri.header = http.CanonicalHeaderKey(cfg.Header)
+	}
+
+	return ri
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e || c == '"' || c == '\\' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// assign sets the request ID on the request headers and context and echoes it
+// on the response.
+func (ri *requestIDs) assign(w http.ResponseWriter, req *http.Request) *http.Request {
+	if ri == nil {
+		return req
+	}
+
+	id := req.Header.Get(ri.header)
+	if !validRequestID(id) || !ri.trusted.trustedPeer(req) {
+		id = newRequestID()
+	}
+
+	req.Header.Set(ri.header, id)
+	w.Header().Set(ri.header, id)
+
+	return req.WithContext(logging.WithRequestID(req.Context(), id))
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+func TestRequestIDsAssign(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		cfg        *models.RequestIDConfig
+		trusted    []string
+		remoteAddr string
+		incoming   string
+		header     string
+		keep       bool
+	}{
+		{
+			name:       "generated without config",
+			remoteAddr: "203.0.113.1:1234",
+			header:     "X-Request-Id",
+		},
+		{
+			name:       "untrusted incoming id replaced",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "203.0.113.1:1234",
+			incoming:   "upstream-id",
+			header:     "X-Request-Id",
+		},
+		{
+			name:       "trusted incoming id kept",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.1.2.3:1234",
+			incoming:   "upstream-id",
+			header:     "X-Request-Id",
+			keep:       true,
+		},
+		{
+			name:       "trusted single address",
+			trusted:    []string{"10.1.2.3"},
+			remoteAddr: "10.1.2.3:1234",
+			incoming:   "upstream-id",
+			header:     "X-Request-Id",
+			keep:       true,
+		},
+		{
+			name:       "invalid trusted id replaced",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.1.2.3:1234",
+			incoming:   "bad id",
+			header:     "X-Request-Id",
+		},
+		{
+			name:       "custom header",
+			cfg:        &models.RequestIDConfig{Header: "x-correlation-id"},
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.1.2.3:1234",
+			incoming:   "upstream-id",
+			header:     "X-Correlation-Id",
+			keep:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			proxies, err := newTrustedProxies(tt.trusted)
+			if err != nil {
+				t.Fatalf("newTrustedProxies() error = %v", err)
+			}
+			ri := newRequestIDs(tt.cfg, proxies)
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.incoming != "" {
+				req.Header.Set(tt.header, tt.incoming)
+			}
+
+			rec := httptest.NewRecorder()
+			req = ri.assign(rec, req)
+
+			id := logging.RequestID(req.Context())
+			if tt.keep && id != tt.incoming {
+				t.Fatalf("request id = %q, want %q", id, tt.incoming)
+			}
+			if !tt.keep && (len(id) != 32 || id == tt.incoming) {
+				t.Fatalf("request id = %q, want a generated id", id)
+			}
+			if got := req.Header.Get(tt.header); got != id {
+				t.Fatalf("forwarded header = %q, want %q", got, id)
+			}
+			if got := rec.Header().Get(tt.header); got != id {
+				t.Fatalf("response header = %q, want %q", got, id)
+			}
+		})
+	}
+}
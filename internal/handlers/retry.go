@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+const (
+	defaultRetryAttempts = 2
+	defaultRetryBudget   = 0.2
+	defaultRetryBackoff  = 25 * time.Millisecond
+
+	// retryBudgetReserve lets a few retries through on paths with too little
+	// traffic to have earned any.
+	retryBudgetReserve = 10.0
+)
+
+// idempotentMethods are the methods that are safe to send more than once.
+var idempotentMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+	http.MethodTrace,
+	http.MethodPut,
+	http.MethodDelete,
+}
+
+// retryBudget allows retries as a fraction of requests. Every request adds
+// ratio to the balance and every retry spends one.
+type retryBudget struct {
+	mu      sync.Mutex
+	ratio   float64
+	balance float64
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.balance += b.ratio
+	if b.balance > retryBudgetReserve {
+		b.balance = retryBudgetReserve
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+
+	return true
+}
+
+type retryTransport struct {
+	next     http.RoundTripper
+	attempts int
+	statuses []int
+	backoff  time.Duration
+	budget   *retryBudget
+}
+
+// newRetryTransport wraps next with the path's retry policy, or returns next
+// when retries are not configured.
+func newRetryTransport(cfg *models.Retry, next http.RoundTripper) http.RoundTripper {
+	if cfg == nil {
+		return next
+	}
+
+	rt := &retryTransport{
+		next:     next,
+		attempts: defaultRetryAttempts,
+		statuses: cfg.Statuses,
+		backoff:  timeoutOrDefault(cfg.Backoff, defaultRetryBackoff),
+		budget:   &retryBudget{ratio: defaultRetryBudget, balance: retryBudgetReserve},
+	}
+
+	if cfg.Attempts > 0 {
+		rt.attempts = cfg.Attempts
+	}
+	if cfg.Budget > 0 {
+		rt.budget.ratio = cfg.Budget
+	}
+
+	return rt
+}
+
+// replayable reports whether req can be sent again: it must be idempotent and
+// its body, if any, must be reproducible.
+func replayable(req *http.Request) bool {
+	if !containsString(idempotentMethods, req.Method) {
+		return false
+	}
+
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.budget.deposit()
+
+	if !replayable(req) {
+		return rt.next.RoundTrip(req)
+	}
+
+	backoff := rt.backoff
+	for attempt := 1; ; attempt++ {
+		resp, err := rt.next.RoundTrip(req)
+
+		last := attempt >= rt.attempts
+		if last || !rt.retryable(req, resp, err) || !rt.budget.withdraw() {
+			return resp, err
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			_ = resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// retryable reports whether an attempt failed in a way worth retrying.
+// Connection failures are retried unless the client has gone away; responses
+// only when their status is listed.
+func (rt *retryTransport) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() == nil && !errors.Is(err, context.Canceled) && !errors.Is(err, errCircuitOpen)
+	}
+
+	for _, s := range rt.statuses {
+		if resp.StatusCode == s {
+			return true
+		}
+	}
+
+	return false
+}
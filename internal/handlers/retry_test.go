@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func statusResponse(status int) *http.Response {
+	return &http.Response{StatusCode: status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}
+}
+
+func TestRetryTransport(t *testing.T) {
+	t.Parallel()
+
+	errRefused := errors.New("connection refused")
+
+	tests := []struct {
+		name      string
+		cfg       *models.Retry
+		method    string
+		body      string
+		results   []int
+		wantCalls int32
+		wantCode  int
+		wantErr   bool
+	}{
+		{
+			name:      "connection failure retried",
+			cfg:       &models.Retry{Attempts: 3, Backoff: 1},
+			method:    http.MethodGet,
+			results:   []int{0, 0, 200},
+			wantCalls: 3,
+			wantCode:  200,
+		},
+		{
+			name:      "attempts exhausted",
+			cfg:       &models.Retry{Attempts: 2, Backoff: 1},
+			method:    http.MethodGet,
+			results:   []int{0, 0, 200},
+			wantCalls: 2,
+			wantErr:   true,
+		},
+		{
+			name:      "listed status retried",
+			cfg:       &models.Retry{Attempts: 3, Statuses: []int{503}, Backoff: 1},
+			method:    http.MethodGet,
+			results:   []int{503, 200},
+			wantCalls: 2,
+			wantCode:  200,
+		},
+		{
+			name:      "unlisted status returned",
+			cfg:       &models.Retry{Attempts: 3, Statuses: []int{503}, Backoff: 1},
+			method:    http.MethodGet,
+			results:   []int{500, 200},
+			wantCalls: 1,
+			wantCode:  500,
+		},
+		{
+			name:      "post not retried",
+			cfg:       &models.Retry{Attempts: 3, Backoff: 1},
+			method:    http.MethodPost,
+			results:   []int{0, 200},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "put with replayable body retried",
+			cfg:       &models.Retry{Attempts: 3, Backoff: 1},
+			method:    http.MethodPut,
+			body:      "payload",
+			results:   []int{0, 200},
+			wantCalls: 2,
+			wantCode:  200,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls int32
+			next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				n := atomic.AddInt32(&calls, 1)
+				if req.Body != nil {
+					if b, _ := io.ReadAll(req.Body); string(b) != tt.body {
+						t.Errorf("attempt %d body = %q, want %q", n, b, tt.body)
+					}
+				}
+
+				status := tt.results[n-1]
+				if status == 0 {
+					return nil, errRefused
+				}
+				return statusResponse(status), nil
+			})
+
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req := httptest.NewRequest(tt.method, "http://upstream/", body)
+			if tt.body != "" {
+				req.GetBody = func() (io.ReadCloser, error) {
+					return io.NopCloser(strings.NewReader(tt.body)), nil
+				}
+			}
+
+			resp, err := newRetryTransport(tt.cfg, next).RoundTrip(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RoundTrip() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && resp.StatusCode != tt.wantCode {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if calls != tt.wantCalls {
+				t.Fatalf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	t.Parallel()
+
+	b := &retryBudget{ratio: 0.5}
+
+	if b.withdraw() {
+		t.Fatal("withdraw() from an empty budget = true, want false")
+	}
+
+	b.deposit()
+	b.deposit()
+	if !b.withdraw() {
+		t.Fatal("withdraw() after two deposits = false, want true")
+	}
+	if b.withdraw() {
+		t.Fatal("withdraw() after spending the balance = true, want false")
+	}
+
+	for i := 0; i < 100; i++ {
+		b.deposit()
+	}
+	if b.balance != retryBudgetReserve {
+		t.Fatalf("balance = %v, want it capped at %v", b.balance, retryBudgetReserve)
+	}
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+// pathRewriter applies a path's stripPrefix, rewrite and addPrefix rules, in
+// that order, to the incoming request path.
+type pathRewriter struct {
+	stripPrefix string
+	addPrefix   string
+	rules       []rewriteRule
+}
+
+type rewriteRule struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+// newPathRewriter compiles the rewrite rules for path. It returns nil when the
+// path has no rewrite settings.
+func newPathRewriter(path models.Path) (*pathRewriter, error) {
+	if path.StripPrefix == "" && path.AddPrefix == "" && len(path.Rewrite) == 0 {
+		return nil, nil
+	}
+
+	pr := &pathRewriter{
+		stripPrefix: strings.TrimSuffix(path.StripPrefix, "/"),
+		addPrefix:   strings.TrimSuffix(path.AddPrefix, "/"),
+	}
+
+	for _, rule := range path.Rewrite {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite pattern %q: %v", rule.Match, err)
+		}
+
+		pr.rules = append(pr.rules, rewriteRule{match: re, replace: rule.Replace})
+	}
+
+	return pr, nil
+}
+
+// rewrite returns the rewritten path and the prefix that was stripped from it,
+// if any. Only the first matching regex rule is applied.
+func (pr *pathRewriter) rewrite(p string) (string, string) {
+	if pr == nil {
+		return p, ""
+	}
+
+	var stripped string
+	if pr.stripPrefix != "" && (p == pr.stripPrefix || strings.HasPrefix(p, pr.stripPrefix+"/")) {
+		stripped = pr.stripPrefix
+		p = strings.TrimPrefix(p, pr.stripPrefix)
+	}
+
+	for _, rule := range pr.rules {
+		if rule.match.MatchString(p) {
+			p = rule.match.ReplaceAllString(p, rule.replace)
+			break
+		}
+	}
+
+	if pr.addPrefix != "" {
+		p = pr.addPrefix + p
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+
+	return p, stripped
+}
+
+// rewriteURL rewrites u's path in place and returns the stripped prefix.
+func (pr *pathRewriter) rewriteURL(u *url.URL) string {
+	if pr == nil {
+		return ""
+	}
+
+	p, stripped := pr.rewrite(u.Path)
+	u.Path = p
+	u.RawPath = ""
+
+	return stripped
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+func TestPathRewriterRewrite(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		path         models.Path
+		in           string
+		want         string
+		wantStripped string
+	}{
+		{
+			name: "no rules",
+			path: models.Path{},
+			in:   "/api/users",
+			want: "/api/users",
+		},
+		{
+			name:         "strip prefix",
+			path:         models.Path{StripPrefix: "/api"},
+			in:           "/api/users",
+			want:         "/users",
+			wantStripped: "/api",
+		},
+		{
+			name:         "strip prefix to root",
+			path:         models.Path{StripPrefix: "/api/"},
+			in:           "/api",
+			want:         "/",
+			wantStripped: "/api",
+		},
+		{
+			name: "strip prefix only on segment boundary",
+			path: models.Path{StripPrefix: "/api"},
+			in:   "/apiv2/users",
+			want: "/apiv2/users",
+		},
+		{
+			name: "add prefix",
+			path: models.Path{AddPrefix: "/v1"},
+			in:   "/users",
+			want: "/v1/users",
+		},
+		{
+			name: "regex with capture groups",
+			path: models.Path{Rewrite: []models.RewriteRule{
+				{Match: `^/users/(\d+)$`, Replace: "/accounts/$1/profile"},
+				{Match: `^/users/(.*)$`, Replace: "/never/$1"},
+			}},
+			in:   "/users/42",
+			want: "/accounts/42/profile",
+		},
+		{
+			name: "strip, rewrite and add",
+			path: models.Path{
+				StripPrefix: "/api",
+				AddPrefix:   "/internal",
+				Rewrite:     []models.RewriteRule{{Match: `^/(?P<name>\w+)/list$`, Replace: "/${name}"}},
+			},
+			in:           "/api/orders/list",
+			want:         "/internal/orders",
+			wantStripped: "/api",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			pr, err := newPathRewriter(tt.path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, stripped := pr.rewrite(tt.in)
+			if got != tt.want {
+				t.Fatalf("rewrite(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if stripped != tt.wantStripped {
+				t.Fatalf("stripped = %q, want %q", stripped, tt.wantStripped)
+			}
+		})
+	}
+}
+
+func TestNewPathRewriterInvalidPattern(t *testing.T) {
+	t.Parallel()
+
+	_, err := newPathRewriter(models.Path{Rewrite: []models.RewriteRule{{Match: "("}}})
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestWsDialTarget(t *testing.T) {
+	t.Parallel()
+
+	pr, err := newPathRewriter(models.Path{StripPrefix: "/ws"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://foo.example.com/ws/chat?room=1", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "abc")
+	req.Header.Set("Cookie", "a=b")
+
+	target, header := wsDialTarget("ws://127.0.0.1:1234/base", pr, req)
+	if target != "ws://127.0.0.1:1234/base/chat?room=1" {
+		t.Fatalf("target = %q", target)
+	}
+	if header.Get("X-Forwarded-Prefix") != "/ws" {
+		t.Fatalf("X-Forwarded-Prefix = %q", header.Get("X-Forwarded-Prefix"))
+	}
+	if header.Get("Upgrade") != "" || header.Get("Sec-WebSocket-Key") != "" {
+		t.Fatalf("handshake headers were not removed: %v", header)
+	}
+	if header.Get("Cookie") != "a=b" {
+		t.Fatalf("cookie header was not forwarded")
+	}
+
+	target, _ = wsDialTarget("ws://127.0.0.1:1234", nil, req)
+	if target != "ws://127.0.0.1:1234" {
+		t.Fatalf("target without rewriter = %q", target)
+	}
+}
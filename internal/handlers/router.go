@@ -3,7 +3,9 @@ package handlers
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"sync"
 
 	"github.com/oorrwullie/routy/internal/logging"
 	"github.com/oorrwullie/routy/internal/models"
@@ -14,11 +16,26 @@ import (
 
 // Routy is the main struct for the router
 type Routy struct {
-	accessLog chan *http.Request
-	denyList  *models.DenyList
-	EventLog  chan logging.EventLogMessage
-	hostnames []string
-	routes    *models.Routes
+	accessLog  chan *http.Request
+	breakers   map[string]*circuitBreaker
+	breakersMu sync.Mutex
+	cacheStore *cacheStore
+	denyList   *models.DenyList
+	EventLog   chan logging.EventLogMessage
+	geoIP      *geoIP
+	hostnames  []string
+	limits     serverLimits
+	mirrors    []*mirror
+	mirrorsMu  sync.Mutex
+	oidcLogins map[string]*oidcAuth
+	proxies    trustedProxies
+	requestIDs *requestIDs
+	routes     *models.Routes
+	splits     map[string][]*splitter
+	splitsMu   sync.Mutex
+	tracing    *tracing
+	transports *transportRegistry
+	waf        *waf
 }
 
 // NewRouty creates a new instance of the Routy struct
@@ -76,60 +93,132 @@ func (r *Routy) Route() error {
 		}
 	}
 
+	r.limits = newServerLimits(r.routes.Limits)
+
 	certManager, err := r.getCertManager()
 	if err != nil {
 		return err
 	}
 
-	for _, domain := range r.routes.Domains {
-		if len(domain.Paths) != 0 {
-			sd := models.Subdomain{
-				Name:  domain.Name,
-				Paths: domain.Paths,
-			}
+	r.cacheStore, err = newCacheStore(r.routes.Cache)
+	if err != nil {
+		return err
+	}
+
+	r.proxies, err = newTrustedProxies(r.routes.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	r.requestIDs = newRequestIDs(r.routes.RequestID, r.proxies)
+
+	r.tracing, err = newTracing(r.routes.Tracing)
+	if err != nil {
+		return err
+	}
 
-			domain.Subdomains = append(domain.Subdomains, sd)
+	r.waf, err = r.loadWAF()
+	if err != nil {
+		return err
+	}
+
+	r.geoIP, err = newGeoIP(r.routes.GeoIP, r.proxies, r.EventLog)
+	if err != nil {
+		return err
+	}
+
+	r.transports = newTransportRegistry(newResolver(r.tracing))
+
+	r.startCertMonitor()
+	r.startStatusServer()
+
+	for _, e := range routeEntries(r.routes) {
+		if e.path.Upgrade {
+			r.handleWebSocket(e.domain, e.subdomain, e.path)
+		} else {
+			r.handleHttp(router, e.domain, e.subdomain, e.path)
 		}
+	}
 
-		for _, sd := range domain.Subdomains {
-			if len(sd.Paths) != 0 {
-				for _, path := range sd.Paths {
-					if path.Upgrade {
-						go r.handleWebSocket(path)
-					} else {
-						go r.handleHttp(router, domain, sd, path)
-					}
-				}
+	// a host whose paths do not cover the sign in paths still needs them
+	for host, login := range r.oidcLogins {
+		router.Host(host).MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+			return login.ownsPath(req)
+		}).HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req = r.requestIDs.assign(w, req)
+			if r.isDenied(req) {
+				return
 			}
+
+			req = r.geoIP.annotate(req)
+			r.accessLog <- req
+			login.authorize(w, req)
+		})
+	}
+
+	fallback, err := r.fallbackHandler()
+	if err != nil {
+		return fmt.Errorf("invalid fallback route: %v", err)
+	}
+
+	httpHandler := certManager.HTTPHandler(nil)
+	if fallback != nil {
+		router.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+			return !r.isKnownHost(req.Host)
+		}).HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			r.serveFallback(fallback, w, req)
+		})
+
+		httpHandler = certManager.HTTPHandler(r.httpRedirectHandler(fallback))
+	}
+
+	tlsConfig, err := r.tlsConfig(certManager)
+	if err != nil {
+		return err
+	}
+
+	httpsListener, err := r.startStreams()
+	if err != nil {
+		return err
+	}
+
+	if httpsListener == nil {
+		httpsListener, err = net.Listen("tcp", ":https")
+		if err != nil {
+			return err
 		}
+	}
 
-		// listens fo any traffic on http and redirects it to https
-		go func() {
-			httpServer := &http.Server{
-				Addr:    ":http",
-				Handler: certManager.HTTPHandler(nil),
-			}
+	// listens fo any traffic on http and redirects it to https
+	go func() {
+		httpServer := r.limits.newServer(":http", httpHandler)
 
-			if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				r.EventLog <- logging.EventLogMessage{
-					Level:   "ERROR",
-					Caller:  "Route()->httpServer.ListenAndServe()",
-					Message: fmt.Sprintf("failed to start http server: %v", err),
-				}
+		if err := r.limits.listenAndServe(httpServer); err != nil && err != http.ErrServerClosed {
+			r.EventLog <- logging.EventLogMessage{
+				Level:   "ERROR",
+				Caller:  "Route()->httpServer.ListenAndServe()",
+				Message: fmt.Sprintf("failed to start http server: %v", err),
 			}
-		}()
-
-		server := &http.Server{
-			Addr:      ":https",
-			Handler:   router,
-			TLSConfig: certManager.TLSConfig(),
 		}
+	}()
+
+	handler := r.hstsHandler(router)
+	h3Server := newHTTP3Server(r.routes.HTTP3, tlsConfig, handler)
+	r.limits.configureHTTP3(h3Server)
 
-		// start the https server
+	server := r.limits.newServer(":https", altSvcHandler(h3Server, handler))
+	server.TLSConfig = tlsConfig
+
+	// start the https server
+	g.Go(func() error {
+		return server.ServeTLS(r.limits.listener(httpsListener), "", "")
+	})
+
+	if h3Server != nil {
+		// start the http/3 server
 		g.Go(func() error {
-			return server.ListenAndServeTLS("", "")
+			return h3Server.ListenAndServe()
 		})
-
 	}
 
 	return g.Wait()
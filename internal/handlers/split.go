@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+// splitter spreads the requests of a path over several upstreams. The
+// targets and weights can be replaced while requests are being served.
+type splitter struct {
+	name    string
+	proxy   func(target string) (http.Handler, error)
+	pick    func(n int) int
+	trusted trustedProxies
+
+	mu      sync.Mutex
+	proxies map[string]http.Handler
+
+	table atomic.Pointer[splitTable]
+}
+
+// splitTable is the compiled split configuration.
+type splitTable struct {
+	sticky   bool
+	matches  []splitMatch
+	weighted []weightedTarget
+	total    int
+}
+
+type splitMatch struct {
+	header  string
+	cookie  string
+	value   string
+	handler http.Handler
+}
+
+// weightedTarget is chosen for picks below its cumulative weight.
+type weightedTarget struct {
+	until   int
+	handler http.Handler
+}
+
+// newSplitter proxies to the split targets of path, using the path's other
+// settings for every target. The splitter is registered so that Reload can
+// change its targets.
+func (r *Routy) newSplitter(domain models.Domain, sd models.Subdomain, path models.Path) (http.Handler, error) {
+	var host string
+	if sd.Name == domain.Name {
+		host = domain.Name
+	} else {
+		host = fmt.Sprintf("%s.%s", sd.Name, domain.Name)
+	}
+
+	s := &splitter{
+		name: host + path.Location,
+		proxy: func(target string) (http.Handler, error) {
+			p := path
+			p.Target = target
+			return r.newProxy(domain, sd, p)
+		},
+		pick:    rand.IntN,
+		trusted: r.proxies,
+		proxies: make(map[string]http.Handler),
+	}
+
+	if err := s.update(path.Split); err != nil {
+		return nil, err
+	}
+
+	r.splitsMu.Lock()
+	if r.splits == nil {
+		r.splits = make(map[string][]*splitter)
+	}
+	r.splits[s.name] = append(r.splits[s.name], s)
+	r.splitsMu.Unlock()
+
+	return s, nil
+}
+
+// update replaces the targets. An invalid configuration leaves the current
+// one in place.
+func (s *splitter) update(cfg *models.TrafficSplit) error {
+	if len(cfg.Targets) == 0 {
+		return fmt.Errorf("split needs at least one target")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	table := &splitTable{sticky: cfg.Sticky}
+
+	for _, t := range cfg.Targets {
+		if t.Weight < 0 {
+			return fmt.Errorf("split weight for %s must not be negative", t.Target)
+		}
+		if (t.Header != nil && t.Header.Name == "") || (t.Cookie != nil && t.Cookie.Name == "") {
+			return fmt.Errorf("split match for %s needs a name", t.Target)
+		}
+
+		handler, ok := s.proxies[t.Target]
+		if !ok {
+			var err error
+			handler, err = s.proxy(t.Target)
+			if err != nil {
+				return err
+			}
+			s.proxies[t.Target] = handler
+		}
+
+		if t.Header != nil {
+			table.matches = append(table.matches, splitMatch{header: http.CanonicalHeaderKey(t.Header.Name), value: t.Header.Value, handler: handler})
+		}
+		if t.Cookie != nil {
+			table.matches = append(table.matches, splitMatch{cookie: t.Cookie.Name, value: t.Cookie.Value, handler: handler})
+		}
+
+		if t.Weight > 0 {
+			table.total += t.Weight
+			table.weighted = append(table.weighted, weightedTarget{until: table.total, handler: handler})
+		}
+	}
+
+	if table.total == 0 {
+		return fmt.Errorf("split needs a target with a weight")
+	}
+
+	s.table.Store(table)
+
+	return nil
+}
+
+func (s *splitter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	table := s.table.Load()
+
+	for _, m := range table.matches {
+		if m.matches(req) {
+			m.handler.ServeHTTP(w, req)
+			return
+		}
+	}
+
+	var n int
+	if table.sticky {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(s.trusted.clientAddress(req)))
+		n = int(h.Sum32() % uint32(table.total))
+	} else {
+		n = s.pick(table.total)
+	}
+
+	for _, t := range table.weighted {
+		if n < t.until {
+			t.handler.ServeHTTP(w, req)
+			return
+		}
+	}
+}
+
+func (m splitMatch) matches(req *http.Request) bool {
+	var values []string
+	if m.header != "" {
+		values = req.Header.Values(m.header)
+	} else {
+		for _, c := range req.CookiesNamed(m.cookie) {
+			values = append(values, c.Value)
+		}
+	}
+
+	for _, v := range values {
+		if m.value == "" || v == m.value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reload reads cfg.yaml again and applies changed traffic splits to the
+// running router. Other changes take effect when routy is restarted.
+func (r *Routy) Reload() error {
+	routes, err := models.GetDomainRoutes()
+	if err != nil {
+		return err
+	}
+
+	r.splitsMu.Lock()
+	defer r.splitsMu.Unlock()
+
+	var errs []error
+	seen := make(map[string]int)
+
+	for _, e := range routeEntries(routes) {
+		if e.path.Split == nil || e.path.Upgrade {
+			continue
+		}
+
+		var host string
+		if e.subdomain.Name == e.domain.Name {
+			host = e.domain.Name
+		} else {
+			host = fmt.Sprintf("%s.%s", e.subdomain.Name, e.domain.Name)
+		}
+
+		name := host + e.path.Location
+		i := seen[name]
+		seen[name]++
+
+		if i >= len(r.splits[name]) {
+			errs = append(errs, fmt.Errorf("split on %s is new and needs a restart", name))
+			continue
+		}
+
+		if err := r.splits[name][i].update(e.path.Split); err != nil {
+			errs = append(errs, fmt.Errorf("failed to update split on %s: %v", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+// newSplitUpstreams starts upstreams answering with their name and the Host
+// header they received.
+func newSplitUpstreams(t *testing.T, names ...string) map[string]string {
+	t.Helper()
+
+	urls := make(map[string]string)
+	for _, name := range names {
+		name := name
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = io.WriteString(w, name+" "+req.Host)
+		}))
+		t.Cleanup(upstream.Close)
+		urls[name] = upstream.URL
+	}
+
+	return urls
+}
+
+func serveSplit(t *testing.T, h http.Handler, req *http.Request) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	return rec.Body.String()
+}
+
+func TestSplitter(t *testing.T) {
+	t.Parallel()
+
+	urls := newSplitUpstreams(t, "stable", "canary", "beta")
+
+	domain := models.Domain{Name: "example.com"}
+	sd := models.Subdomain{Name: "app"}
+
+	tests := []struct {
+		name   string
+		split  models.TrafficSplit
+		pick   int
+		header string
+		cookie *http.Cookie
+		want   string
+	}{
+		{
+			name:  "first weighted target",
+			split: models.TrafficSplit{Targets: []models.SplitTarget{{Target: urls["stable"], Weight: 90}, {Target: urls["canary"], Weight: 10}}},
+			pick:  89,
+			want:  "stable app.example.com",
+		},
+		{
+			name:  "second weighted target",
+			split: models.TrafficSplit{Targets: []models.SplitTarget{{Target: urls["stable"], Weight: 90}, {Target: urls["canary"], Weight: 10}}},
+			pick:  90,
+			want:  "canary app.example.com",
+		},
+		{
+			name: "header match",
+			split: models.TrafficSplit{Targets: []models.SplitTarget{
+				{Target: urls["stable"], Weight: 100},
+				{Target: urls["canary"], Header: &models.SplitMatch{Name: "x-canary", Value: "1"}},
+			}},
+			header: "1",
+			want:   "canary app.example.com",
+		},
+		{
+			name: "header with another value",
+			split: models.TrafficSplit{Targets: []models.SplitTarget{
+				{Target: urls["stable"], Weight: 100},
+				{Target: urls["canary"], Header: &models.SplitMatch{Name: "X-Canary", Value: "1"}},
+			}},
+			header: "0",
+			want:   "stable app.example.com",
+		},
+		{
+			name: "cookie with any value",
+			split: models.TrafficSplit{Targets: []models.SplitTarget{
+				{Target: urls["stable"], Weight: 100},
+				{Target: urls["beta"], Cookie: &models.SplitMatch{Name: "beta"}},
+			}},
+			cookie: &http.Cookie{Name: "beta", Value: "yes"},
+			want:   "beta app.example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := newTestProxyRouty()
+
+			h, err := r.newSplitter(domain, sd, models.Path{Location: "/", Split: &tt.split})
+			if err != nil {
+				t.Fatalf("newSplitter() error = %v", err)
+			}
+			h.(*splitter).pick = func(int) int { return tt.pick }
+
+			req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+			if tt.header != "" {
+				req.Header.Set("X-Canary", tt.header)
+			}
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+
+			if got := serveSplit(t, h, req); got != tt.want {
+				t.Fatalf("response = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitterSticky(t *testing.T) {
+	t.Parallel()
+
+	urls := newSplitUpstreams(t, "stable", "canary")
+
+	r := newTestProxyRouty()
+	h, err := r.newSplitter(models.Domain{Name: "example.com"}, models.Subdomain{Name: "example.com"}, models.Path{
+		Location: "/",
+		Split: &models.TrafficSplit{Sticky: true, Targets: []models.SplitTarget{
+			{Target: urls["stable"], Weight: 50},
+			{Target: urls["canary"], Weight: 50},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("newSplitter() error = %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 32; i++ {
+		remoteAddr := fmt.Sprintf("192.0.2.%d:1234", i)
+
+		var first string
+		for j := 0; j < 3; j++ {
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			req.RemoteAddr = remoteAddr
+			// a client choosing its forwarded address must not choose its target
+			req.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d", j))
+
+			got := serveSplit(t, h, req)
+			if j == 0 {
+				first = got
+			} else if got != first {
+				t.Fatalf("client %s was sent to %q and %q", remoteAddr, first, got)
+			}
+		}
+		seen[first] = true
+	}
+
+	if len(seen) != 2 {
+		t.Fatalf("clients were sent to %v, want both targets", seen)
+	}
+}
+
+func TestNewSplitterErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []models.TrafficSplit{
+		{},
+		{Targets: []models.SplitTarget{{Target: "http://127.0.0.1:8080", Weight: -1}}},
+		{Targets: []models.SplitTarget{{Target: "http://127.0.0.1:8080", Weight: 1, Header: &models.SplitMatch{Value: "1"}}}},
+		{Targets: []models.SplitTarget{{Target: "http://127.0.0.1:8080", Header: &models.SplitMatch{Name: "X-Canary"}}}},
+		{Targets: []models.SplitTarget{{Target: "http://%zz", Weight: 1}}},
+	}
+
+	r := newTestProxyRouty()
+	for _, split := range tests {
+		split := split
+		if _, err := r.newSplitter(models.Domain{Name: "example.com"}, models.Subdomain{Name: "app"}, models.Path{Location: "/", Split: &split}); err == nil {
+			t.Fatalf("newSplitter(%+v) error = nil, want an error", split)
+		}
+	}
+
+	if len(r.splits) != 0 {
+		t.Fatalf("invalid splits were registered")
+	}
+}
+
+func TestReloadSplits(t *testing.T) {
+	urls := newSplitUpstreams(t, "stable", "canary")
+
+	dir := t.TempDir()
+	t.Setenv("ROUTY_DATA_DIR", dir)
+
+	writeCfg := func(stable, canary int) {
+		cfg := fmt.Sprintf(`domains:
+  - name: example.com
+    subdomains:
+      - name: app
+        paths:
+          - location: /
+            split:
+              targets:
+                - target: %s
+                  weight: %d
+                - target: %s
+                  weight: %d
+`, urls["stable"], stable, urls["canary"], canary)
+
+		if err := os.WriteFile(filepath.Join(dir, "cfg.yaml"), []byte(cfg), 0600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	writeCfg(100, 0)
+
+	routes, err := models.GetDomainRoutes()
+	if err != nil {
+		t.Fatalf("GetDomainRoutes() error = %v", err)
+	}
+
+	r := newTestProxyRouty()
+	e := routeEntries(routes)[0]
+
+	h, err := r.newSplitter(e.domain, e.subdomain, e.path)
+	if err != nil {
+		t.Fatalf("newSplitter() error = %v", err)
+	}
+
+	serve := func() string {
+		return serveSplit(t, h, httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil))
+	}
+
+	if got := serve(); got != "stable app.example.com" {
+		t.Fatalf("response before reload = %q, want the stable target", got)
+	}
+
+	writeCfg(0, 100)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	if got := serve(); got != "canary app.example.com" {
+		t.Fatalf("response after reload = %q, want the canary target", got)
+	}
+
+	// an invalid split keeps the previous weights
+	writeCfg(0, 0)
+	if err := r.Reload(); err == nil {
+		t.Fatalf("Reload() error = nil, want an error")
+	}
+
+	if got := serve(); got != "canary app.example.com" {
+		t.Fatalf("response after a failed reload = %q, want the canary target", got)
+	}
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+// precompressedVariants lists the encodings tried for precompressed files, in
+// order of preference.
+var precompressedVariants = []struct {
+	encoding string
+	ext      string
+}{
+	{encoding: "br", ext: ".br"},
+	{encoding: "gzip", ext: ".gz"},
+}
+
+type staticHandler struct {
+	root     string
+	cfg      *models.Static
+	index    string
+	rewriter *pathRewriter
+}
+
+// newStaticHandler returns a handler that serves files from the path's
+// static root.
+func newStaticHandler(p models.Path) (http.Handler, error) {
+	cfg := p.Static
+	if cfg.Root == "" {
+		return nil, fmt.Errorf("static root is required")
+	}
+
+	root := cfg.Root
+	if !filepath.IsAbs(root) {
+		m, err := models.NewModel()
+		if err != nil {
+			return nil, err
+		}
+		root = filepath.Join(m.DataDir, root)
+	}
+
+	if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("static root %s is not a directory", root)
+	}
+
+	for _, rule := range cfg.CacheControl {
+		if _, err := path.Match(rule.Match, ""); err != nil {
+			return nil, fmt.Errorf("invalid cache control pattern %q: %v", rule.Match, err)
+		}
+	}
+
+	rewriter, err := newPathRewriter(p)
+	if err != nil {
+		return nil, err
+	}
+
+	index := cfg.Index
+	if index == "" {
+		index = "index.html"
+	}
+
+	return &staticHandler{
+		root:     root,
+		cfg:      cfg,
+		index:    index,
+		rewriter: rewriter,
+	}, nil
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, _ := h.rewriter.rewrite(req.URL.Path)
+	name = path.Clean("/" + name)
+
+	fi, err := os.Stat(h.filepath(name))
+	if err == nil && fi.IsDir() {
+		if !strings.HasSuffix(req.URL.Path, "/") {
+			http.Redirect(w, req, path.Base(req.URL.Path)+"/", http.StatusMovedPermanently)
+			return
+		}
+
+		indexName := path.Join(name, h.index)
+		if ifi, err := os.Stat(h.filepath(indexName)); err == nil && !ifi.IsDir() {
+			h.serveFile(w, req, indexName)
+			return
+		}
+
+		if h.cfg.Browse {
+			h.serveDirectory(w, req, name)
+			return
+		}
+
+		err = os.ErrNotExist
+	}
+
+	if err != nil {
+		if h.cfg.SPA {
+			h.serveFile(w, req, "/"+h.index)
+			return
+		}
+
+		http.NotFound(w, req)
+		return
+	}
+
+	h.serveFile(w, req, name)
+}
+
+func (h *staticHandler) filepath(name string) string {
+	return filepath.Join(h.root, filepath.FromSlash(name))
+}
+
+// serveFile serves name, or a precompressed variant of it that the client
+// accepts. http.ServeContent handles Range and conditional requests.
+func (h *staticHandler) serveFile(w http.ResponseWriter, req *http.Request, name string) {
+	servePath := h.filepath(name)
+	encoding := ""
+
+	if h.cfg.Precompressed {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		for _, v := range precompressedVariants {
+			if !acceptsEncoding(req.Header.Get("Accept-Encoding"), v.encoding) {
+				continue
+			}
+
+			if fi, err := os.Stat(servePath + v.ext); err == nil && !fi.IsDir() {
+				servePath += v.ext
+				encoding = v.encoding
+				break
+			}
+		}
+	}
+
+	f, err := os.Open(servePath)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, req)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%x-%x`, fi.ModTime().UnixNano(), fi.Size())
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+		etag += "-" + encoding
+	}
+	w.Header().Set("ETag", etag+`"`)
+
+	if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+
+	if cc := h.cacheControl(name); cc != "" {
+		w.Header().Set("Cache-Control", cc)
+	}
+
+	http.ServeContent(w, req, name, fi.ModTime(), f)
+}
+
+// cacheControl returns the value of the first cache control rule matching name.
+func (h *staticHandler) cacheControl(name string) string {
+	rel := strings.TrimPrefix(name, "/")
+	base := path.Base(name)
+
+	for _, rule := range h.cfg.CacheControl {
+		if ok, _ := path.Match(rule.Match, rel); ok {
+			return rule.Value
+		}
+		if ok, _ := path.Match(rule.Match, base); ok {
+			return rule.Value
+		}
+	}
+
+	return ""
+}
+
+func (h *staticHandler) serveDirectory(w http.ResponseWriter, req *http.Request, name string) {
+	entries, err := os.ReadDir(h.filepath(name))
+	if err != nil {
+		http.Error(w, "Error reading directory", http.StatusInternalServerError)
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if req.Method == http.MethodHead {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("<!doctype html>\n<meta name=\"viewport\" content=\"width=device-width\">\n<pre>\n")
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() {
+			n += "/"
+		}
+		u := url.URL{Path: n}
+		fmt.Fprintf(&b, "<a href=\"%s\">%s</a>\n", u.String(), html.EscapeString(n))
+	}
+	b.WriteString("</pre>\n")
+
+	_, _ = w.Write([]byte(b.String()))
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header value allows
+// encoding, honouring q=0 exclusions and the * wildcard.
+func acceptsEncoding(header, encoding string) bool {
+	return negotiateEncoding(header, []string{encoding}) != ""
+}
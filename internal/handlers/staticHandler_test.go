@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+func newTestStaticHandler(t *testing.T, cfg models.Static, stripPrefix string) http.Handler {
+	t.Helper()
+
+	root := t.TempDir()
+	files := map[string]string{
+		"index.html":        "<h1>home</h1>",
+		"app.js":            "console.log('plain')",
+		"app.js.br":         "brotli-bytes",
+		"app.js.gz":         "gzip-bytes",
+		"assets/logo.svg":   "<svg/>",
+		"docs/readme.txt":   "readme",
+		"docs/sub/note.txt": "note",
+	}
+	for name, body := range files {
+		fp := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fp), 0750); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(fp, []byte(body), 0600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	cfg.Root = root
+	h, err := newStaticHandler(models.Path{Location: "/", StripPrefix: stripPrefix, Static: &cfg})
+	if err != nil {
+		t.Fatalf("newStaticHandler: %v", err)
+	}
+
+	return h
+}
+
+func serveStatic(h http.Handler, method, target string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://example.com"+target, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestStaticHandlerServesFiles(t *testing.T) {
+	t.Parallel()
+
+	h := newTestStaticHandler(t, models.Static{
+		CacheControl: []models.CacheControlRule{
+			{Match: "assets/*", Value: "public, max-age=31536000, immutable"},
+			{Match: "*.html", Value: "no-cache"},
+		},
+	}, "")
+
+	rec := serveStatic(h, http.MethodGet, "/", nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != "<h1>home</h1>" {
+		t.Fatalf("index response = %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Cache-Control") != "no-cache" {
+		t.Fatalf("index cache-control = %q", rec.Header().Get("Cache-Control"))
+	}
+
+	rec = serveStatic(h, http.MethodGet, "/assets/logo.svg", nil)
+	if rec.Header().Get("Cache-Control") != "public, max-age=31536000, immutable" {
+		t.Fatalf("asset cache-control = %q", rec.Header().Get("Cache-Control"))
+	}
+	if rec.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Fatalf("asset content-type = %q", rec.Header().Get("Content-Type"))
+	}
+
+	etag := rec.Header().Get("ETag")
+	if etag == "" || rec.Header().Get("Last-Modified") == "" {
+		t.Fatalf("missing validators: %v", rec.Header())
+	}
+
+	rec = serveStatic(h, http.MethodGet, "/assets/logo.svg", map[string]string{"If-None-Match": etag})
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("conditional status = %d, want 304", rec.Code)
+	}
+
+	rec = serveStatic(h, http.MethodGet, "/docs/readme.txt", map[string]string{"Range": "bytes=0-3"})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "read" {
+		t.Fatalf("range response = %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = serveStatic(h, http.MethodGet, "/../../etc/passwd", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("traversal status = %d, want 404", rec.Code)
+	}
+
+	rec = serveStatic(h, http.MethodPost, "/", nil)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST status = %d, want 405", rec.Code)
+	}
+}
+
+func TestStaticHandlerPrecompressed(t *testing.T) {
+	t.Parallel()
+
+	h := newTestStaticHandler(t, models.Static{Precompressed: true}, "")
+
+	tests := []struct {
+		accept       string
+		wantBody     string
+		wantEncoding string
+	}{
+		{accept: "gzip, br", wantBody: "brotli-bytes", wantEncoding: "br"},
+		{accept: "gzip", wantBody: "gzip-bytes", wantEncoding: "gzip"},
+		{accept: "br;q=0, gzip;q=0.5", wantBody: "gzip-bytes", wantEncoding: "gzip"},
+		{accept: "", wantBody: "console.log('plain')", wantEncoding: ""},
+	}
+
+	for _, tt := range tests {
+		rec := serveStatic(h, http.MethodGet, "/app.js", map[string]string{"Accept-Encoding": tt.accept})
+		if rec.Body.String() != tt.wantBody {
+			t.Fatalf("Accept-Encoding %q body = %q, want %q", tt.accept, rec.Body.String(), tt.wantBody)
+		}
+		if got := rec.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+			t.Fatalf("Accept-Encoding %q encoding = %q, want %q", tt.accept, got, tt.wantEncoding)
+		}
+		if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/javascript") {
+			t.Fatalf("content-type = %q", rec.Header().Get("Content-Type"))
+		}
+		if rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("vary = %q", rec.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestStaticHandlerDirectoriesAndSPA(t *testing.T) {
+	t.Parallel()
+
+	plain := newTestStaticHandler(t, models.Static{}, "/static")
+
+	rec := serveStatic(plain, http.MethodGet, "/static/docs/", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("listing without browse = %d, want 404", rec.Code)
+	}
+
+	rec = serveStatic(plain, http.MethodGet, "/static/missing", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("missing file without spa = %d, want 404", rec.Code)
+	}
+
+	browse := newTestStaticHandler(t, models.Static{Browse: true, SPA: true}, "")
+
+	rec = serveStatic(browse, http.MethodGet, "/docs", nil)
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "/docs/" {
+		t.Fatalf("directory redirect = %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	rec = serveStatic(browse, http.MethodGet, "/docs/", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `<a href="readme.txt">readme.txt</a>`) ||
+		!strings.Contains(rec.Body.String(), `<a href="sub/">sub/</a>`) {
+		t.Fatalf("listing = %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = serveStatic(browse, http.MethodGet, "/app/settings/profile", nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != "<h1>home</h1>" {
+		t.Fatalf("spa fallback = %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		header   string
+		encoding string
+		want     bool
+	}{
+		{header: "gzip, deflate, br", encoding: "br", want: true},
+		{header: "gzip", encoding: "br", want: false},
+		{header: "br;q=0", encoding: "br", want: false},
+		{header: "*", encoding: "zstd", want: true},
+		{header: "*;q=0, gzip", encoding: "br", want: false},
+		{header: "", encoding: "gzip", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := acceptsEncoding(tt.header, tt.encoding); got != tt.want {
+			t.Fatalf("acceptsEncoding(%q, %q) = %v, want %v", tt.header, tt.encoding, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+type certificateStatusEntry struct {
+	models.CertificateInfo
+	DaysRemaining int    `json:"daysRemaining"`
+	Status        string `json:"status"`
+	Message       string `json:"message,omitempty"`
+}
+
+// startStatusServer serves operational information on a local-only listener.
+func (r *Routy) startStatusServer() {
+	if r.routes.Status != nil && r.routes.Status.Disabled {
+		return
+	}
+
+	listen := r.routes.StatusAddress()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /certs", r.certsStatusHandler)
+	mux.HandleFunc("POST /cache/purge", r.cachePurgeHandler)
+	mux.HandleFunc("GET /mirrors", r.mirrorsStatusHandler)
+
+	go func() {
+		server := &http.Server{
+			Addr:              listen,
+			Handler:           mux,
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			r.EventLog <- logging.EventLogMessage{
+				Level:   "ERROR",
+				Caller:  "startStatusServer()->server.ListenAndServe()",
+				Message: fmt.Sprintf("failed to start status server: %v", err),
+			}
+		}
+	}()
+}
+
+func (r *Routy) certsStatusHandler(w http.ResponseWriter, _ *http.Request) {
+	certs, err := models.GetCertificates()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, warnDays, errorDays := r.certMonitorSettings()
+	now := time.Now()
+
+	entries := make([]certificateStatusEntry, 0, len(certs))
+	for _, c := range certs {
+		status, msg := certificateStatus(c, now, warnDays, errorDays)
+		entries = append(entries, certificateStatusEntry{
+			CertificateInfo: c,
+			DaysRemaining:   c.DaysRemaining(now),
+			Status:          status,
+			Message:         msg,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entries)
+}
+
+// cachePurgeHandler removes cached responses whose host and path start with
+// the prefix query parameter, or every response when it is empty.
+func (r *Routy) cachePurgeHandler(w http.ResponseWriter, req *http.Request) {
+	prefix := req.URL.Query().Get("prefix")
+
+	purged := 0
+	if r.cacheStore != nil {
+		purged = r.cacheStore.purge(prefix)
+	}
+
+	r.EventLog <- logging.EventLogMessage{
+		Level:   "INFO",
+		Caller:  "cachePurgeHandler()",
+		Message: fmt.Sprintf("purged %d cached responses with prefix %s", purged, prefix),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
@@ -0,0 +1,522 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+const (
+	defaultStreamDialTimeout = 10 * time.Second
+	defaultUDPIdleTimeout    = 60 * time.Second
+	defaultUDPMaxSessions    = 1024
+	clientHelloTimeout       = 5 * time.Second
+	maxUDPPacketSize         = 64 << 10
+)
+
+// streamTargets spreads connections over a stream's targets in turn.
+type streamTargets struct {
+	addrs []string
+	next  atomic.Uint32
+}
+
+func newStreamTargets(addrs []string) (*streamTargets, error) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+
+	for _, a := range addrs {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			return nil, fmt.Errorf("invalid stream target %q: %v", a, err)
+		}
+	}
+
+	return &streamTargets{addrs: addrs}, nil
+}
+
+// dial connects to the next target, trying the others in order if it cannot
+// be reached.
+func (st *streamTargets) dial(network string) (net.Conn, error) {
+	start := int(st.next.Add(1) - 1)
+
+	var lastErr error
+	for i := range st.addrs {
+		addr := st.addrs[(start+i)%len(st.addrs)]
+
+		conn, err := net.DialTimeout(network, addr, defaultStreamDialTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// sniRouter picks targets by TLS server name.
+type sniRouter struct {
+	exact    map[string]*streamTargets
+	wildcard map[string]*streamTargets
+}
+
+func newSNIRouter(routes []models.SNIRoute) (*sniRouter, error) {
+	if len(routes) == 0 {
+		return nil, nil
+	}
+
+	sr := &sniRouter{
+		exact:    make(map[string]*streamTargets),
+		wildcard: make(map[string]*streamTargets),
+	}
+
+	for _, route := range routes {
+		targets, err := newStreamTargets(route.Targets)
+		if err != nil {
+			return nil, err
+		}
+		if targets == nil {
+			return nil, fmt.Errorf("sni route for %s has no targets", strings.Join(route.Hostnames, ", "))
+		}
+
+		for _, h := range route.Hostnames {
+			h = strings.ToLower(h)
+			if strings.HasPrefix(h, "*.") {
+				sr.wildcard[h[2:]] = targets
+			} else {
+				sr.exact[h] = targets
+			}
+		}
+	}
+
+	return sr, nil
+}
+
+func (sr *sniRouter) lookup(serverName string) *streamTargets {
+	name := strings.ToLower(serverName)
+	if t, ok := sr.exact[name]; ok {
+		return t
+	}
+
+	if i := strings.Index(name, "."); i >= 0 {
+		return sr.wildcard[name[i+1:]]
+	}
+
+	return nil
+}
+
+type tcpStream struct {
+	cfg     models.Stream
+	targets *streamTargets
+	sni     *sniRouter
+	https   *handoffListener
+}
+
+// isHTTPSAddress reports whether listen is the address of the HTTPS listener.
+func isHTTPSAddress(listen string) bool {
+	host, port, err := net.SplitHostPort(listen)
+	return err == nil && host == "" && (port == "443" || port == "https")
+}
+
+// startStreams starts the configured stream listeners. A TCP stream on the
+// HTTPS address shares the listener with the HTTPS server: connections whose
+// server name it does not route are returned through the listener it returns.
+func (r *Routy) startStreams() (net.Listener, error) {
+	var httpsListener net.Listener
+
+	for _, s := range r.routes.Streams {
+		targets, err := newStreamTargets(s.Targets)
+		if err != nil {
+			return nil, err
+		}
+
+		switch strings.ToLower(s.Protocol) {
+		case "", "tcp":
+			stream := &tcpStream{cfg: s, targets: targets}
+
+			stream.sni, err = newSNIRouter(s.SNI)
+			if err != nil {
+				return nil, err
+			}
+
+			if stream.targets == nil && stream.sni == nil {
+				return nil, fmt.Errorf("stream %s has no targets", s.Listen)
+			}
+
+			ln, err := net.Listen("tcp", s.Listen)
+			if err != nil {
+				return nil, fmt.Errorf("failed to listen for stream %s: %v", s.Listen, err)
+			}
+
+			if isHTTPSAddress(s.Listen) {
+				if httpsListener != nil || stream.targets != nil || stream.sni == nil {
+					_ = ln.Close()
+					return nil, fmt.Errorf("a stream on the https address must route by sni only and there can only be one")
+				}
+
+				stream.https = newHandoffListener(ln)
+				httpsListener = stream.https
+			}
+
+			go r.serveTCPStream(ln, stream)
+		case "udp":
+			if targets == nil {
+				return nil, fmt.Errorf("stream %s has no targets", s.Listen)
+			}
+
+			pc, err := net.ListenPacket("udp", s.Listen)
+			if err != nil {
+				return nil, fmt.Errorf("failed to listen for stream %s: %v", s.Listen, err)
+			}
+
+			go r.serveUDPStream(pc, s, targets)
+		default:
+			return nil, fmt.Errorf("unsupported stream protocol %q", s.Protocol)
+		}
+	}
+
+	return httpsListener, nil
+}
+
+// streamRequest describes a stream connection as a request for the access log.
+func streamRequest(protocol, host, remoteAddr string) *http.Request {
+	return &http.Request{
+		Method:     strings.ToUpper(protocol),
+		URL:        &url.URL{Scheme: protocol, Host: host},
+		RemoteAddr: remoteAddr,
+		Header:     http.Header{},
+	}
+}
+
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+func (r *Routy) serveTCPStream(ln net.Listener, s *tcpStream) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			r.EventLog <- logging.EventLogMessage{
+				Level:   "ERROR",
+				Caller:  "serveTCPStream()->ln.Accept()",
+				Message: fmt.Sprintf("failed to accept stream connection on %s: %v", s.cfg.Listen, err),
+			}
+
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		go r.handleTCPStream(conn, s)
+	}
+}
+
+func (r *Routy) handleTCPStream(conn net.Conn, s *tcpStream) {
+	if r.denyList.IsDenied(remoteIP(conn.RemoteAddr())) {
+		_ = conn.Close()
+		return
+	}
+
+	targets := s.targets
+	host := s.cfg.Listen
+
+	if s.sni != nil {
+		_ = conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+		hello, replay, err := peekClientHello(conn)
+		_ = conn.SetReadDeadline(time.Time{})
+
+		conn = &prefixConn{Conn: conn, r: replay}
+
+		if err == nil && hello.ServerName != "" {
+			if t := s.sni.lookup(hello.ServerName); t != nil {
+				targets = t
+				host = hello.ServerName
+			}
+		}
+
+		if targets == s.targets && s.https != nil {
+			s.https.handoff(conn)
+			return
+		}
+	}
+
+	if targets == nil {
+		_ = conn.Close()
+		return
+	}
+
+	r.accessLog <- streamRequest("tcp", host, conn.RemoteAddr().String())
+
+	upstream, err := targets.dial("tcp")
+	if err != nil {
+		r.EventLog <- logging.EventLogMessage{
+			Level:   "ERROR",
+			Caller:  "handleTCPStream()->targets.dial()",
+			Message: fmt.Sprintf("failed to connect stream %s to an upstream: %v", host, err),
+		}
+
+		_ = conn.Close()
+		return
+	}
+
+	pipeStreams(conn, upstream)
+}
+
+// pipeStreams copies data both ways until both sides are done, passing on
+// half-closes so protocols that shut down their write side keep working.
+func pipeStreams(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+
+		_, _ = io.Copy(dst, src)
+
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+
+	_ = a.Close()
+	_ = b.Close()
+}
+
+// peekClientHello reads the TLS ClientHello from r without completing the
+// handshake. The returned reader replays everything read so far.
+func peekClientHello(r io.Reader) (*tls.ClientHelloInfo, io.Reader, error) {
+	peeked := new(bytes.Buffer)
+
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(readOnlyConn{r: io.TeeReader(r, peeked)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = &tls.ClientHelloInfo{ServerName: h.ServerName, SupportedProtos: h.SupportedProtos}
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	replay := io.MultiReader(peeked, r)
+	if hello == nil {
+		return nil, replay, err
+	}
+
+	return hello, replay, nil
+}
+
+var errHelloRead = errors.New("client hello read")
+
+// readOnlyConn lets a TLS server read a ClientHello without answering it.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(_ time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(_ time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(_ time.Time) error { return nil }
+
+// prefixConn is a connection whose first bytes have already been read and
+// are replayed from r.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Conn.Close()
+}
+
+// handoffListener passes connections a stream did not route on to the HTTPS
+// server.
+type handoffListener struct {
+	net.Listener
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newHandoffListener(ln net.Listener) *handoffListener {
+	return &handoffListener{
+		Listener: ln,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *handoffListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *handoffListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+
+	return l.Listener.Close()
+}
+
+func (l *handoffListener) handoff(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		_ = c.Close()
+	}
+}
+
+type udpSession struct {
+	upstream   net.Conn
+	lastActive atomic.Int64
+}
+
+func (r *Routy) serveUDPStream(pc net.PacketConn, s models.Stream, targets *streamTargets) {
+	idle := timeoutOrDefault(s.IdleTimeout, defaultUDPIdleTimeout)
+
+	maxSessions := defaultUDPMaxSessions
+	if s.MaxSessions > 0 {
+		maxSessions = s.MaxSessions
+	}
+
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+	full := false
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		key := addr.String()
+
+		mu.Lock()
+		sess := sessions[key]
+		count := len(sessions)
+		mu.Unlock()
+
+		if sess == nil {
+			if r.denyList.IsDenied(remoteIP(addr)) {
+				continue
+			}
+
+			// source addresses are easily forged, so new sessions are
+			// dropped rather than letting them use up sockets
+			if count >= maxSessions {
+				if !full {
+					full = true
+					r.EventLog <- logging.EventLogMessage{
+						Level:   "WARN",
+						Caller:  "serveUDPStream()",
+						Message: fmt.Sprintf("stream %s has %d sessions open; dropping packets from new clients", s.Listen, count),
+					}
+				}
+
+				continue
+			}
+			full = false
+
+			upstream, err := targets.dial("udp")
+			if err != nil {
+				r.EventLog <- logging.EventLogMessage{
+					Level:   "ERROR",
+					Caller:  "serveUDPStream()->targets.dial()",
+					Message: fmt.Sprintf("failed to connect stream %s to an upstream: %v", s.Listen, err),
+				}
+
+				continue
+			}
+
+			sess = &udpSession{upstream: upstream}
+			mu.Lock()
+			sessions[key] = sess
+			mu.Unlock()
+
+			r.accessLog <- streamRequest("udp", s.Listen, key)
+
+			go func() {
+				r.udpReplies(pc, addr, sess, idle)
+
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+			}()
+		}
+
+		sess.lastActive.Store(time.Now().UnixNano())
+		_, _ = sess.upstream.Write(buf[:n])
+	}
+}
+
+// udpReplies sends the upstream's datagrams back to the client until the
+// session has been idle in both directions for the idle timeout.
+func (r *Routy) udpReplies(pc net.PacketConn, client net.Addr, sess *udpSession, idle time.Duration) {
+	defer func() {
+		_ = sess.upstream.Close()
+	}()
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		_ = sess.upstream.SetReadDeadline(time.Now().Add(idle))
+
+		n, err := sess.upstream.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() &&
+				time.Since(time.Unix(0, sess.lastActive.Load())) < idle {
+				continue
+			}
+
+			return
+		}
+
+		sess.lastActive.Store(time.Now().UnixNano())
+		if _, err := pc.WriteTo(buf[:n], client); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+func newTestStreamRouty(t *testing.T) *Routy {
+	t.Helper()
+
+	r := &Routy{
+		routes:    &models.Routes{},
+		denyList:  &models.DenyList{},
+		accessLog: make(chan *http.Request),
+		EventLog:  make(chan logging.EventLogMessage),
+	}
+
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+
+	go func() {
+		for {
+			select {
+			case <-r.accessLog:
+			case <-r.EventLog:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return r
+}
+
+// startTLSUpstream starts a TLS server for host that answers every
+// connection with its host name.
+func startTLSUpstream(t *testing.T, host string) string {
+	t.Helper()
+
+	cert, _ := newTestCertificate(t, host)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("tls.Listen() error = %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.WriteString(conn, host+"\n")
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// startEchoUpstream starts a TCP server that echoes what it reads.
+func startEchoUpstream(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func startTestStream(t *testing.T, r *Routy, s *tcpStream) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go r.serveTCPStream(ln, s)
+
+	return ln.Addr().String()
+}
+
+func TestSNIRouterLookup(t *testing.T) {
+	t.Parallel()
+
+	exact := &streamTargets{addrs: []string{"exact:443"}}
+	wild := &streamTargets{addrs: []string{"wild:443"}}
+
+	sr := &sniRouter{
+		exact:    map[string]*streamTargets{"db.example.com": exact},
+		wildcard: map[string]*streamTargets{"example.com": wild},
+	}
+
+	tests := []struct {
+		name string
+		host string
+		want *streamTargets
+	}{
+		{name: "exact", host: "db.example.com", want: exact},
+		{name: "case insensitive", host: "DB.Example.com", want: exact},
+		{name: "wildcard", host: "api.example.com", want: wild},
+		{name: "wildcard matches one label", host: "a.b.example.com", want: nil},
+		{name: "apex not matched by wildcard", host: "example.com", want: nil},
+		{name: "unknown", host: "other.org", want: nil},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := sr.lookup(tt.host); got != tt.want {
+				t.Fatalf("lookup(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeekClientHello(t *testing.T) {
+	t.Parallel()
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		defer client.Close()
+		_ = tls.Client(client, &tls.Config{ServerName: "db.example.com"}).Handshake()
+	}()
+
+	hello, replay, err := peekClientHello(server)
+	if err != nil {
+		t.Fatalf("peekClientHello() error = %v", err)
+	}
+
+	if hello.ServerName != "db.example.com" {
+		t.Fatalf("ServerName = %q, want %q", hello.ServerName, "db.example.com")
+	}
+
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(replay, first); err != nil {
+		t.Fatalf("replay read error = %v", err)
+	}
+	if first[0] != 0x16 {
+		t.Fatalf("replayed record type = %#x, want handshake (0x16)", first[0])
+	}
+}
+
+func TestTCPStreamSNIRouting(t *testing.T) {
+	t.Parallel()
+
+	r := newTestStreamRouty(t)
+
+	addrA := startTLSUpstream(t, "a.example.com")
+	addrB := startTLSUpstream(t, "b.example.com")
+
+	sni, err := newSNIRouter([]models.SNIRoute{
+		{Hostnames: []string{"a.example.com"}, Targets: []string{addrA}},
+		{Hostnames: []string{"*.example.com"}, Targets: []string{addrB}},
+	})
+	if err != nil {
+		t.Fatalf("newSNIRouter() error = %v", err)
+	}
+
+	listen := startTestStream(t, r, &tcpStream{sni: sni})
+
+	tests := []struct {
+		name       string
+		serverName string
+		want       string
+	}{
+		{name: "exact", serverName: "a.example.com", want: "a.example.com"},
+		{name: "wildcard", serverName: "b.example.com", want: "b.example.com"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			// the backends hold their own certificates, so seeing them
+			// shows the session was passed through
+			conn, err := tls.Dial("tcp", listen, &tls.Config{
+				ServerName:         tt.serverName,
+				InsecureSkipVerify: true,
+			})
+			if err != nil {
+				t.Fatalf("tls.Dial() error = %v", err)
+			}
+			defer conn.Close()
+
+			if got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; got != tt.want {
+				t.Fatalf("backend certificate = %q, want %q", got, tt.want)
+			}
+
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				t.Fatalf("read error = %v", err)
+			}
+			if line != tt.want+"\n" {
+				t.Fatalf("backend answered %q, want %q", line, tt.want+"\n")
+			}
+		})
+	}
+}
+
+func TestTCPStreamFailover(t *testing.T) {
+	t.Parallel()
+
+	r := newTestStreamRouty(t)
+
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	downAddr := down.Addr().String()
+	_ = down.Close()
+
+	targets, err := newStreamTargets([]string{downAddr, startEchoUpstream(t)})
+	if err != nil {
+		t.Fatalf("newStreamTargets() error = %v", err)
+	}
+
+	listen := startTestStream(t, r, &tcpStream{targets: targets})
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", listen)
+		if err != nil {
+			t.Fatalf("net.Dial() error = %v", err)
+		}
+
+		_, _ = io.WriteString(conn, "ping")
+		_ = conn.(*net.TCPConn).CloseWrite()
+
+		got, err := io.ReadAll(conn)
+		_ = conn.Close()
+		if err != nil {
+			t.Fatalf("read error = %v", err)
+		}
+		if string(got) != "ping" {
+			t.Fatalf("echo = %q, want %q", got, "ping")
+		}
+	}
+}
+
+func TestTCPStreamHandsOffUnroutedConnections(t *testing.T) {
+	t.Parallel()
+
+	r := newTestStreamRouty(t)
+
+	sni, err := newSNIRouter([]models.SNIRoute{
+		{Hostnames: []string{"db.example.com"}, Targets: []string{"127.0.0.1:1"}},
+	})
+	if err != nil {
+		t.Fatalf("newSNIRouter() error = %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+
+	stream := &tcpStream{sni: sni, https: newHandoffListener(ln)}
+	defer stream.https.Close()
+	go r.serveTCPStream(ln, stream)
+
+	cert, pool := newTestCertificate(t, "www.example.com")
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = io.WriteString(w, "https")
+		}),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	go func() { _ = server.ServeTLS(stream.https, "", "") }()
+	defer server.Close()
+
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "www.example.com"}},
+	}
+
+	resp, err := client.Get("https://" + ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "https" {
+		t.Fatalf("body = %q, want %q", body, "https")
+	}
+}
+
+func TestUDPStream(t *testing.T) {
+	t.Parallel()
+
+	conn := dialUDPStream(t, models.Stream{Protocol: "udp", IdleTimeout: 1000})
+
+	buf := make([]byte, 1500)
+	for _, msg := range []string{"one", "two"} {
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if _, err := io.WriteString(conn, msg); err != nil {
+			t.Fatalf("write error = %v", err)
+		}
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("read error = %v", err)
+		}
+		if string(buf[:n]) != msg {
+			t.Fatalf("echo = %q, want %q", buf[:n], msg)
+		}
+	}
+}
+
+func TestUDPStreamMaxSessions(t *testing.T) {
+	t.Parallel()
+
+	first := dialUDPStream(t, models.Stream{Protocol: "udp", IdleTimeout: 5000, MaxSessions: 1})
+
+	second, err := net.Dial("udp", first.RemoteAddr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() error = %v", err)
+	}
+	defer second.Close()
+
+	buf := make([]byte, 1500)
+	_ = first.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(first, "one"); err != nil {
+		t.Fatalf("write error = %v", err)
+	}
+	if _, err := first.Read(buf); err != nil {
+		t.Fatalf("read error = %v", err)
+	}
+
+	_ = second.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := io.WriteString(second, "two"); err != nil {
+		t.Fatalf("write error = %v", err)
+	}
+	if n, err := second.Read(buf); err == nil {
+		t.Fatalf("client over the session limit got %q, want its packets dropped", buf[:n])
+	}
+
+	_ = first.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(first, "three"); err != nil {
+		t.Fatalf("write error = %v", err)
+	}
+	if n, err := first.Read(buf); err != nil || string(buf[:n]) != "three" {
+		t.Fatalf("echo = %q, %v, want the open session to keep working", buf[:n], err)
+	}
+}
+
+// dialUDPStream serves stream in front of an echo upstream and returns a
+// client connected to it.
+func dialUDPStream(t *testing.T, stream models.Stream) net.Conn {
+	t.Helper()
+
+	r := newTestStreamRouty(t)
+
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	t.Cleanup(func() { _ = upstream.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = upstream.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+
+	targets, err := newStreamTargets([]string{upstream.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("newStreamTargets() error = %v", err)
+	}
+
+	go r.serveUDPStream(pc, stream, targets)
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() error = %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+func TestStartStreamsValidation(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		stream models.Stream
+	}{
+		{name: "no targets", stream: models.Stream{Listen: "127.0.0.1:0"}},
+		{name: "bad target", stream: models.Stream{Listen: "127.0.0.1:0", Targets: []string{"nohost"}}},
+		{name: "bad protocol", stream: models.Stream{Listen: "127.0.0.1:0", Protocol: "sctp", Targets: []string{"127.0.0.1:1"}}},
+		{name: "udp sni only", stream: models.Stream{Listen: "127.0.0.1:0", Protocol: "udp"}},
+		{name: "sni route without targets", stream: models.Stream{
+			Listen: "127.0.0.1:0",
+			SNI:    []models.SNIRoute{{Hostnames: []string{"a.example.com"}}},
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := newTestStreamRouty(t)
+			r.routes.Streams = []models.Stream{tt.stream}
+
+			if _, err := r.startStreams(); err == nil {
+				t.Fatalf("startStreams() error = nil, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,387 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/ocsp"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+}
+
+// tlsConfig builds the listener TLS config from the certificate manager and
+// the global and per-domain tls settings in cfg.yaml.
+func (r *Routy) tlsConfig(certManager *autocert.Manager) (*tls.Config, error) {
+	base := certManager.TLSConfig()
+
+	global, err := applyTLSConfig(base, r.routes.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid global tls config: %v", err)
+	}
+
+	stapler := newOCSPStapler(r.EventLog)
+	overrides := make(map[string]*tls.Config)
+
+	for _, d := range r.routes.Domains {
+		if d.TLS == nil {
+			continue
+		}
+
+		merged := r.routes.TLS.Merge(d.TLS)
+		cfg, err := applyTLSConfig(base, merged)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls config for domain %s: %v", d.Name, err)
+		}
+
+		if merged.OCSPStapling != nil && *merged.OCSPStapling {
+			cfg.GetCertificate = stapler.wrap(cfg.GetCertificate)
+		}
+
+		overrides[d.Name] = cfg
+	}
+
+	if r.routes.TLS != nil && r.routes.TLS.OCSPStapling != nil && *r.routes.TLS.OCSPStapling {
+		global.GetCertificate = stapler.wrap(global.GetCertificate)
+	}
+
+	if len(overrides) > 0 {
+		global.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if cfg, ok := lookupDomain(overrides, hello.ServerName); ok {
+				return cfg, nil
+			}
+
+			return nil, nil
+		}
+	}
+
+	return global, nil
+}
+
+// lookupDomain returns the value for the most specific domain in m that host
+// belongs to, matching the domain itself or any of its subdomains.
+func lookupDomain[T any](m map[string]T, host string) (T, bool) {
+	name := hostWithoutPort(host)
+
+	for {
+		if v, ok := m[name]; ok {
+			return v, true
+		}
+
+		idx := strings.Index(name, ".")
+		if idx == -1 {
+			var zero T
+			return zero, false
+		}
+		name = name[idx+1:]
+	}
+}
+
+// applyTLSConfig returns a clone of base with the versions, cipher suites and
+// curves from cfg applied.
+func applyTLSConfig(base *tls.Config, cfg *models.TLSConfig) (*tls.Config, error) {
+	out := base.Clone()
+	if cfg == nil {
+		return out, nil
+	}
+
+	if cfg.MinVersion != "" {
+		v, err := parseTLSVersion(cfg.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+		out.MinVersion = v
+	}
+
+	if cfg.MaxVersion != "" {
+		v, err := parseTLSVersion(cfg.MaxVersion)
+		if err != nil {
+			return nil, err
+		}
+		out.MaxVersion = v
+	}
+
+	if out.MinVersion != 0 && out.MaxVersion != 0 && out.MinVersion > out.MaxVersion {
+		return nil, fmt.Errorf("minVersion %s is greater than maxVersion %s", cfg.MinVersion, cfg.MaxVersion)
+	}
+
+	if len(cfg.CipherSuites) > 0 {
+		suites, err := parseCipherSuites(cfg.CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		out.CipherSuites = suites
+	}
+
+	if len(cfg.CurvePreferences) > 0 {
+		curves, err := parseCurves(cfg.CurvePreferences)
+		if err != nil {
+			return nil, err
+		}
+		out.CurvePreferences = curves
+	}
+
+	return out, nil
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(s), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("unknown tls version %q", s)
+	}
+
+	return v, nil
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, n := range names {
+		id, ok := known[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", n)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func parseCurves(names []string) ([]tls.CurveID, error) {
+	curves := make([]tls.CurveID, 0, len(names))
+	for _, n := range names {
+		c, ok := tlsCurves[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q", n)
+		}
+		curves = append(curves, c)
+	}
+
+	return curves, nil
+}
+
+// hstsHeader returns the Strict-Transport-Security header value for cfg.
+func hstsHeader(cfg *models.HSTSConfig) string {
+	if cfg == nil || cfg.MaxAge <= 0 {
+		return ""
+	}
+
+	v := "max-age=" + strconv.Itoa(cfg.MaxAge)
+	if cfg.IncludeSubDomains {
+		v += "; includeSubDomains"
+	}
+	if cfg.Preload {
+		v += "; preload"
+	}
+
+	return v
+}
+
+// hstsHandler adds the Strict-Transport-Security header to every response,
+// using the domain override when the request host belongs to one.
+func (r *Routy) hstsHandler(next http.Handler) http.Handler {
+	global := ""
+	if r.routes.TLS != nil {
+		global = hstsHeader(r.routes.TLS.HSTS)
+	}
+
+	headers := make(map[string]string)
+	for _, d := range r.routes.Domains {
+		if d.TLS != nil && d.TLS.HSTS != nil {
+			headers[d.Name] = hstsHeader(d.TLS.HSTS)
+		}
+	}
+
+	if global == "" && len(headers) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		v := global
+		if h, ok := lookupDomain(headers, req.Host); ok {
+			v = h
+		}
+
+		if v != "" && req.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", v)
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// ocspStapler fetches and caches OCSP responses for served certificates.
+type ocspStapler struct {
+	mu       sync.Mutex
+	staples  map[string]*ocspStaple
+	fetching map[string]bool
+	eventLog chan<- logging.EventLogMessage
+	client   *http.Client
+}
+
+type ocspStaple struct {
+	raw        []byte
+	nextUpdate time.Time
+}
+
+func newOCSPStapler(eventLog chan<- logging.EventLogMessage) *ocspStapler {
+	return &ocspStapler{
+		staples:  make(map[string]*ocspStaple),
+		fetching: make(map[string]bool),
+		eventLog: eventLog,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// wrap returns a GetCertificate func that attaches a cached OCSP response to
+// the certificate. Missing or stale responses are refreshed in the background
+// so the handshake is never blocked on the responder.
+func (s *ocspStapler) wrap(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := getCertificate(hello)
+		if err != nil || cert == nil || len(cert.Certificate) < 2 {
+			return cert, err
+		}
+
+		leaf := cert.Leaf
+		if leaf == nil {
+			leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return cert, nil
+			}
+		}
+
+		if len(leaf.OCSPServer) == 0 {
+			return cert, nil
+		}
+
+		key := leaf.SerialNumber.String()
+
+		s.mu.Lock()
+		staple := s.staples[key]
+		stale := staple == nil || time.Now().After(staple.nextUpdate)
+		if stale && !s.fetching[key] {
+			s.fetching[key] = true
+			go s.fetch(key, cert.Certificate)
+		}
+		s.mu.Unlock()
+
+		if stale {
+			return cert, nil
+		}
+
+		stapled := *cert
+		stapled.OCSPStaple = staple.raw
+
+		return &stapled, nil
+	}
+}
+
+func (s *ocspStapler) fetch(key string, chain [][]byte) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.fetching, key)
+		s.mu.Unlock()
+	}()
+
+	staple, err := s.request(chain)
+	if err != nil {
+		s.eventLog <- logging.EventLogMessage{
+			Level:   "WARN",
+			Caller:  "ocspStapler.fetch()",
+			Message: fmt.Sprintf("failed to fetch OCSP response for certificate %s: %v", key, err),
+		}
+
+		return
+	}
+
+	s.mu.Lock()
+	s.staples[key] = staple
+	s.mu.Unlock()
+}
+
+func (s *ocspStapler) request(chain [][]byte) (*ocspStaple, error) {
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+
+	issuer, err := x509.ParseCertificate(chain[1])
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder returned %s", resp.Status)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.Status != ocsp.Good {
+		return nil, fmt.Errorf("OCSP status is not good: %d", parsed.Status)
+	}
+
+	nextUpdate := parsed.NextUpdate
+	if nextUpdate.IsZero() {
+		nextUpdate = time.Now().Add(time.Hour)
+	}
+
+	return &ocspStaple{raw: raw, nextUpdate: nextUpdate}, nil
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+func TestApplyTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		cfg        *models.TLSConfig
+		wantMin    uint16
+		wantMax    uint16
+		wantSuites int
+		wantCurves int
+		wantErr    bool
+	}{
+		{
+			name: "nil config keeps base",
+			cfg:  nil,
+		},
+		{
+			name:    "tls 1.3 only",
+			cfg:     &models.TLSConfig{MinVersion: "1.3", MaxVersion: "TLS1.3"},
+			wantMin: tls.VersionTLS13,
+			wantMax: tls.VersionTLS13,
+		},
+		{
+			name: "suites and curves",
+			cfg: &models.TLSConfig{
+				MinVersion:       "1.2",
+				CipherSuites:     []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+				CurvePreferences: []string{"X25519", "P256"},
+			},
+			wantMin:    tls.VersionTLS12,
+			wantSuites: 2,
+			wantCurves: 2,
+		},
+		{
+			name:    "unknown version",
+			cfg:     &models.TLSConfig{MinVersion: "1.4"},
+			wantErr: true,
+		},
+		{
+			name:    "min above max",
+			cfg:     &models.TLSConfig{MinVersion: "1.3", MaxVersion: "1.2"},
+			wantErr: true,
+		},
+		{
+			name:    "insecure suite rejected",
+			cfg:     &models.TLSConfig{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown curve",
+			cfg:     &models.TLSConfig{CurvePreferences: []string{"P224"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := applyTLSConfig(&tls.Config{}, tt.cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.MinVersion != tt.wantMin {
+				t.Fatalf("min version = %x, want %x", got.MinVersion, tt.wantMin)
+			}
+			if got.MaxVersion != tt.wantMax {
+				t.Fatalf("max version = %x, want %x", got.MaxVersion, tt.wantMax)
+			}
+			if len(got.CipherSuites) != tt.wantSuites {
+				t.Fatalf("cipher suites = %d, want %d", len(got.CipherSuites), tt.wantSuites)
+			}
+			if len(got.CurvePreferences) != tt.wantCurves {
+				t.Fatalf("curves = %d, want %d", len(got.CurvePreferences), tt.wantCurves)
+			}
+		})
+	}
+}
+
+func TestHSTSHeader(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		cfg  *models.HSTSConfig
+		want string
+	}{
+		{
+			name: "nil",
+			cfg:  nil,
+			want: "",
+		},
+		{
+			name: "max age only",
+			cfg:  &models.HSTSConfig{MaxAge: 31536000},
+			want: "max-age=31536000",
+		},
+		{
+			name: "all options",
+			cfg:  &models.HSTSConfig{MaxAge: 63072000, IncludeSubDomains: true, Preload: true},
+			want: "max-age=63072000; includeSubDomains; preload",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := hstsHeader(tt.cfg); got != tt.want {
+				t.Fatalf("hstsHeader() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupDomain(t *testing.T) {
+	t.Parallel()
+
+	m := map[string]string{
+		"example.com":     "apex",
+		"foo.example.com": "foo",
+	}
+
+	tests := []struct {
+		host   string
+		want   string
+		wantOk bool
+	}{
+		{host: "example.com", want: "apex", wantOk: true},
+		{host: "bar.example.com:443", want: "apex", wantOk: true},
+		{host: "a.foo.example.com", want: "foo", wantOk: true},
+		{host: "FOO.example.com.", want: "foo", wantOk: true},
+		{host: "other.org", wantOk: false},
+	}
+
+	for _, tt := range tests {
+		got, ok := lookupDomain(m, tt.host)
+		if ok != tt.wantOk || got != tt.want {
+			t.Fatalf("lookupDomain(%q) = %q, %v, want %q, %v", tt.host, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultTracingServiceName = "routy"
+	tracerName                = "github.com/oorrwullie/routy"
+)
+
+// tracing creates spans for proxied requests and propagates W3C trace context
+// to upstreams. A nil *tracing disables tracing.
+type tracing struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// newTracing returns nil when tracing is not configured.
+func newTracing(cfg *models.TracingConfig) (*tracing, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	sampler, err := tracingSampler(cfg.Sampler, cfg.SampleRatio)
+	if err != nil {
+		return nil, err
+	}
+
+	exporter, err := newTraceExporter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTracingServiceName
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+
+	return &tracing{
+		provider:   provider,
+		tracer:     provider.Tracer(tracerName),
+		propagator: propagation.TraceContext{},
+	}, nil
+}
+
+func newTraceExporter(cfg *models.TracingConfig) (sdktrace.SpanExporter, error) {
+	ctx := context.Background()
+	isURL := strings.Contains(cfg.Endpoint, "://")
+
+	switch strings.ToLower(cfg.Protocol) {
+	case "", "http":
+		var opts []otlptracehttp.Option
+		if isURL {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		} else if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+		}
+
+		return otlptracehttp.New(ctx, opts...)
+	case "grpc":
+		var opts []otlptracegrpc.Option
+		if isURL {
+			opts = append(opts, otlptracegrpc.WithEndpointURL(cfg.Endpoint))
+		} else if cfg.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlptracegrpc.WithHeaders(cfg.Headers))
+		}
+
+		return otlptracegrpc.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unsupported tracing protocol %q", cfg.Protocol)
+	}
+}
+
+// tracingSampler maps the OpenTelemetry sampler names to a sampler.
+func tracingSampler(name string, ratio float64) (sdktrace.Sampler, error) {
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("sample ratio %v is not between 0 and 1", ratio)
+	}
+
+	switch strings.ToLower(name) {
+	case "", "parentbased_always_on":
+		return sdktrace.ParentBased(sdktrace.AlwaysSample()), nil
+	case "parentbased_always_off":
+		return sdktrace.ParentBased(sdktrace.NeverSample()), nil
+	case "parentbased_traceidratio":
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio)), nil
+	case "always_on":
+		return sdktrace.AlwaysSample(), nil
+	case "always_off":
+		return sdktrace.NeverSample(), nil
+	case "traceidratio":
+		return sdktrace.TraceIDRatioBased(ratio), nil
+	default:
+		return nil, fmt.Errorf("unsupported sampler %q", name)
+	}
+}
+
+// start begins a child span of the span in ctx.
+func (t *tracing) start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if t == nil {
+		return ctx, trace.SpanFromContext(context.Background())
+	}
+
+	return t.tracer.Start(ctx, name, opts...)
+}
+
+// startRequest starts the server span for req, continuing the trace in its
+// traceparent header if there is one.
+func (t *tracing) startRequest(req *http.Request, route string) (*http.Request, trace.Span) {
+	if t == nil {
+		return req, trace.SpanFromContext(context.Background())
+	}
+
+	ctx := t.propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := t.tracer.Start(ctx, req.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", req.URL.Path),
+			attribute.String("server.address", hostWithoutPort(req.Host)),
+			attribute.String("client.address", logging.GetRequestRemoteAddress(req)),
+		),
+	)
+
+	if id := logging.RequestID(ctx); id != "" {
+		span.SetAttributes(attribute.String("routy.request_id", id))
+	}
+
+	return req.WithContext(ctx), span
+}
+
+// inject writes the trace context in ctx to header.
+func (t *tracing) inject(ctx context.Context, header http.Header) {
+	if t == nil {
+		return
+	}
+
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// writer records the response status on span when the headers are written.
+func (t *tracing) writer(w http.ResponseWriter, span trace.Span) http.ResponseWriter {
+	if t == nil {
+		return w
+	}
+
+	return &spanWriter{ResponseWriter: w, span: span}
+}
+
+// transport wraps next so every upstream request gets a client span covering
+// the round trip and the response body.
+func (t *tracing) transport(next http.RoundTripper) http.RoundTripper {
+	if t == nil {
+		return next
+	}
+
+	return &tracingTransport{next: next, t: t}
+}
+
+func (t *tracing) shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	return t.provider.Shutdown(ctx)
+}
+
+// isDenied checks the deny list for the client of req inside its own span.
+func (r *Routy) isDenied(req *http.Request) bool {
+	addr := logging.GetRequestRemoteAddress(req)
+
+	_, span := r.tracing.start(req.Context(), "deny-list")
+	defer span.End()
+
+	denied := r.denyList.IsDenied(addr)
+	span.SetAttributes(attribute.Bool("routy.denied", denied))
+
+	return denied
+}
+
+// Shutdown flushes any spans that have not been exported yet.
+func (r *Routy) Shutdown(ctx context.Context) error {
+	return r.tracing.shutdown(ctx)
+}
+
+func setSpanStatus(span trace.Span, status int) {
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+type spanWriter struct {
+	http.ResponseWriter
+	span        trace.Span
+	wroteHeader bool
+}
+
+func (sw *spanWriter) WriteHeader(code int) {
+	if !sw.wroteHeader && (code < 100 || code >= 200 || code == http.StatusSwitchingProtocols) {
+		sw.wroteHeader = true
+		setSpanStatus(sw.span, code)
+	}
+
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *spanWriter) Write(p []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *spanWriter) Flush() {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+
+	_ = http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+func (sw *spanWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+type tracingTransport struct {
+	next http.RoundTripper
+	t    *tracing
+}
+
+func (tt *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tt.t.tracer.Start(req.Context(), "upstream "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Hostname()),
+			attribute.String("url.full", req.URL.String()),
+		),
+	)
+
+	req = req.Clone(ctx)
+	tt.t.inject(ctx, req.Header)
+
+	resp, err := tt.next.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+
+		return nil, err
+	}
+
+	setSpanStatus(span, resp.StatusCode)
+
+	// upgraded connections keep their body, which the proxy needs as an
+	// io.ReadWriteCloser
+	if resp.StatusCode == http.StatusSwitchingProtocols || resp.Body == nil {
+		span.End()
+		return resp, nil
+	}
+
+	resp.Body = &spanBody{ReadCloser: resp.Body, span: span}
+
+	return resp, nil
+}
+
+// spanBody ends the upstream span once the response body has been consumed.
+type spanBody struct {
+	io.ReadCloser
+	span trace.Span
+	once sync.Once
+}
+
+func (b *spanBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.span.RecordError(err)
+	}
+
+	return n, err
+}
+
+func (b *spanBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.span.End()
+	})
+
+	return err
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/oorrwullie/routy/internal/models"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newTestTracing() (*tracing, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	return &tracing{
+		provider:   provider,
+		tracer:     provider.Tracer(tracerName),
+		propagator: propagation.TraceContext{},
+	}, recorder
+}
+
+func TestTracingSampler(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		sampler string
+		ratio   float64
+		wantErr bool
+	}{
+		{name: "default"},
+		{name: "parent based ratio", sampler: "parentbased_traceidratio", ratio: 0.25},
+		{name: "always off", sampler: "ALWAYS_OFF"},
+		{name: "unknown sampler", sampler: "sometimes", wantErr: true},
+		{name: "ratio out of range", sampler: "traceidratio", ratio: 1.5, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := tracingSampler(tt.sampler, tt.ratio)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("tracingSampler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewTracingUnsupportedProtocol(t *testing.T) {
+	t.Parallel()
+
+	if _, err := newTracing(&models.TracingConfig{Protocol: "thrift"}); err == nil {
+		t.Fatal("newTracing() error = nil, want error")
+	}
+}
+
+func TestTracingPropagation(t *testing.T) {
+	t.Parallel()
+
+	tr, recorder := newTestTracing()
+
+	var upstreamTraceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamTraceparent = req.Header.Get("Traceparent")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	res := newResolver(tr)
+	client := &http.Client{Transport: tr.transport(&http.Transport{DialContext: res.dialUpstream(&net.Dialer{}, target.Host)})}
+
+	const incoming = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req, span := tr.startRequest(req, "example.com/")
+		defer span.End()
+		w = tr.writer(w, span)
+
+		out, _ := http.NewRequestWithContext(req.Context(), http.MethodGet, target.String(), nil)
+		resp, err := client.Do(out)
+		if err != nil {
+			t.Errorf("upstream request error = %v", err)
+			return
+		}
+		_ = resp.Body.Close()
+
+		w.WriteHeader(resp.StatusCode)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("Traceparent", incoming)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusTeapot {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusTeapot)
+	}
+
+	sc := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(req.Context(), propagation.HeaderCarrier{"Traceparent": []string{upstreamTraceparent}}))
+	if got := sc.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("upstream trace id = %q, want the incoming trace id", got)
+	}
+
+	names := make(map[string]trace.SpanKind)
+	for _, s := range recorder.Ended() {
+		names[s.Name()] = s.SpanKind()
+		if s.SpanContext().TraceID() != sc.TraceID() {
+			t.Fatalf("span %s has trace id %s, want %s", s.Name(), s.SpanContext().TraceID(), sc.TraceID())
+		}
+	}
+
+	for name, kind := range map[string]trace.SpanKind{
+		"GET example.com/": trace.SpanKindServer,
+		"upstream GET":     trace.SpanKindClient,
+		"upstream dial":    trace.SpanKindInternal,
+	} {
+		if got, ok := names[name]; !ok || got != kind {
+			t.Fatalf("span %q kind = %v (recorded %v), want %v", name, got, ok, kind)
+		}
+	}
+}
+
+func TestTracingNilDisabled(t *testing.T) {
+	t.Parallel()
+
+	var tr *tracing
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	out, span := tr.startRequest(req, "example.com/")
+	span.End()
+
+	if out != req || span.SpanContext().IsValid() {
+		t.Fatal("nil tracing should not start spans")
+	}
+
+	rec := httptest.NewRecorder()
+	if tr.writer(rec, span) != rec {
+		t.Fatal("nil tracing should not wrap the response writer")
+	}
+}
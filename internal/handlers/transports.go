@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+const (
+	defaultMaxIdleConns        = 256
+	defaultMaxIdleConnsPerHost = 64
+	defaultKeepAlive           = 30 * time.Second
+)
+
+type transportKey struct {
+	upstream string
+	protocol string
+	timeouts models.Timeouts
+	pool     models.ConnectionPool
+}
+
+// transportRegistry shares one pooled transport between all paths that proxy
+// to the same upstream with the same settings.
+type transportRegistry struct {
+	mu         sync.Mutex
+	resolver   *resolver
+	transports map[transportKey]*http.Transport
+}
+
+func newTransportRegistry(res *resolver) *transportRegistry {
+	return &transportRegistry{
+		resolver:   res,
+		transports: make(map[transportKey]*http.Transport),
+	}
+}
+
+// poolConfig returns the most specific connection pool settings for a path.
+func poolConfig(routes *models.Routes, path models.Path) *models.ConnectionPool {
+	if path.Pool != nil {
+		return path.Pool
+	}
+
+	return routes.Pool
+}
+
+// get returns the transport for upstream, creating it on first use.
+func (tr *transportRegistry) get(upstream, protocol string, timeouts *models.Timeouts, pool *models.ConnectionPool) *http.Transport {
+	key := transportKey{upstream: upstream, protocol: protocol}
+	if timeouts != nil {
+		key.timeouts = *timeouts
+	}
+	if pool != nil {
+		key.pool = *pool
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if t, ok := tr.transports[key]; ok {
+		return t
+	}
+
+	t := tr.newTransport(upstream, key.timeouts, key.pool)
+	setUpstreamProtocol(t, protocol)
+	tr.transports[key] = t
+
+	return t
+}
+
+func (tr *transportRegistry) newTransport(upstream string, timeouts models.Timeouts, pool models.ConnectionPool) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   timeoutOrDefault(timeouts.Dial, defaultDialTimeout),
+		KeepAlive: timeoutOrDefault(pool.KeepAlive, defaultKeepAlive),
+	}
+
+	dial := tr.resolver.dialUpstream(dialer, upstream)
+	if socket, ok := strings.CutPrefix(upstream, unixUpstreamPrefix); ok {
+		dial = tr.resolver.dialSocket(dialer, socket)
+	}
+
+	t := &http.Transport{
+		DialContext:           dial,
+		TLSHandshakeTimeout:   timeoutOrDefault(timeouts.TLSHandshake, defaultTLSHandshakeTimeout),
+		ResponseHeaderTimeout: timeoutOrDefault(timeouts.ResponseHeader, defaultResponseHeaderTimeout),
+		IdleConnTimeout:       timeoutOrDefault(timeouts.Idle, defaultIdleConnTimeout),
+		MaxIdleConns:          defaultMaxIdleConns,
+		MaxIdleConnsPerHost:   defaultMaxIdleConnsPerHost,
+		MaxConnsPerHost:       pool.MaxConnsPerHost,
+	}
+
+	if pool.MaxIdleConns > 0 {
+		t.MaxIdleConns = pool.MaxIdleConns
+	}
+	if pool.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = pool.MaxIdleConnsPerHost
+	}
+
+	return t
+}
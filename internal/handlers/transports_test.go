@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+// listenLoopback starts an upstream answering with name on host. Port 0 picks
+// a free port.
+func listenLoopback(t *testing.T, host, port, name string) (string, bool) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return "", false
+	}
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, name+" "+req.Host)
+	}))
+	upstream.Listener = ln
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+
+	return upstream.URL, true
+}
+
+func TestProxyUpstreamsOnSharedPort(t *testing.T) {
+	t.Parallel()
+
+	// two upstreams on the same port, which the proxies both send to the
+	// public host on that port
+	first, ok := listenLoopback(t, "127.0.0.2", "0", "first")
+	if !ok {
+		t.Skip("127.0.0.2 is not a loopback address on this system")
+	}
+	firstURL, _ := url.Parse(first)
+
+	second, ok := listenLoopback(t, "127.0.0.3", firstURL.Port(), "second")
+	if !ok {
+		t.Skip("the port is not free on 127.0.0.3")
+	}
+
+	r := newTestProxyRouty()
+	domain := models.Domain{Name: "example.com"}
+	sd := models.Subdomain{Name: "example.com"}
+
+	tests := []struct {
+		location string
+		target   string
+		want     string
+	}{
+		{location: "/", target: first, want: "first example.com"},
+		{location: "/other", target: second, want: "second example.com"},
+	}
+
+	for _, tt := range tests {
+		proxy, err := r.newProxy(domain, sd, models.Path{Location: tt.location, Target: tt.target})
+		if err != nil {
+			t.Fatalf("newProxy() error = %v", err)
+		}
+
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "https://example.com"+tt.location, nil))
+
+		if rec.Body.String() != tt.want {
+			t.Fatalf("path %s reached %q, want %q", tt.location, rec.Body.String(), tt.want)
+		}
+	}
+}
+
+func TestTransportRegistry(t *testing.T) {
+	t.Parallel()
+
+	tr := newTransportRegistry(newResolver(nil))
+
+	a := tr.get("10.0.0.1:80", "", nil, nil)
+	if b := tr.get("10.0.0.1:80", "", &models.Timeouts{}, &models.ConnectionPool{}); a != b {
+		t.Fatal("paths with the same upstream and settings got different transports")
+	}
+	if b := tr.get("10.0.0.2:80", "", nil, nil); a == b {
+		t.Fatal("different upstreams share a transport")
+	}
+	if b := tr.get("10.0.0.1:80", "", &models.Timeouts{ResponseHeader: 500}, nil); a == b {
+		t.Fatal("paths with different timeouts share a transport")
+	}
+
+	if a.MaxIdleConnsPerHost != defaultMaxIdleConnsPerHost {
+		t.Fatalf("MaxIdleConnsPerHost = %d, want %d", a.MaxIdleConnsPerHost, defaultMaxIdleConnsPerHost)
+	}
+
+	p := tr.get("10.0.0.1:80", "", nil, &models.ConnectionPool{MaxIdleConnsPerHost: 4, MaxConnsPerHost: 8})
+	if p.MaxIdleConnsPerHost != 4 || p.MaxConnsPerHost != 8 {
+		t.Fatalf("pool limits = %d/%d, want 4/8", p.MaxIdleConnsPerHost, p.MaxConnsPerHost)
+	}
+}
+
+func TestPoolConfig(t *testing.T) {
+	t.Parallel()
+
+	global := &models.ConnectionPool{MaxIdleConns: 10}
+	routes := &models.Routes{Pool: global}
+
+	if got := poolConfig(routes, models.Path{}); got != global {
+		t.Fatalf("poolConfig() = %v, want the global pool", got)
+	}
+
+	override := &models.ConnectionPool{MaxIdleConns: 20}
+	if got := poolConfig(routes, models.Path{Pool: override}); got != override {
+		t.Fatalf("poolConfig() = %v, want the path pool", got)
+	}
+}
+
+// legacyTransport is the transport every route used to build for itself. It
+// keeps net/http's default of two idle connections per host and holds a lock
+// across each dial, so new connections are made one at a time.
+func legacyTransport(upstream string) *http.Transport {
+	var mu sync.Mutex
+
+	return &http.Transport{
+		DialContext: func(_ context.Context, network, _ string) (net.Conn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			return net.Dial(network, upstream)
+		},
+	}
+}
+
+// BenchmarkProxy measures proxy throughput under parallel load. The per-route
+// case is the transport routes used to build for themselves, and the
+// small-pool case uses net/http's default of two idle connections per host
+// with the shared transport.
+func BenchmarkProxy(b *testing.B) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+
+	for _, bc := range []struct {
+		name   string
+		pool   *models.ConnectionPool
+		legacy bool
+	}{
+		{name: "per-route", legacy: true},
+		{name: "pooled"},
+		{name: "small-pool", pool: &models.ConnectionPool{MaxIdleConnsPerHost: 2}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			r := &Routy{routes: &models.Routes{Pool: bc.pool}}
+			r.transports = newTransportRegistry(newResolver(nil))
+
+			domain := models.Domain{Name: "example.com"}
+			sd := models.Subdomain{Name: "example.com"}
+			proxy, err := r.newProxy(domain, sd, models.Path{Location: "/", Target: upstream.URL})
+			if err != nil {
+				b.Fatalf("newProxy() error = %v", err)
+			}
+
+			if bc.legacy {
+				public := &url.URL{Scheme: "http", Host: net.JoinHostPort("example.com", target.Port())}
+				proxy = &httputil.ReverseProxy{
+					Rewrite: func(req *httputil.ProxyRequest) {
+						req.SetXForwarded()
+						req.SetURL(public)
+						req.Out.Host = "example.com"
+					},
+					Transport: legacyTransport(target.Host),
+				}
+			}
+
+			// enough concurrent requests to need more than two connections,
+			// whatever the number of CPUs
+			b.SetParallelism(16)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					rec := httptest.NewRecorder()
+					proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+					if rec.Code != http.StatusOK {
+						b.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+						return
+					}
+					_, _ = io.Copy(io.Discard, rec.Body)
+				}
+			})
+		})
+	}
+}
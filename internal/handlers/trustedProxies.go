@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the addresses, such as load balancers in front of routy,
+// whose forwarding headers are believed.
+type trustedProxies []*net.IPNet
+
+func newTrustedProxies(cidrs []string) (trustedProxies, error) {
+	var tp trustedProxies
+
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			if strings.Contains(c, ":") {
+				c += "/128"
+			} else {
+				c += "/32"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s: %v", c, err)
+		}
+		tp = append(tp, ipNet)
+	}
+
+	return tp, nil
+}
+
+func (tp trustedProxies) contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, c := range tp {
+		if c.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// trustedPeer reports whether the connection itself, not a forwarded header,
+// comes from a trusted address.
+func (tp trustedProxies) trustedPeer(req *http.Request) bool {
+	return tp.contains(connAddress(req))
+}
+
+// clientAddress returns the address of the client. The forwarding headers
+// can be set by anyone, so they are only read when the connection comes from
+// a trusted proxy. X-Forwarded-For is read from the right, skipping further
+// trusted proxies, as the entries on its left are up to the client.
+func (tp trustedProxies) clientAddress(req *http.Request) string {
+	addr := connAddress(req)
+	if !tp.contains(addr) {
+		return addr
+	}
+
+	if forwarded := req.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+
+			addr = hop
+			if !tp.contains(hop) {
+				break
+			}
+		}
+
+		return addr
+	}
+
+	if realIP := strings.TrimSpace(req.Header.Get("X-Real-Ip")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+
+	return addr
+}
+
+// connAddress returns the IP address of the connection.
+func connAddress(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
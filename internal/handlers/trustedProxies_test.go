@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxiesClientAddress(t *testing.T) {
+	t.Parallel()
+
+	proxies, err := newTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("newTrustedProxies() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{name: "direct client", remoteAddr: "203.0.113.7:1234", want: "203.0.113.7"},
+		{name: "spoofed by a direct client", remoteAddr: "203.0.113.7:1234", forwarded: []string{"198.51.100.1"}, realIP: "198.51.100.2", want: "203.0.113.7"},
+		{name: "forwarded by a trusted proxy", remoteAddr: "10.0.0.1:1234", forwarded: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "client entries on the left are skipped", remoteAddr: "10.0.0.1:1234", forwarded: []string{"198.51.100.9, 203.0.113.7"}, want: "203.0.113.7"},
+		{name: "chained trusted proxies", remoteAddr: "10.0.0.1:1234", forwarded: []string{"203.0.113.7", "192.0.2.1"}, want: "203.0.113.7"},
+		{name: "real ip from a trusted proxy", remoteAddr: "10.0.0.1:1234", realIP: "203.0.113.7", want: "203.0.113.7"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, f := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", f)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-Ip", tt.realIP)
+			}
+
+			if got := proxies.clientAddress(req); got != tt.want {
+				t.Fatalf("clientAddress() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTrustedProxiesInvalidCIDR(t *testing.T) {
+	t.Parallel()
+
+	if _, err := newTrustedProxies([]string{"not-a-cidr"}); err == nil {
+		t.Fatal("newTrustedProxies() error = nil, want error")
+	}
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const (
+	unixScheme = "unix://"
+
+	// unixUpstreamPrefix marks socket upstreams in transport keys so they
+	// never share a pool with a TCP upstream.
+	unixUpstreamPrefix = "unix:"
+)
+
+// parseUnixTarget splits a target of the form unix:///run/app.sock or
+// unix:///run/app.sock:/prefix into the socket path and the request path
+// prefix. ok is false when target is not a unix socket target.
+func parseUnixTarget(target string) (socket, prefix string, ok bool, err error) {
+	rest, found := strings.CutPrefix(target, unixScheme)
+	if !found {
+		return "", "", false, nil
+	}
+
+	socket, prefix, _ = strings.Cut(rest, ":")
+	if !strings.HasPrefix(socket, "/") {
+		return "", "", true, fmt.Errorf("unix socket target %s must use an absolute socket path", target)
+	}
+
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		return "", "", true, fmt.Errorf("path of unix socket target %s must start with /", target)
+	}
+
+	return socket, prefix, true, nil
+}
+
+// unixTargetURL returns the URL requests to a socket are sent to. The host
+// only ends up in the Host header, as the connection always goes to the
+// socket.
+func unixTargetURL(scheme, host, prefix string) *url.URL {
+	if host == "" {
+		host = "localhost"
+	}
+
+	return &url.URL{Scheme: scheme, Host: host, Path: prefix}
+}
+
+// dialSocket returns a DialContext function that connects to the unix socket
+// whatever address it is asked to dial.
+func (res *resolver) dialSocket(dialer *net.Dialer, socket string) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return res.dial(ctx, dialer, "unix", socket)
+	}
+}
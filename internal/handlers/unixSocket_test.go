@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+// listenUnix listens on a socket in a short temporary directory, as socket
+// paths are limited to about 100 bytes.
+func listenUnix(t *testing.T) (net.Listener, string) {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "routy")
+	if err != nil {
+		t.Fatalf("MkdirTemp() error = %v", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	socket := filepath.Join(dir, "app.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+
+	return ln, socket
+}
+
+func TestParseUnixTarget(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		target     string
+		wantSocket string
+		wantPrefix string
+		wantOK     bool
+		wantErr    bool
+	}{
+		{name: "tcp target", target: "http://127.0.0.1:8080"},
+		{name: "socket", target: "unix:///run/app.sock", wantSocket: "/run/app.sock", wantOK: true},
+		{name: "socket with path", target: "unix:///run/app.sock:/api/v1", wantSocket: "/run/app.sock", wantPrefix: "/api/v1", wantOK: true},
+		{name: "relative socket", target: "unix://run/app.sock", wantOK: true, wantErr: true},
+		{name: "path without slash", target: "unix:///run/app.sock:api", wantOK: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			socket, prefix, ok, err := parseUnixTarget(tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseUnixTarget(%q) error = %v, wantErr %v", tt.target, err, tt.wantErr)
+			}
+			if ok != tt.wantOK {
+				t.Fatalf("parseUnixTarget(%q) ok = %v, want %v", tt.target, ok, tt.wantOK)
+			}
+			if socket != tt.wantSocket || prefix != tt.wantPrefix {
+				t.Fatalf("parseUnixTarget(%q) = %q, %q, want %q, %q", tt.target, socket, prefix, tt.wantSocket, tt.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestProxyToUnixSocket(t *testing.T) {
+	t.Parallel()
+
+	ln, socket := listenUnix(t)
+
+	var conns atomic.Int32
+	upstream := &httptest.Server{
+		Listener: ln,
+		Config: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				_, _ = io.WriteString(w, req.Host+" "+req.URL.Path)
+			}),
+			ConnState: func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					conns.Add(1)
+				}
+			},
+		},
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	r := newTestProxyRouty()
+	proxy, err := r.newProxy(
+		models.Domain{Name: "example.com"},
+		models.Subdomain{Name: "app"},
+		models.Path{Location: "/", Target: "unix://" + socket + ":/base"},
+	)
+	if err != nil {
+		t.Fatalf("newProxy() error = %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "https://app.example.com/users", nil))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+		}
+		if got, want := rec.Body.String(), "app.example.com /base/users"; got != want {
+			t.Fatalf("body = %q, want %q", got, want)
+		}
+	}
+
+	if got := conns.Load(); got != 1 {
+		t.Fatalf("upstream connections = %d, want 1", got)
+	}
+}
+
+func TestWebSocketUnixSocket(t *testing.T) {
+	t.Parallel()
+
+	ln, socket := listenUnix(t)
+
+	upgrader := websocket.Upgrader{}
+	upstream := &httptest.Server{
+		Listener: ln,
+		Config: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				conn, err := upgrader.Upgrade(w, req, nil)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				_ = conn.WriteMessage(websocket.TextMessage, []byte(req.URL.Path))
+			}),
+		},
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	dialer, target, err := wsUpstream("unix://" + socket + ":/ws")
+	if err != nil {
+		t.Fatalf("wsUpstream() error = %v", err)
+	}
+
+	conn, _, err := dialer.Dial(target, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if string(msg) != "/ws" {
+		t.Fatalf("upstream path = %q, want %q", msg, "/ws")
+	}
+}
@@ -0,0 +1,403 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+const (
+	defaultWAFBodyLimit    = 64 << 10
+	defaultWAFChallengeTTL = time.Hour
+	wafChallengeCookie     = "_routy_waf"
+)
+
+// wafChallengePage sets the challenge cookie with a script and reloads, which
+// browsers pass and most automated clients do not.
+const wafChallengePage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Checking your browser</title></head>
+<body><noscript>Please enable JavaScript to continue.</noscript>
+<script>document.cookie="%s=%s; path=/; max-age=%d; secure; samesite=lax";location.reload();</script>
+</body></html>
+`
+
+// waf inspects requests with the rules in wafRules.json.
+type waf struct {
+	rules        []wafRule
+	logOnly      bool
+	bodyLimit    int64
+	inspectBody  bool
+	challengeTTL time.Duration
+	key          []byte
+	proxies      trustedProxies
+	eventLog     chan<- logging.EventLogMessage
+	now          func() time.Time
+}
+
+type wafRule struct {
+	id         string
+	action     string
+	conditions []wafCondition
+}
+
+type wafCondition struct {
+	target   string
+	name     string
+	operator string
+	value    string
+	number   float64
+	re       *regexp.Regexp
+	negate   bool
+}
+
+// loadWAF reads the rules when the firewall is enabled and returns nil
+// otherwise.
+func (r *Routy) loadWAF() (*waf, error) {
+	cfg := r.routes.WAF
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+
+	rules, err := models.GetWAFRules()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read waf rules: %v", err)
+	}
+
+	return newWAF(cfg, rules, r.proxies, r.EventLog)
+}
+
+// newWAF returns nil when cfg is nil or not enabled.
+func newWAF(cfg *models.WAFConfig, rules []models.WAFRule, proxies trustedProxies, eventLog chan<- logging.EventLogMessage) (*waf, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+
+	wf := &waf{
+		logOnly:      cfg.LogOnly,
+		bodyLimit:    defaultWAFBodyLimit,
+		challengeTTL: timeoutOrDefault(cfg.ChallengeTTL, defaultWAFChallengeTTL),
+		key:          make([]byte, 32),
+		proxies:      proxies,
+		eventLog:     eventLog,
+		now:          time.Now,
+	}
+	if cfg.BodyLimit > 0 {
+		wf.bodyLimit = int64(cfg.BodyLimit)
+	}
+
+	if _, err := rand.Read(wf.key); err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		compiled, err := compileWAFRule(rule)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range compiled.conditions {
+			if c.target == "body" {
+				wf.inspectBody = true
+			}
+		}
+
+		wf.rules = append(wf.rules, compiled)
+	}
+
+	return wf, nil
+}
+
+func compileWAFRule(rule models.WAFRule) (wafRule, error) {
+	if rule.ID == "" {
+		return wafRule{}, fmt.Errorf("waf rule without an id")
+	}
+
+	switch rule.Action {
+	case "block", "log", "challenge":
+	default:
+		return wafRule{}, fmt.Errorf("waf rule %s has unknown action %s", rule.ID, rule.Action)
+	}
+
+	if len(rule.Conditions) == 0 {
+		return wafRule{}, fmt.Errorf("waf rule %s has no conditions", rule.ID)
+	}
+
+	compiled := wafRule{id: rule.ID, action: rule.Action}
+
+	for _, c := range rule.Conditions {
+		wc := wafCondition{
+			target:   c.Target,
+			name:     http.CanonicalHeaderKey(c.Name),
+			operator: c.Operator,
+			value:    c.Value,
+			negate:   c.Negate,
+		}
+
+		switch c.Target {
+		case "method", "path", "query", "body":
+		case "header":
+			if c.Name == "" {
+				return wafRule{}, fmt.Errorf("waf rule %s matches a header without a name", rule.ID)
+			}
+		default:
+			return wafRule{}, fmt.Errorf("waf rule %s has unknown target %s", rule.ID, c.Target)
+		}
+
+		switch c.Operator {
+		case "equals", "contains", "prefix", "suffix", "exists":
+		case "regex":
+			re, err := regexp.Compile(c.Value)
+			if err != nil {
+				return wafRule{}, fmt.Errorf("waf rule %s has an invalid regex: %v", rule.ID, err)
+			}
+			wc.re = re
+		case "gt", "lt":
+			n, err := strconv.ParseFloat(c.Value, 64)
+			if err != nil {
+				return wafRule{}, fmt.Errorf("waf rule %s compares with %s, which is not a number", rule.ID, c.Value)
+			}
+			wc.number = n
+		default:
+			return wafRule{}, fmt.Errorf("waf rule %s has unknown operator %s", rule.ID, c.Operator)
+		}
+
+		compiled.conditions = append(compiled.conditions, wc)
+	}
+
+	return compiled, nil
+}
+
+// inspect runs the rules in order. When a block or challenge rule matches it
+// answers the client and ok is false. The returned request carries the
+// inspected body along with the rest of it.
+func (wf *waf) inspect(w http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	if wf == nil {
+		return req, true
+	}
+
+	var body []byte
+	if wf.inspectBody {
+		body, req = wf.peekBody(req)
+	}
+
+	for _, rule := range wf.rules {
+		if !rule.match(req, body) {
+			continue
+		}
+
+		if rule.action == "challenge" && wf.passedChallenge(req) {
+			continue
+		}
+
+		wf.log(req, rule)
+
+		if wf.logOnly {
+			continue
+		}
+
+		switch rule.action {
+		case "block":
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return nil, false
+		case "challenge":
+			wf.challenge(w, req)
+			return nil, false
+		}
+	}
+
+	return req, true
+}
+
+// peekBody reads up to the body limit and puts it back for the upstream.
+// Bodies without a Content-Length are read until the limit or their end.
+// gRPC calls and upgraded connections are streams that would hold the
+// request up, so their bodies are not read.
+func (wf *waf) peekBody(req *http.Request) ([]byte, *http.Request) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, req
+	}
+
+	if isGRPC(req) || isGRPCWeb(req) || req.Header.Get("Upgrade") != "" {
+		return nil, req
+	}
+
+	limit := wf.bodyLimit
+	if req.ContentLength >= 0 && req.ContentLength < limit {
+		limit = req.ContentLength
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(req.Body, limit))
+
+	rest := req.Body
+	req = req.WithContext(req.Context())
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), rest), rest}
+
+	if mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mt == "application/x-www-form-urlencoded" {
+		body = []byte(decodeWAFValue(string(body)))
+	}
+
+	return body, req
+}
+
+func (rule wafRule) match(req *http.Request, body []byte) bool {
+	for _, c := range rule.conditions {
+		if c.match(req, body) == c.negate {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c wafCondition) match(req *http.Request, body []byte) bool {
+	values := c.values(req, body)
+
+	if c.operator == "exists" {
+		return len(values) != 0
+	}
+
+	for _, v := range values {
+		if c.compare(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// values returns the parts of req the condition looks at. Parts that are
+// absent return none.
+func (c wafCondition) values(req *http.Request, body []byte) []string {
+	switch c.target {
+	case "method":
+		return []string{req.Method}
+	case "path":
+		return []string{req.URL.Path}
+	case "query":
+		if req.URL.RawQuery == "" {
+			return nil
+		}
+		return []string{decodeWAFValue(req.URL.RawQuery)}
+	case "header":
+		return req.Header.Values(c.name)
+	case "body":
+		if len(body) == 0 {
+			return nil
+		}
+		return []string{string(body)}
+	}
+
+	return nil
+}
+
+func (c wafCondition) compare(v string) bool {
+	switch c.operator {
+	case "regex":
+		return c.re.MatchString(v)
+	case "equals":
+		return v == c.value
+	case "contains":
+		return strings.Contains(v, c.value)
+	case "prefix":
+		return strings.HasPrefix(v, c.value)
+	case "suffix":
+		return strings.HasSuffix(v, c.value)
+	case "gt", "lt":
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return false
+		}
+		if c.operator == "gt" {
+			return n > c.number
+		}
+		return n < c.number
+	}
+
+	return false
+}
+
+// decodeWAFValue undoes up to two rounds of URL encoding so that encoded
+// payloads match the same rules as plain ones.
+func decodeWAFValue(v string) string {
+	for i := 0; i < 2 && strings.ContainsAny(v, "%+"); i++ {
+		decoded, err := url.QueryUnescape(v)
+		if err != nil || decoded == v {
+			break
+		}
+		v = decoded
+	}
+
+	return v
+}
+
+// challengeToken is bound to the client address and expires with the
+// challenge TTL.
+func (wf *waf) challengeToken(addr string, expires int64) string {
+	mac := hmac.New(sha256.New, wf.key)
+	fmt.Fprintf(mac, "%s|%d", addr, expires)
+
+	return strconv.FormatInt(expires, 10) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (wf *waf) passedChallenge(req *http.Request) bool {
+	cookie, err := req.Cookie(wafChallengeCookie)
+	if err != nil {
+		return false
+	}
+
+	expiry, _, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || wf.now().Unix() >= expires {
+		return false
+	}
+
+	want := wf.challengeToken(wf.proxies.clientAddress(req), expires)
+
+	return hmac.Equal([]byte(cookie.Value), []byte(want))
+}
+
+func (wf *waf) challenge(w http.ResponseWriter, req *http.Request) {
+	expires := wf.now().Add(wf.challengeTTL).Unix()
+	token := wf.challengeToken(wf.proxies.clientAddress(req), expires)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, wafChallengePage, wafChallengeCookie, token, int(wf.challengeTTL.Seconds()))
+}
+
+func (wf *waf) log(req *http.Request, rule wafRule) {
+	action := rule.action
+	if wf.logOnly {
+		action = "log"
+	}
+
+	wf.eventLog <- logging.EventLogMessage{
+		Level:  "WARN",
+		Caller: "waf.inspect()",
+		Message: fmt.Sprintf("waf rule %s matched %s %s, action %s",
+			rule.id, req.Method, req.URL.EscapedPath(), action),
+		RequestID: logging.RequestID(req.Context()),
+	}
+}
@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oorrwullie/routy/internal/logging"
+	"github.com/oorrwullie/routy/internal/models"
+)
+
+func newTestWAF(t *testing.T, cfg models.WAFConfig, rules []models.WAFRule) (*waf, chan logging.EventLogMessage) {
+	t.Helper()
+
+	events := make(chan logging.EventLogMessage, 16)
+
+	cfg.Enabled = true
+	wf, err := newWAF(&cfg, rules, nil, events)
+	if err != nil {
+		t.Fatalf("newWAF() error = %v", err)
+	}
+
+	return wf, events
+}
+
+func TestWAFStarterRules(t *testing.T) {
+	t.Parallel()
+
+	wf, _ := newTestWAF(t, models.WAFConfig{}, models.StarterWAFRules)
+
+	tests := []struct {
+		name      string
+		method    string
+		target    string
+		body      string
+		form      bool
+		userAgent string
+		wantCode  int
+	}{
+		{name: "plain page", target: "/products?id=42&sort=name", wantCode: http.StatusOK},
+		{name: "apostrophe in search", target: "/search?q=O%27Reilly+books", wantCode: http.StatusOK},
+		{name: "union select", target: "/products?id=1+UNION+ALL+SELECT+password+FROM+users", wantCode: http.StatusForbidden},
+		{name: "double encoded union select", target: "/products?id=1%2520union%2520select%25201", wantCode: http.StatusForbidden},
+		{name: "tautology", target: "/login?user=admin%27+or+%271%27%3D%271", wantCode: http.StatusForbidden},
+		{name: "sleep", target: "/products?id=1+and+sleep(5)", wantCode: http.StatusForbidden},
+		{name: "script tag", target: "/search?q=%3Cscript%3Ealert(1)%3C/script%3E", wantCode: http.StatusForbidden},
+		{name: "event handler", target: "/search?q=%3Cimg+src=x+onerror=alert(1)%3E", wantCode: http.StatusForbidden},
+		{name: "traversal in query", target: "/download?file=..%2F..%2Fetc%2Fpasswd", wantCode: http.StatusForbidden},
+		{name: "git directory", target: "/.git/config", wantCode: http.StatusForbidden},
+		{name: "env file", target: "/.env", wantCode: http.StatusForbidden},
+		{name: "scanner", target: "/", userAgent: "sqlmap/1.7.2#stable (https://sqlmap.org)", wantCode: http.StatusForbidden},
+		{name: "union select in form", method: http.MethodPost, target: "/login", body: "user=x%27+union+select+1--", form: true, wantCode: http.StatusForbidden},
+		{name: "plain form", method: http.MethodPost, target: "/login", body: "user=alice&password=secret", form: true, wantCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			req := httptest.NewRequest(method, "https://app.example.com"+tt.target, strings.NewReader(tt.body))
+			req.Header.Set("User-Agent", "Mozilla/5.0")
+			if tt.userAgent != "" {
+				req.Header.Set("User-Agent", tt.userAgent)
+			}
+			if tt.form {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			rec := httptest.NewRecorder()
+			if _, ok := wf.inspect(rec, req); ok {
+				rec.WriteHeader(http.StatusOK)
+			}
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestWAFBodyIsKept(t *testing.T) {
+	t.Parallel()
+
+	wf, _ := newTestWAF(t, models.WAFConfig{BodyLimit: 8}, []models.WAFRule{
+		{ID: "secret", Action: "block", Conditions: []models.WAFCondition{{Target: "body", Operator: "contains", Value: "secret"}}},
+	})
+
+	tests := []struct {
+		name    string
+		body    string
+		chunked bool
+		wantOK  bool
+	}{
+		{name: "inside the limit", body: "a secret", wantOK: false},
+		{name: "padded past the limit", body: "a secret 0123456789", wantOK: false},
+		{name: "beyond the limit", body: "0123456789 secret", wantOK: true},
+		{name: "chunked inside the limit", body: "a secret 0123456789", chunked: true, wantOK: false},
+		{name: "chunked beyond the limit", body: "0123456789 secret", chunked: true, wantOK: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodPost, "https://app.example.com/", strings.NewReader(tt.body))
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+
+			got, ok := wf.inspect(httptest.NewRecorder(), req)
+			if ok != tt.wantOK {
+				t.Fatalf("inspect() = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+
+			body, err := io.ReadAll(got.Body)
+			if err != nil {
+				t.Fatalf("ReadAll() error = %v", err)
+			}
+			if string(body) != tt.body {
+				t.Fatalf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestWAFStreamedBody(t *testing.T) {
+	t.Parallel()
+
+	wf, _ := newTestWAF(t, models.WAFConfig{}, []models.WAFRule{
+		{ID: "secret", Action: "block", Conditions: []models.WAFCondition{{Target: "body", Operator: "contains", Value: "secret"}}},
+	})
+
+	tests := []struct {
+		name        string
+		contentType string
+		upgrade     string
+		length      int64
+	}{
+		{name: "upgrade", contentType: "application/octet-stream", upgrade: "websocket", length: -1},
+		{name: "grpc stream", contentType: "application/grpc", length: -1},
+		{name: "grpc with a length", contentType: "application/grpc", length: 64},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			// the client has sent part of the body and is waiting for an answer
+			pr, pw := io.Pipe()
+			defer pw.Close()
+			go func() {
+				_, _ = pw.Write([]byte("first secret message"))
+			}()
+
+			req := httptest.NewRequest(http.MethodPost, "https://app.example.com/stream", pr)
+			req.ContentLength = tt.length
+			req.Header.Set("Content-Type", tt.contentType)
+			if tt.upgrade != "" {
+				req.Header.Set("Upgrade", tt.upgrade)
+			}
+
+			done := make(chan bool, 1)
+			go func() {
+				_, ok := wf.inspect(httptest.NewRecorder(), req)
+				done <- ok
+			}()
+
+			select {
+			case ok := <-done:
+				if !ok {
+					t.Fatalf("inspect() = false, want the stream passed on")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("inspect() waited for the rest of the body")
+			}
+		})
+	}
+}
+
+func TestWAFOperators(t *testing.T) {
+	t.Parallel()
+
+	req := httptest.NewRequest(http.MethodPut, "https://app.example.com/api/items", nil)
+	req.Header.Set("Content-Length", "2048")
+	req.Header.Set("X-Debug", "on")
+
+	tests := []struct {
+		name string
+		cond models.WAFCondition
+		want bool
+	}{
+		{name: "equals", cond: models.WAFCondition{Target: "method", Operator: "equals", Value: "PUT"}, want: true},
+		{name: "prefix", cond: models.WAFCondition{Target: "path", Operator: "prefix", Value: "/api/"}, want: true},
+		{name: "suffix", cond: models.WAFCondition{Target: "path", Operator: "suffix", Value: "/users"}, want: false},
+		{name: "gt", cond: models.WAFCondition{Target: "header", Name: "content-length", Operator: "gt", Value: "1024"}, want: true},
+		{name: "lt", cond: models.WAFCondition{Target: "header", Name: "Content-Length", Operator: "lt", Value: "1024"}, want: false},
+		{name: "exists", cond: models.WAFCondition{Target: "header", Name: "X-Debug", Operator: "exists"}, want: true},
+		{name: "negated exists", cond: models.WAFCondition{Target: "header", Name: "Referer", Operator: "exists", Negate: true}, want: true},
+		{name: "missing query", cond: models.WAFCondition{Target: "query", Operator: "contains", Value: ""}, want: false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rule, err := compileWAFRule(models.WAFRule{ID: "t", Action: "block", Conditions: []models.WAFCondition{tt.cond}})
+			if err != nil {
+				t.Fatalf("compileWAFRule() error = %v", err)
+			}
+
+			if got := rule.match(req, nil); got != tt.want {
+				t.Fatalf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWAFLogOnly(t *testing.T) {
+	t.Parallel()
+
+	wf, events := newTestWAF(t, models.WAFConfig{LogOnly: true}, []models.WAFRule{
+		{ID: "no-trace", Action: "block", Conditions: []models.WAFCondition{{Target: "method", Operator: "equals", Value: "TRACE"}}},
+	})
+
+	if _, ok := wf.inspect(httptest.NewRecorder(), httptest.NewRequest(http.MethodTrace, "https://app.example.com/", nil)); !ok {
+		t.Fatalf("inspect() = false, want true in log only mode")
+	}
+
+	select {
+	case msg := <-events:
+		if !strings.Contains(msg.Message, "no-trace") || !strings.HasSuffix(msg.Message, "action log") {
+			t.Fatalf("event = %q, want the rule logged without acting", msg.Message)
+		}
+	default:
+		t.Fatalf("the match was not logged")
+	}
+}
+
+func TestWAFChallenge(t *testing.T) {
+	t.Parallel()
+
+	wf, events := newTestWAF(t, models.WAFConfig{ChallengeTTL: 60000}, []models.WAFRule{
+		{ID: "bots", Action: "challenge", Conditions: []models.WAFCondition{{Target: "path", Operator: "prefix", Value: "/"}}},
+	})
+
+	now := time.Now()
+	wf.now = func() time.Time { return now }
+
+	newRequest := func(cookie *http.Cookie) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+		req.RemoteAddr = "192.0.2.1:5555"
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+
+	rec := httptest.NewRecorder()
+	if _, ok := wf.inspect(rec, newRequest(nil)); ok {
+		t.Fatalf("inspect() without a cookie = true, want false")
+	}
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "document.cookie") {
+		t.Fatalf("challenge = %d %q, want the challenge page", rec.Code, rec.Body.String())
+	}
+	<-events
+
+	token := wf.challengeToken("192.0.2.1", now.Add(time.Minute).Unix())
+	if !strings.Contains(rec.Body.String(), token) {
+		t.Fatalf("challenge page does not set the token")
+	}
+
+	if _, ok := wf.inspect(httptest.NewRecorder(), newRequest(&http.Cookie{Name: wafChallengeCookie, Value: token})); !ok {
+		t.Fatalf("inspect() with the cookie = false, want true")
+	}
+
+	// the cookie is bound to the client address
+	other := newRequest(&http.Cookie{Name: wafChallengeCookie, Value: token})
+	other.RemoteAddr = "192.0.2.2:5555"
+	if _, ok := wf.inspect(httptest.NewRecorder(), other); ok {
+		t.Fatalf("inspect() from another address = true, want false")
+	}
+	<-events
+
+	// and cannot be claimed with a forwarded address
+	other.Header.Set("X-Forwarded-For", "192.0.2.1")
+	if _, ok := wf.inspect(httptest.NewRecorder(), other); ok {
+		t.Fatalf("inspect() with a forged X-Forwarded-For = true, want false")
+	}
+	<-events
+
+	now = now.Add(time.Minute)
+	if _, ok := wf.inspect(httptest.NewRecorder(), newRequest(&http.Cookie{Name: wafChallengeCookie, Value: token})); ok {
+		t.Fatalf("inspect() with an expired cookie = true, want false")
+	}
+}
+
+func TestCompileWAFRuleErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		rule models.WAFRule
+	}{
+		{name: "no id", rule: models.WAFRule{Action: "block", Conditions: []models.WAFCondition{{Target: "path", Operator: "exists"}}}},
+		{name: "unknown action", rule: models.WAFRule{ID: "r", Action: "drop", Conditions: []models.WAFCondition{{Target: "path", Operator: "exists"}}}},
+		{name: "no conditions", rule: models.WAFRule{ID: "r", Action: "block"}},
+		{name: "unknown target", rule: models.WAFRule{ID: "r", Action: "block", Conditions: []models.WAFCondition{{Target: "cookie", Operator: "exists"}}}},
+		{name: "header without name", rule: models.WAFRule{ID: "r", Action: "block", Conditions: []models.WAFCondition{{Target: "header", Operator: "exists"}}}},
+		{name: "invalid regex", rule: models.WAFRule{ID: "r", Action: "block", Conditions: []models.WAFCondition{{Target: "path", Operator: "regex", Value: "("}}}},
+		{name: "not a number", rule: models.WAFRule{ID: "r", Action: "block", Conditions: []models.WAFCondition{{Target: "header", Name: "Content-Length", Operator: "gt", Value: "big"}}}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := compileWAFRule(tt.rule); err == nil {
+				t.Fatalf("compileWAFRule() error = nil, want an error")
+			}
+		})
+	}
+}
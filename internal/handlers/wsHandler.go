@@ -1,22 +1,97 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/gorilla/websocket"
 	"github.com/oorrwullie/routy/internal/logging"
 	"github.com/oorrwullie/routy/internal/models"
+	"go.opentelemetry.io/otel/codes"
 )
 
-func (r *Routy) handleWebSocket(path models.Path) {
-	http.HandleFunc(path.Location, r.wsHandleFunc(path))
+func (r *Routy) handleWebSocket(domain models.Domain, sd models.Subdomain, path models.Path) {
+	rewriter, err := newPathRewriter(path)
+	if err != nil {
+		r.EventLog <- logging.EventLogMessage{
+			Level:   "ERROR",
+			Caller:  "handleWebSocket()->newPathRewriter()",
+			Message: fmt.Sprintf("failed to configure rewrites for path %s: %v", path.Location, err),
+		}
+
+		return
+	}
+
+	matcher, err := newRouteMatcher(path, r.proxies)
+	if err == nil && matcher.matchType == matchRegex {
+		err = fmt.Errorf("regex locations are not supported for websocket paths")
+	}
+	if err != nil {
+		r.EventLog <- logging.EventLogMessage{
+			Level:   "ERROR",
+			Caller:  "handleWebSocket()->newRouteMatcher()",
+			Message: fmt.Sprintf("failed to configure matcher for path %s: %v", path.Location, err),
+		}
+
+		return
+	}
+
+	dialer, target, err := wsUpstream(path.Target)
+	if err != nil {
+		r.EventLog <- logging.EventLogMessage{
+			Level:   "ERROR",
+			Caller:  "handleWebSocket()->wsUpstream()",
+			Message: fmt.Sprintf("failed to configure target for path %s: %v", path.Location, err),
+		}
+
+		return
+	}
+
+	var host string
+
+	if sd.Name == domain.Name {
+		host = domain.Name
+	} else {
+		host = fmt.Sprintf("%s.%s", sd.Name, domain.Name)
+	}
+
+	auths, err := r.pathAuthorizers(host, oidcConfig(domain, sd), path)
+	if err != nil {
+		r.EventLog <- logging.EventLogMessage{
+			Level:   "ERROR",
+			Caller:  "handleWebSocket()->r.pathAuthorizers()",
+			Message: fmt.Sprintf("failed to configure authentication for path %s: %v", path.Location, err),
+		}
+
+		return
+	}
+
+	geo, err := newGeoRules(path.Geo, r.geoIP)
+	if err != nil {
+		r.EventLog <- logging.EventLogMessage{
+			Level:   "ERROR",
+			Caller:  "handleWebSocket()->newGeoRules()",
+			Message: fmt.Sprintf("failed to configure geo rules for path %s: %v", path.Location, err),
+		}
+
+		return
+	}
+
+	headers := newHeaderRules(host+path.Location, r.proxies, domain.Headers, sd.Headers, path.Headers)
+
+	http.HandleFunc(path.Location, r.wsHandleFunc(path, dialer, target, rewriter, matcher, auths, geo, headers))
 
 	go func(path models.Path) {
-		if err := http.ListenAndServe(fmt.Sprintf(":%d", path.ListenPort), nil); err != nil && err != http.ErrServerClosed {
+		server := r.limits.newServer(fmt.Sprintf(":%d", path.ListenPort), nil)
+
+		if err := r.limits.listenAndServe(server); err != nil && err != http.ErrServerClosed {
 			r.EventLog <- logging.EventLogMessage{
 				Level:   "ERROR",
-				Caller:  "handleWebSocket()->http.ListenAndServe()",
+				Caller:  "handleWebSocket()->server.ListenAndServe()",
 				Message: fmt.Sprintf("failed to start websocket server: %v", err),
 			}
 		}
@@ -24,27 +99,62 @@ func (r *Routy) handleWebSocket(path models.Path) {
 }
 
 // wsHandleFunc handles WebSocket connections
-func (r *Routy) wsHandleFunc(path models.Path) func(http.ResponseWriter, *http.Request) {
+func (r *Routy) wsHandleFunc(path models.Path, dialer *websocket.Dialer, target string, rewriter *pathRewriter, matcher *routeMatcher, auths []authorizer, geo *geoRules, headers *headerRules) func(http.ResponseWriter, *http.Request) {
+	limits := r.limits.requestLimits(path.Limits)
+
 	return func(w http.ResponseWriter, req *http.Request) {
-		if r.denyList.IsDenied(logging.GetRequestRemoteAddress(req)) {
+		if !matcher.match(req) {
+			http.NotFound(w, req)
 			return
 		}
 
+		req = r.requestIDs.assign(w, req)
+		requestID := logging.RequestID(req.Context())
+
+		req, span := r.tracing.startRequest(req, path.Location)
+		defer span.End()
+
+		if r.isDenied(req) {
+			return
+		}
+
+		req = r.geoIP.annotate(req)
 		r.accessLog <- req
 
+		if !geo.allow(w, req) {
+			return
+		}
+
+		if !limits.apply(w, req) {
+			return
+		}
+
+		req, ok := r.waf.inspect(w, req)
+		if !ok {
+			return
+		}
+
+		req, ok = authorizeAll(auths, w, req)
+		if !ok {
+			return
+		}
+
 		var upgrader = websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true
 			},
 		}
 
-		conn, err := upgrader.Upgrade(w, req, nil)
+		// the response headers written so far, including the request ID, are
+		// not sent by Upgrade unless passed explicitly
+		conn, err := upgrader.Upgrade(w, req, w.Header())
 		if err != nil {
 			msg := fmt.Sprintf("Error upgrading connection to WebSocket: %v", err)
 			r.EventLog <- logging.EventLogMessage{
-				Level:   "ERROR",
-				Caller:  "handleWebSocket()->upgrader.Upgrade()",
-				Message: msg,
+				Level:     "ERROR",
+				Caller:    "handleWebSocket()->upgrader.Upgrade()",
+				Message:   msg,
+				RequestID: requestID,
 			}
 
 			return
@@ -53,13 +163,25 @@ func (r *Routy) wsHandleFunc(path models.Path) func(http.ResponseWriter, *http.R
 			_ = conn.Close()
 		}()
 
-		targetWs, _, err := websocket.DefaultDialer.Dial(path.Target, req.Header)
+		if headers != nil {
+			req = req.Clone(req.Context())
+			headers.applyRequest(req)
+		}
+
+		dialURL, header := wsDialTarget(target, rewriter, req)
+		r.tracing.inject(req.Context(), header)
+
+		targetWs, _, err := dialer.DialContext(req.Context(), dialURL, header)
 		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+
 			msg := fmt.Sprintf("Error connecting to target server: %v", err)
 			r.EventLog <- logging.EventLogMessage{
-				Level:   "ERROR",
-				Caller:  "handleWebSocket()->websocket.DefaultDialer.Dial()",
-				Message: msg,
+				Level:     "ERROR",
+				Caller:    "handleWebSocket()->dialer.DialContext()",
+				Message:   msg,
+				RequestID: requestID,
 			}
 
 			return
@@ -82,9 +204,10 @@ func (r *Routy) wsHandleFunc(path models.Path) func(http.ResponseWriter, *http.R
 				if err != nil {
 					msg := fmt.Sprintf("Error receiving message from client: %v", err)
 					r.EventLog <- logging.EventLogMessage{
-						Level:   "ERROR",
-						Caller:  "handleWebSocket()->conn.ReadMessage()",
-						Message: msg,
+						Level:     "ERROR",
+						Caller:    "handleWebSocket()->conn.ReadMessage()",
+						Message:   msg,
+						RequestID: requestID,
 					}
 
 					return
@@ -94,9 +217,10 @@ func (r *Routy) wsHandleFunc(path models.Path) func(http.ResponseWriter, *http.R
 				if err != nil {
 					msg := fmt.Sprintf("Error sending message to target server: %v", err)
 					r.EventLog <- logging.EventLogMessage{
-						Level:   "ERROR",
-						Caller:  "handleWebSocket()->targetWs.WriteMessage()",
-						Message: msg,
+						Level:     "ERROR",
+						Caller:    "handleWebSocket()->targetWs.WriteMessage()",
+						Message:   msg,
+						RequestID: requestID,
 					}
 
 					return
@@ -109,9 +233,10 @@ func (r *Routy) wsHandleFunc(path models.Path) func(http.ResponseWriter, *http.R
 			if err != nil {
 				msg := fmt.Sprintf("Error receiving message from target server: %v", err)
 				r.EventLog <- logging.EventLogMessage{
-					Level:   "ERROR",
-					Caller:  "handleWebSocket()->targetWs.ReadMessage()",
-					Message: msg,
+					Level:     "ERROR",
+					Caller:    "handleWebSocket()->targetWs.ReadMessage()",
+					Message:   msg,
+					RequestID: requestID,
 				}
 
 				return
@@ -121,9 +246,10 @@ func (r *Routy) wsHandleFunc(path models.Path) func(http.ResponseWriter, *http.R
 			if err != nil {
 				msg := fmt.Sprintf("Error sending message to client: %v", err)
 				r.EventLog <- logging.EventLogMessage{
-					Level:   "ERROR",
-					Caller:  "handleWebSocket()->conn.WriteMessage()",
-					Message: msg,
+					Level:     "ERROR",
+					Caller:    "handleWebSocket()->conn.WriteMessage()",
+					Message:   msg,
+					RequestID: requestID,
 				}
 
 				return
@@ -132,3 +258,52 @@ func (r *Routy) wsHandleFunc(path models.Path) func(http.ResponseWriter, *http.R
 
 	}
 }
+
+// wsUpstream returns the dialer and URL used to reach a websocket target. A
+// unix socket target is dialed through the socket.
+func wsUpstream(target string) (*websocket.Dialer, string, error) {
+	socket, prefix, isUnix, err := parseUnixTarget(target)
+	if err != nil || !isUnix {
+		return websocket.DefaultDialer, target, err
+	}
+
+	netDialer := &net.Dialer{Timeout: defaultDialTimeout}
+
+	dialer := *websocket.DefaultDialer
+	dialer.NetDialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return netDialer.DialContext(ctx, "unix", socket)
+	}
+
+	return &dialer, unixTargetURL("ws", "", prefix).String(), nil
+}
+
+// wsDialTarget returns the upstream URL and handshake headers for req. When the
+// path has rewrite rules the rewritten request path is appended to the target.
+func wsDialTarget(target string, rewriter *pathRewriter, req *http.Request) (string, http.Header) {
+	header := req.Header.Clone()
+
+	// the dialer sets its own handshake headers and rejects duplicates
+	for _, h := range []string{"Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions"} {
+		header.Del(h)
+	}
+
+	if rewriter == nil {
+		return target, header
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return target, header
+	}
+
+	in := *req.URL
+	if prefix := rewriter.rewriteURL(&in); prefix != "" {
+		header.Set("X-Forwarded-Prefix", prefix)
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + in.Path
+	u.RawPath = ""
+	u.RawQuery = in.RawQuery
+
+	return u.String(), header
+}
@@ -19,14 +19,29 @@ func StartAccessLogger(requestChan <-chan *http.Request) error {
 		t := time.Now()
 
 		entry := fmt.Sprintf(
-			`{"Timestamp": "%s", "IPAddress": "%s", "URL": "%s", "User-Agent": "%s"}
+			`{"Timestamp": "%s", "IPAddress": "%s", "URL": "%s", "User-Agent": "%s", "RequestId": "%s"}
 `,
 			t.Format("15:04:05 MST 10-02-2006"),
 			GetRequestRemoteAddress(request),
 			request.URL.String(),
 			request.Header.Get("User-Agent"),
+			RequestID(request.Context()),
 		)
 
+		if geo, ok := GeoFrom(request.Context()); ok {
+			entry = fmt.Sprintf(
+				`{"Timestamp": "%s", "IPAddress": "%s", "URL": "%s", "User-Agent": "%s", "RequestId": "%s", "Country": "%s", "ASN": %d}
+`,
+				t.Format("15:04:05 MST 10-02-2006"),
+				GetRequestRemoteAddress(request),
+				request.URL.String(),
+				request.Header.Get("User-Agent"),
+				RequestID(request.Context()),
+				geo.Country,
+				geo.ASN,
+			)
+		}
+
 		if err := m.WriteToAccessLog(entry); err != nil {
 			continue
 		}
@@ -12,6 +12,7 @@ type EventLogMessage struct {
 	Level     string `json:"level"`
 	Caller    string `json:"caller"`
 	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
 }
 
 func StartEventLogger(logChan <-chan EventLogMessage) error {
@@ -33,6 +34,18 @@ func StartEventLogger(logChan <-chan EventLogMessage) error {
 			logMsg.Message,
 		)
 
+		if logMsg.RequestID != "" {
+			entry = fmt.Sprintf(
+				`{"Timestamp": "%s", "Level": "%s", "Caller": "%s", "Message": "%s", "RequestId": "%s"}
+`,
+				logMsg.Timestamp,
+				logMsg.Level,
+				logMsg.Caller,
+				logMsg.Message,
+				logMsg.RequestID,
+			)
+		}
+
 		if err := m.WriteToEventLog(entry); err != nil {
 			continue
 		}
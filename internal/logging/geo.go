@@ -0,0 +1,22 @@
+package logging
+
+import "context"
+
+type geoKey struct{}
+
+// Geo is where a client's address was found in the GeoIP databases.
+type Geo struct {
+	Country string
+	ASN     uint
+}
+
+// WithGeo returns a copy of ctx carrying the client's location.
+func WithGeo(ctx context.Context, geo Geo) context.Context {
+	return context.WithValue(ctx, geoKey{}, geo)
+}
+
+// GeoFrom returns the location stored in ctx and whether there is one.
+func GeoFrom(ctx context.Context) (Geo, bool) {
+	geo, ok := ctx.Value(geoKey{}).(Geo)
+	return geo, ok
+}
@@ -0,0 +1,19 @@
+package logging
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	t.Parallel()
+
+	if got := RequestID(context.Background()); got != "" {
+		t.Fatalf("RequestID() = %q, want empty", got)
+	}
+
+	ctx := WithRequestID(context.Background(), "abc123")
+	if got := RequestID(ctx); got != "abc123" {
+		t.Fatalf("RequestID() = %q, want %q", got, "abc123")
+	}
+}
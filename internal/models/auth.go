@@ -0,0 +1,66 @@
+package models
+
+type (
+	// ForwardAuth asks the service at Address whether a request may pass.
+	// The service receives the original method, URI and headers; Headers
+	// limits which request headers are sent. A 2xx answer lets the request
+	// through with the ResponseHeaders copied from the answer, anything else
+	// is returned to the client. Timeout and CacheTTL are in milliseconds;
+	// CacheTTL caches allowed requests for that long.
+	ForwardAuth struct {
+		Address         string   `yaml:"address"`
+		Headers         []string `yaml:"headers,omitempty"`
+		ResponseHeaders []string `yaml:"responseHeaders,omitempty"`
+		Timeout         int      `yaml:"timeout,omitempty"`
+		CacheTTL        int      `yaml:"cacheTTL,omitempty"`
+	}
+
+	// BasicAuth asks for a user name and password checked against File, an
+	// htpasswd file with bcrypt or argon2 hashes. File is relative to the
+	// data directory unless it is absolute. UserHeader, when set, carries
+	// the user name to the upstream.
+	BasicAuth struct {
+		File       string `yaml:"file"`
+		Realm      string `yaml:"realm,omitempty"`
+		UserHeader string `yaml:"userHeader,omitempty"`
+	}
+
+	// JWTAuth accepts requests carrying a valid bearer token. Tokens are
+	// verified with the keys published at JWKSURL or the PEM encoded public
+	// keys in Keys, which are relative to the data directory unless absolute.
+	// Claims lists the values each claim may have, and ClaimHeaders maps
+	// claims to headers sent to the upstream. Nested claims are named with
+	// dots, as in realm_access.roles. Leeway is in milliseconds.
+	JWTAuth struct {
+		JWKSURL      string              `yaml:"jwksURL,omitempty"`
+		Keys         []string            `yaml:"keys,omitempty"`
+		Algorithms   []string            `yaml:"algorithms,omitempty"`
+		Issuer       string              `yaml:"issuer,omitempty"`
+		Audience     []string            `yaml:"audience,omitempty"`
+		Leeway       int                 `yaml:"leeway,omitempty"`
+		Claims       map[string][]string `yaml:"claims,omitempty"`
+		ClaimHeaders map[string]string   `yaml:"claimHeaders,omitempty"`
+	}
+
+	// OIDC signs browser users in with an OpenID Connect provider and keeps
+	// them signed in with an encrypted session cookie. The subdomain setting
+	// replaces the domain setting. CookieSecret encrypts the session and must
+	// be kept private. AllowedGroups and AllowedEmailDomains restrict who may
+	// sign in; GroupsClaim names the claim holding the user's groups.
+	// SessionTTL is in milliseconds.
+	OIDC struct {
+		Issuer              string   `yaml:"issuer"`
+		ClientID            string   `yaml:"clientId"`
+		ClientSecret        string   `yaml:"clientSecret"`
+		Scopes              []string `yaml:"scopes,omitempty"`
+		CallbackPath        string   `yaml:"callbackPath,omitempty"`
+		LogoutPath          string   `yaml:"logoutPath,omitempty"`
+		CookieName          string   `yaml:"cookieName,omitempty"`
+		CookieSecret        string   `yaml:"cookieSecret"`
+		SessionTTL          int      `yaml:"sessionTTL,omitempty"`
+		GroupsClaim         string   `yaml:"groupsClaim,omitempty"`
+		AllowedGroups       []string `yaml:"allowedGroups,omitempty"`
+		AllowedEmailDomains []string `yaml:"allowedEmailDomains,omitempty"`
+		PassAccessToken     bool     `yaml:"passAccessToken,omitempty"`
+	}
+)
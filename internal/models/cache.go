@@ -0,0 +1,35 @@
+package models
+
+const cacheDirname string = "cache"
+
+type (
+	// CacheStore sizes the shared response cache. Sizes are in bytes. When
+	// Disk is set, entries evicted from memory are kept under the data
+	// directory until MaxDiskBytes is reached.
+	CacheStore struct {
+		MaxMemoryBytes int64 `yaml:"maxMemoryBytes,omitempty"`
+		MaxObjectBytes int64 `yaml:"maxObjectBytes,omitempty"`
+		Disk           bool  `yaml:"disk,omitempty"`
+		MaxDiskBytes   int64 `yaml:"maxDiskBytes,omitempty"`
+	}
+
+	// PathCache enables response caching for a path. Durations are in
+	// milliseconds. DefaultTTL applies to responses without freshness
+	// information; the stale settings apply when the upstream does not send
+	// its own stale-while-revalidate or stale-if-error directives.
+	PathCache struct {
+		DefaultTTL           int `yaml:"defaultTTL,omitempty"`
+		StaleWhileRevalidate int `yaml:"staleWhileRevalidate,omitempty"`
+		StaleIfError         int `yaml:"staleIfError,omitempty"`
+	}
+)
+
+// GetCacheDir returns the directory used by the disk cache tier.
+func GetCacheDir() (string, error) {
+	m, err := NewModel()
+	if err != nil {
+		return "", err
+	}
+
+	return m.GetFilepath(cacheDirname)
+}
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const certDirname string = "certs"
+
+// CertMonitorConfig configures the certificate expiry monitor. CheckInterval
+// is in milliseconds.
+type CertMonitorConfig struct {
+	CheckInterval int  `yaml:"checkInterval,omitempty"`
+	WarnDays      int  `yaml:"warnDays,omitempty"`
+	ErrorDays     int  `yaml:"errorDays,omitempty"`
+	Disabled      bool `yaml:"disabled,omitempty"`
+}
+
+// CertificateInfo describes a certificate stored in the certs cache.
+type CertificateInfo struct {
+	Name      string    `json:"name"`
+	DNSNames  []string  `json:"dnsNames"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+// DaysRemaining returns the number of whole days until the certificate expires.
+// It is negative for expired certificates.
+func (c CertificateInfo) DaysRemaining(now time.Time) int {
+	return int(c.NotAfter.Sub(now).Hours() / 24)
+}
+
+// GetCertificates scans the certs cache and returns the leaf certificate of
+// every entry, sorted by expiry. ACME account keys and challenge tokens are skipped.
+func GetCertificates() ([]CertificateInfo, error) {
+	m, err := NewModel()
+	if err != nil {
+		return nil, err
+	}
+
+	certDir, err := m.GetFilepath(certDirname)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(certDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read cert directory: %v", err)
+	}
+
+	certs := make([]CertificateInfo, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, "acme_account") ||
+			strings.HasSuffix(name, "+token") || strings.HasSuffix(name, "+http-01") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(certDir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read certificate %s: %v", name, err)
+		}
+
+		leaf := parseLeafCertificate(data)
+		if leaf == nil {
+			continue
+		}
+
+		certs = append(certs, CertificateInfo{
+			Name:      name,
+			DNSNames:  leaf.DNSNames,
+			Issuer:    leaf.Issuer.CommonName,
+			NotBefore: leaf.NotBefore,
+			NotAfter:  leaf.NotAfter,
+		})
+	}
+
+	sort.Slice(certs, func(i, j int) bool {
+		return certs[i].NotAfter.Before(certs[j].NotAfter)
+	})
+
+	return certs, nil
+}
+
+// parseLeafCertificate returns the first certificate in a PEM bundle, which is
+// the leaf in the layout autocert writes.
+func parseLeafCertificate(data []byte) *x509.Certificate {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil
+		}
+
+		return cert
+	}
+}
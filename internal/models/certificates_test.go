@@ -0,0 +1,89 @@
+package models
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCert(t *testing.T, dir, name string, notAfter time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		Issuer:       pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+}
+
+func TestGetCertificates(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("ROUTY_DATA_DIR", tmp)
+
+	certDir := filepath.Join(tmp, certDirname)
+	if err := os.MkdirAll(certDir, 0750); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	writeTestCert(t, certDir, "late.example.com", now.Add(60*24*time.Hour))
+	writeTestCert(t, certDir, "soon.example.com", now.Add(5*24*time.Hour))
+
+	if err := os.WriteFile(filepath.Join(certDir, "acme_account+key"), []byte("key"), 0600); err != nil {
+		t.Fatalf("write account key: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(certDir, "garbage"), []byte("not a cert"), 0600); err != nil {
+		t.Fatalf("write garbage: %v", err)
+	}
+
+	certs, err := GetCertificates()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(certs) != 2 {
+		t.Fatalf("certificate count = %d, want 2", len(certs))
+	}
+	if certs[0].Name != "soon.example.com" || certs[1].Name != "late.example.com" {
+		t.Fatalf("certificates not sorted by expiry: %q, %q", certs[0].Name, certs[1].Name)
+	}
+	if got := certs[0].DaysRemaining(now); got != 5 {
+		t.Fatalf("DaysRemaining() = %d, want 5", got)
+	}
+	if len(certs[0].DNSNames) != 1 || certs[0].DNSNames[0] != "soon.example.com" {
+		t.Fatalf("unexpected dns names: %v", certs[0].DNSNames)
+	}
+}
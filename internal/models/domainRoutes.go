@@ -4,42 +4,199 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
-const configFilename string = "cfg.yaml"
+const (
+	configFilename      string = "cfg.yaml"
+	defaultStatusListen string = "127.0.0.1:9180"
+)
 
 type (
 	Routes struct {
-		Domains []Domain `yaml:"domains"`
+		TLS            *TLSConfig         `yaml:"tls,omitempty"`
+		CertMonitor    *CertMonitorConfig `yaml:"certMonitor,omitempty"`
+		Status         *StatusConfig      `yaml:"status,omitempty"`
+		Fallback       *Path              `yaml:"fallback,omitempty"`
+		Cache          *CacheStore        `yaml:"cache,omitempty"`
+		RequestID      *RequestIDConfig   `yaml:"requestId,omitempty"`
+		TrustedProxies []string           `yaml:"trustedProxies,omitempty"`
+		Tracing        *TracingConfig     `yaml:"tracing,omitempty"`
+		Pool           *ConnectionPool    `yaml:"pool,omitempty"`
+		HTTP3          *HTTP3Config       `yaml:"http3,omitempty"`
+		WAF            *WAFConfig         `yaml:"waf,omitempty"`
+		Limits         *ServerLimits      `yaml:"limits,omitempty"`
+		GeoIP          *GeoIPConfig       `yaml:"geoIP,omitempty"`
+		Streams        []Stream           `yaml:"streams,omitempty"`
+		Domains        []Domain           `yaml:"domains"`
+	}
+
+	// RequestIDConfig controls request ID propagation. Header defaults to
+	// X-Request-Id. An incoming ID is only kept when the connection comes
+	// from one of the trusted proxies; otherwise a new one is generated.
+	RequestIDConfig struct {
+		Header string `yaml:"header,omitempty"`
+	}
+
+	// HTTP3Config enables the HTTP/3 listener. Listen is the UDP address and
+	// defaults to :443. AdvertisePort overrides the port announced in Alt-Svc
+	// headers when UDP traffic is forwarded from a different port.
+	HTTP3Config struct {
+		Enabled       bool   `yaml:"enabled,omitempty"`
+		Listen        string `yaml:"listen,omitempty"`
+		AdvertisePort int    `yaml:"advertisePort,omitempty"`
+	}
+
+	// StatusConfig configures the local status endpoint. Listen defaults to
+	// 127.0.0.1:9180; set Disabled to turn the endpoint off.
+	StatusConfig struct {
+		Listen   string `yaml:"listen,omitempty"`
+		Disabled bool   `yaml:"disabled,omitempty"`
 	}
 
 	Domain struct {
-		Name       string      `yaml:"name"`
-		Subdomains []Subdomain `yaml:"subdomains"`
-		Paths      []Path      `yaml:"paths"`
+		Name        string       `yaml:"name"`
+		TLS         *TLSConfig   `yaml:"tls,omitempty"`
+		Compression *Compression `yaml:"compression,omitempty"`
+		Headers     *Headers     `yaml:"headers,omitempty"`
+		OIDC        *OIDC        `yaml:"oidc,omitempty"`
+		Subdomains  []Subdomain  `yaml:"subdomains"`
+		Paths       []Path       `yaml:"paths"`
 	}
 
 	Subdomain struct {
-		Name  string      `yaml:"name"`
-		CORS  *CORSConfig `yaml:"cors,omitempty"`
-		Paths []Path      `yaml:"paths"`
+		Name        string       `yaml:"name"`
+		CORS        *CORSConfig  `yaml:"cors,omitempty"`
+		Compression *Compression `yaml:"compression,omitempty"`
+		Headers     *Headers     `yaml:"headers,omitempty"`
+		OIDC        *OIDC        `yaml:"oidc,omitempty"`
+		Paths       []Path       `yaml:"paths"`
+	}
+
+	// Headers changes the headers sent to the upstream and to the client.
+	// Domain, subdomain and path rules are applied in that order. Values may
+	// use the placeholders {client_ip}, {request_id}, {host}, {method},
+	// {path}, {scheme}, {route}, {tls_version}, {tls_cipher} and {tls_sni}.
+	Headers struct {
+		Request         *HeaderRules `yaml:"request,omitempty"`
+		Response        *HeaderRules `yaml:"response,omitempty"`
+		SecurityHeaders bool         `yaml:"securityHeaders,omitempty"`
+	}
+
+	HeaderRules struct {
+		Set    map[string]string `yaml:"set,omitempty"`
+		Add    map[string]string `yaml:"add,omitempty"`
+		Remove []string          `yaml:"remove,omitempty"`
+	}
+
+	// Compression enables response compression. The most specific of the
+	// domain, subdomain and path settings is used. MinSize is in bytes.
+	Compression struct {
+		Disabled  bool     `yaml:"disabled,omitempty"`
+		Encodings []string `yaml:"encodings,omitempty"`
+		Types     []string `yaml:"types,omitempty"`
+		MinSize   int      `yaml:"minSize,omitempty"`
 	}
 
 	CORSConfig struct {
-		AllowOrigins    []string `yaml:"allowOrigins,omitempty"`
-		AllowMethods    []string `yaml:"allowMethods,omitempty"`
-		AllowHeaders    []string `yaml:"allowHeaders,omitempty"`
-		ExposeHeaders   []string `yaml:"exposeHeaders,omitempty"`
+		AllowOrigins     []string `yaml:"allowOrigins,omitempty"`
+		AllowMethods     []string `yaml:"allowMethods,omitempty"`
+		AllowHeaders     []string `yaml:"allowHeaders,omitempty"`
+		ExposeHeaders    []string `yaml:"exposeHeaders,omitempty"`
 		AllowCredentials bool     `yaml:"allowCredentials,omitempty"`
-		MaxAge          int      `yaml:"maxAge,omitempty"`
+		MaxAge           int      `yaml:"maxAge,omitempty"`
 	}
 
 	Path struct {
-		Location   string `yaml:"location"`
-		Upgrade    bool   `yaml:"upgrade"`
-		Target     string `yaml:"target"`
-		ListenPort int    `yaml:"listenPort,omitempty"`
+		Location       string          `yaml:"location"`
+		Upgrade        bool            `yaml:"upgrade"`
+		Target         string          `yaml:"target"`
+		Protocol       string          `yaml:"protocol,omitempty"`
+		GRPCWeb        bool            `yaml:"grpcWeb,omitempty"`
+		ListenPort     int             `yaml:"listenPort,omitempty"`
+		StripPrefix    string          `yaml:"stripPrefix,omitempty"`
+		AddPrefix      string          `yaml:"addPrefix,omitempty"`
+		Rewrite        []RewriteRule   `yaml:"rewrite,omitempty"`
+		Match          *RouteMatch     `yaml:"match,omitempty"`
+		Priority       int             `yaml:"priority,omitempty"`
+		Redirect       *Redirect       `yaml:"redirect,omitempty"`
+		Respond        *Respond        `yaml:"respond,omitempty"`
+		Static         *Static         `yaml:"static,omitempty"`
+		Compression    *Compression    `yaml:"compression,omitempty"`
+		Cache          *PathCache      `yaml:"cache,omitempty"`
+		Headers        *Headers        `yaml:"headers,omitempty"`
+		Timeouts       *Timeouts       `yaml:"timeouts,omitempty"`
+		Retry          *Retry          `yaml:"retry,omitempty"`
+		CircuitBreaker *CircuitBreaker `yaml:"circuitBreaker,omitempty"`
+		Pool           *ConnectionPool `yaml:"pool,omitempty"`
+		ForwardAuth    *ForwardAuth    `yaml:"forwardAuth,omitempty"`
+		BasicAuth      *BasicAuth      `yaml:"basicAuth,omitempty"`
+		JWT            *JWTAuth        `yaml:"jwt,omitempty"`
+		Limits         *RequestLimits  `yaml:"limits,omitempty"`
+		Geo            *GeoRules       `yaml:"geo,omitempty"`
+		Mirror         *Mirror         `yaml:"mirror,omitempty"`
+		Split          *TrafficSplit   `yaml:"split,omitempty"`
+	}
+
+	// Static serves files from Root, which is relative to the data directory
+	// unless it is absolute.
+	Static struct {
+		Root          string             `yaml:"root"`
+		Index         string             `yaml:"index,omitempty"`
+		Browse        bool               `yaml:"browse,omitempty"`
+		SPA           bool               `yaml:"spa,omitempty"`
+		Precompressed bool               `yaml:"precompressed,omitempty"`
+		CacheControl  []CacheControlRule `yaml:"cacheControl,omitempty"`
+	}
+
+	// CacheControlRule sets the Cache-Control header for files matching the
+	// Match glob, which is compared against the file's path and its base name.
+	CacheControlRule struct {
+		Match string `yaml:"match"`
+		Value string `yaml:"value"`
+	}
+
+	// Redirect sends the client to To, a URL template that may use {scheme},
+	// {host}, {apex}, {www}, {path}, {query} and {uri}. Status defaults to 302.
+	Redirect struct {
+		To     string `yaml:"to"`
+		Status int    `yaml:"status,omitempty"`
+	}
+
+	// Respond answers the request directly. Status defaults to 200 and
+	// ContentType to text/plain.
+	Respond struct {
+		Status      int               `yaml:"status,omitempty"`
+		Body        string            `yaml:"body,omitempty"`
+		ContentType string            `yaml:"contentType,omitempty"`
+		Headers     map[string]string `yaml:"headers,omitempty"`
+	}
+
+	// RouteMatch narrows which requests a path handles. Type controls how
+	// Location is compared: prefix (the default), exact or regex. Header and
+	// query values must match exactly; an empty value only requires presence.
+	RouteMatch struct {
+		Type        string            `yaml:"type,omitempty"`
+		Methods     []string          `yaml:"methods,omitempty"`
+		Headers     map[string]string `yaml:"headers,omitempty"`
+		Query       map[string]string `yaml:"query,omitempty"`
+		ClientCIDRs []string          `yaml:"clientCIDRs,omitempty"`
+	}
+
+	// RewriteRule replaces a request path matching the Match regex with
+	// Replace, which may reference capture groups as $1 or ${name}.
+	RewriteRule struct {
+		Match   string `yaml:"match"`
+		Replace string `yaml:"replace"`
 	}
 )
 
+// StatusAddress returns the address the local status endpoint listens on.
+func (r *Routes) StatusAddress() string {
+	if r.Status != nil && r.Status.Listen != "" {
+		return r.Status.Listen
+	}
+
+	return defaultStatusListen
+}
+
 func GetDomainRoutes() (*Routes, error) {
 	data := &Routes{}
 
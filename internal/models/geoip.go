@@ -0,0 +1,23 @@
+package models
+
+type (
+	// GeoIPConfig loads MaxMind format databases from the data directory, or
+	// absolute paths, to find the country and autonomous system of clients.
+	// Country and ASN databases may be listed together; every database is
+	// consulted. CountryHeader and ASNHeader pass the results to upstreams.
+	GeoIPConfig struct {
+		Databases     []string `yaml:"databases"`
+		CountryHeader string   `yaml:"countryHeader,omitempty"`
+		ASNHeader     string   `yaml:"asnHeader,omitempty"`
+	}
+
+	// GeoRules allow or deny clients by ISO country code and autonomous
+	// system number. A client matching a deny list is refused; when allow
+	// lists are set, a client must match one of them.
+	GeoRules struct {
+		AllowCountries []string `yaml:"allowCountries,omitempty"`
+		DenyCountries  []string `yaml:"denyCountries,omitempty"`
+		AllowASNs      []uint   `yaml:"allowASNs,omitempty"`
+		DenyASNs       []uint   `yaml:"denyASNs,omitempty"`
+	}
+)
@@ -0,0 +1,28 @@
+package models
+
+type (
+	// ServerLimits protect the listeners from slow and oversized requests.
+	// Durations are in milliseconds and zero keeps the default: headers must
+	// arrive within 10 seconds, idle connections are closed after two minutes
+	// and headers may take up to 1MiB. MaxBodyBytes and MaxConnsPerIP are not
+	// limited unless set.
+	ServerLimits struct {
+		ReadHeaderTimeout int   `yaml:"readHeaderTimeout,omitempty"`
+		ReadTimeout       int   `yaml:"readTimeout,omitempty"`
+		WriteTimeout      int   `yaml:"writeTimeout,omitempty"`
+		IdleTimeout       int   `yaml:"idleTimeout,omitempty"`
+		MaxHeaderBytes    int   `yaml:"maxHeaderBytes,omitempty"`
+		MaxBodyBytes      int64 `yaml:"maxBodyBytes,omitempty"`
+		MaxConnsPerIP     int   `yaml:"maxConnsPerIP,omitempty"`
+	}
+
+	// RequestLimits replace the server limits for the requests of one path.
+	// Headers are already read when the path is known, so MaxHeaderBytes can
+	// only be lower than the server's.
+	RequestLimits struct {
+		ReadTimeout    int   `yaml:"readTimeout,omitempty"`
+		WriteTimeout   int   `yaml:"writeTimeout,omitempty"`
+		MaxHeaderBytes int   `yaml:"maxHeaderBytes,omitempty"`
+		MaxBodyBytes   int64 `yaml:"maxBodyBytes,omitempty"`
+	}
+)
@@ -82,6 +82,19 @@ func (m *Model) appendToFile(filename string, data string) error {
 	return nil
 }
 
+func (m *Model) writeFile(filename string, data []byte) error {
+	fp, err := m.GetFilepath(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(fp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+
+	return nil
+}
+
 func (m *Model) GetFilepath(filename string) (string, error) {
 	fp := filepath.Join(m.DataDir, filename)
 
@@ -0,0 +1,27 @@
+package models
+
+type (
+	// Stream forwards raw TCP or UDP traffic arriving on Listen. Protocol is
+	// tcp (the default) or udp. Connections are spread over Targets in turn,
+	// moving on to the next target when one cannot be reached. TCP streams
+	// can route TLS connections by server name with SNI; the TLS session is
+	// passed through to the backend untouched. IdleTimeout ends UDP sessions
+	// after that many milliseconds without traffic, and MaxSessions caps the
+	// UDP sessions open at once.
+	Stream struct {
+		Name        string     `yaml:"name,omitempty"`
+		Protocol    string     `yaml:"protocol,omitempty"`
+		Listen      string     `yaml:"listen"`
+		Targets     []string   `yaml:"targets,omitempty"`
+		SNI         []SNIRoute `yaml:"sni,omitempty"`
+		IdleTimeout int        `yaml:"idleTimeout,omitempty"`
+		MaxSessions int        `yaml:"maxSessions,omitempty"`
+	}
+
+	// SNIRoute sends TLS connections for Hostnames to Targets. A hostname
+	// of the form *.example.com matches any single-label subdomain.
+	SNIRoute struct {
+		Hostnames []string `yaml:"hostnames"`
+		Targets   []string `yaml:"targets"`
+	}
+)
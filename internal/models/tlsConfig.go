@@ -0,0 +1,55 @@
+package models
+
+type (
+	// TLSConfig holds the listener TLS settings. It can be set globally and
+	// overridden per domain; unset fields fall back to the global value.
+	TLSConfig struct {
+		MinVersion       string      `yaml:"minVersion,omitempty"`
+		MaxVersion       string      `yaml:"maxVersion,omitempty"`
+		CipherSuites     []string    `yaml:"cipherSuites,omitempty"`
+		CurvePreferences []string    `yaml:"curvePreferences,omitempty"`
+		HSTS             *HSTSConfig `yaml:"hsts,omitempty"`
+		OCSPStapling     *bool       `yaml:"ocspStapling,omitempty"`
+	}
+
+	// HSTSConfig controls the Strict-Transport-Security header. MaxAge is in seconds.
+	HSTSConfig struct {
+		MaxAge            int  `yaml:"maxAge"`
+		IncludeSubDomains bool `yaml:"includeSubDomains,omitempty"`
+		Preload           bool `yaml:"preload,omitempty"`
+	}
+)
+
+// Merge returns a copy of the global config with the fields set in override
+// taking precedence. Either argument may be nil.
+func (c *TLSConfig) Merge(override *TLSConfig) *TLSConfig {
+	merged := &TLSConfig{}
+	if c != nil {
+		*merged = *c
+	}
+
+	if override == nil {
+		return merged
+	}
+
+	if override.MinVersion != "" {
+		merged.MinVersion = override.MinVersion
+	}
+	if override.MaxVersion != "" {
+		merged.MaxVersion = override.MaxVersion
+	}
+	if len(override.CipherSuites) > 0 {
+		merged.CipherSuites = override.CipherSuites
+	}
+	if len(override.CurvePreferences) > 0 {
+		merged.CurvePreferences = override.CurvePreferences
+	}
+	if override.HSTS != nil {
+		merged.HSTS = override.HSTS
+	}
+	if override.OCSPStapling != nil {
+		merged.OCSPStapling = override.OCSPStapling
+	}
+
+	return merged
+}
@@ -0,0 +1,16 @@
+package models
+
+// TracingConfig exports OpenTelemetry traces to an OTLP collector. Protocol is
+// http (the default) or grpc. Endpoint is a host:port or a URL and defaults to
+// the collector's standard port on localhost. Sampler takes the OpenTelemetry
+// sampler names, defaulting to parentbased_always_on; SampleRatio applies to
+// the traceidratio samplers.
+type TracingConfig struct {
+	Endpoint    string            `yaml:"endpoint,omitempty"`
+	Protocol    string            `yaml:"protocol,omitempty"`
+	Insecure    bool              `yaml:"insecure,omitempty"`
+	Headers     map[string]string `yaml:"headers,omitempty"`
+	ServiceName string            `yaml:"serviceName,omitempty"`
+	Sampler     string            `yaml:"sampler,omitempty"`
+	SampleRatio float64           `yaml:"sampleRatio,omitempty"`
+}
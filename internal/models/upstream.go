@@ -0,0 +1,74 @@
+package models
+
+type (
+	// Timeouts limit how long routy waits on an upstream. Durations are in
+	// milliseconds; zero keeps the default.
+	Timeouts struct {
+		Dial           int `yaml:"dial,omitempty"`
+		TLSHandshake   int `yaml:"tlsHandshake,omitempty"`
+		ResponseHeader int `yaml:"responseHeader,omitempty"`
+		Idle           int `yaml:"idle,omitempty"`
+	}
+
+	// Retry retries idempotent requests that fail to connect or receive one
+	// of the Statuses. Attempts counts the first try. Budget caps retries as a
+	// fraction of requests to the path, and Backoff is the delay in
+	// milliseconds before the first retry, doubling after each one.
+	Retry struct {
+		Attempts int     `yaml:"attempts,omitempty"`
+		Statuses []int   `yaml:"statuses,omitempty"`
+		Budget   float64 `yaml:"budget,omitempty"`
+		Backoff  int     `yaml:"backoff,omitempty"`
+	}
+
+	// ConnectionPool limits the connections kept to upstreams. KeepAlive is
+	// the TCP keep-alive interval in milliseconds. The idle timeout is set
+	// with Timeouts.Idle.
+	ConnectionPool struct {
+		MaxIdleConns        int `yaml:"maxIdleConns,omitempty"`
+		MaxIdleConnsPerHost int `yaml:"maxIdleConnsPerHost,omitempty"`
+		MaxConnsPerHost     int `yaml:"maxConnsPerHost,omitempty"`
+		KeepAlive           int `yaml:"keepAlive,omitempty"`
+	}
+
+	// CircuitBreaker stops sending requests to an upstream after Failures
+	// consecutive errors. It stays open for OpenFor milliseconds and then lets
+	// a single request through to probe the upstream.
+	CircuitBreaker struct {
+		Failures int `yaml:"failures,omitempty"`
+		OpenFor  int `yaml:"openFor,omitempty"`
+	}
+
+	// Mirror sends a copy of Percent of a path's requests, all of them by
+	// default, to Target and discards the answers. Bodies larger than
+	// BodyLimit bytes, 1MiB by default, are not mirrored. Timeout bounds each
+	// copy in milliseconds.
+	Mirror struct {
+		Target    string  `yaml:"target"`
+		Percent   float64 `yaml:"percent,omitempty"`
+		BodyLimit int64   `yaml:"bodyLimit,omitempty"`
+		Timeout   int     `yaml:"timeout,omitempty"`
+	}
+
+	// TrafficSplit spreads a path's requests over several upstreams. A request
+	// matching a target's Header or Cookie goes to that target; the others are
+	// divided by Weight, at random or by client address when Sticky is set.
+	TrafficSplit struct {
+		Sticky  bool          `yaml:"sticky,omitempty"`
+		Targets []SplitTarget `yaml:"targets"`
+	}
+
+	SplitTarget struct {
+		Target string      `yaml:"target"`
+		Weight int         `yaml:"weight,omitempty"`
+		Header *SplitMatch `yaml:"header,omitempty"`
+		Cookie *SplitMatch `yaml:"cookie,omitempty"`
+	}
+
+	// SplitMatch matches a header or cookie called Name. An empty Value
+	// matches any value.
+	SplitMatch struct {
+		Name  string `yaml:"name"`
+		Value string `yaml:"value,omitempty"`
+	}
+)
@@ -0,0 +1,173 @@
+package models
+
+import "encoding/json"
+
+const wafRulesFilename string = "wafRules.json"
+
+type (
+	// WAFConfig enables request inspection with the rules in wafRules.json.
+	// LogOnly logs every match without acting on it. BodyLimit is the number
+	// of body bytes inspected and defaults to 64KiB. ChallengeTTL is how long
+	// a passed challenge is remembered, in milliseconds.
+	WAFConfig struct {
+		Enabled      bool `yaml:"enabled,omitempty"`
+		LogOnly      bool `yaml:"logOnly,omitempty"`
+		BodyLimit    int  `yaml:"bodyLimit,omitempty"`
+		ChallengeTTL int  `yaml:"challengeTTL,omitempty"`
+	}
+
+	// WAFRule applies Action to requests matching all of its Conditions.
+	// Action is block, log or challenge.
+	WAFRule struct {
+		ID          string         `json:"id"`
+		Description string         `json:"description,omitempty"`
+		Action      string         `json:"action"`
+		Conditions  []WAFCondition `json:"conditions"`
+	}
+
+	// WAFCondition compares a part of the request with Value. Target is
+	// method, path, query, header or body; Name is the header name. Operator
+	// is regex, equals, contains, prefix, suffix, gt, lt or exists.
+	WAFCondition struct {
+		Target   string `json:"target"`
+		Name     string `json:"name,omitempty"`
+		Operator string `json:"operator"`
+		Value    string `json:"value,omitempty"`
+		Negate   bool   `json:"negate,omitempty"`
+	}
+)
+
+// GetWAFRules reads the rules from the data directory. When there are none
+// yet the starter rules are written there and returned.
+func GetWAFRules() ([]WAFRule, error) {
+	m, err := NewModel()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := m.getFileData(wafRulesFilename)
+	if err != nil {
+		if err.Error() != "file not found" {
+			return nil, err
+		}
+
+		data, err := json.MarshalIndent(StarterWAFRules, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+
+		if err := m.writeFile(wafRulesFilename, data); err != nil {
+			return nil, err
+		}
+
+		return StarterWAFRules, nil
+	}
+
+	var rules []WAFRule
+	if err := json.Unmarshal(res, &rules); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// StarterWAFRules catch common SQL injection, cross site scripting, path
+// traversal and scanner requests.
+var StarterWAFRules = []WAFRule{
+	{
+		ID:          "sqli-union-select",
+		Description: "SQL injection using UNION SELECT",
+		Action:      "block",
+		Conditions: []WAFCondition{
+			{Target: "query", Operator: "regex", Value: `(?i)\bunion\b[\s(/*]+(all[\s(/*]+)?select\b`},
+		},
+	},
+	{
+		ID:          "sqli-union-select-body",
+		Description: "SQL injection using UNION SELECT in the body",
+		Action:      "block",
+		Conditions: []WAFCondition{
+			{Target: "body", Operator: "regex", Value: `(?i)\bunion\b[\s(/*]+(all[\s(/*]+)?select\b`},
+		},
+	},
+	{
+		ID:          "sqli-tautology",
+		Description: "SQL injection using an always true comparison",
+		Action:      "block",
+		Conditions: []WAFCondition{
+			{Target: "query", Operator: "regex", Value: `(?i)['"]\s*(or|and)\s+['"]?\w+['"]?\s*=\s*['"]?\w+`},
+		},
+	},
+	{
+		ID:          "sqli-functions",
+		Description: "SQL injection using time based or schema functions",
+		Action:      "block",
+		Conditions: []WAFCondition{
+			{Target: "query", Operator: "regex", Value: `(?i)\b(sleep|benchmark|pg_sleep|waitfor\s+delay)\b\s*[('"]|\binformation_schema\b`},
+		},
+	},
+	{
+		ID:          "sqli-stacked",
+		Description: "SQL injection with a stacked destructive statement",
+		Action:      "block",
+		Conditions: []WAFCondition{
+			{Target: "query", Operator: "regex", Value: `(?i);\s*(drop|truncate|alter|delete\s+from|insert\s+into|update\s+\w+\s+set)\b`},
+		},
+	},
+	{
+		ID:          "xss-script",
+		Description: "Cross site scripting with script tags, event handlers or javascript URLs",
+		Action:      "block",
+		Conditions: []WAFCondition{
+			{Target: "query", Operator: "regex", Value: `(?i)<\s*script\b|<[^>]+\bon[a-z]+\s*=|javascript\s*:|<\s*(iframe|object|embed)\b`},
+		},
+	},
+	{
+		ID:          "xss-script-body",
+		Description: "Cross site scripting in the body",
+		Action:      "log",
+		Conditions: []WAFCondition{
+			{Target: "body", Operator: "regex", Value: `(?i)<\s*script\b|<[^>]+\bon[a-z]+\s*=|javascript\s*:`},
+		},
+	},
+	{
+		ID:          "path-traversal",
+		Description: "Path traversal outside the document root",
+		Action:      "block",
+		Conditions: []WAFCondition{
+			{Target: "path", Operator: "regex", Value: `(^|[/\\])\.\.([/\\]|$)`},
+		},
+	},
+	{
+		ID:          "path-traversal-query",
+		Description: "Path traversal or system files in the query",
+		Action:      "block",
+		Conditions: []WAFCondition{
+			{Target: "query", Operator: "regex", Value: `(?i)\.\.[/\\]|/etc/(passwd|shadow)|\b(boot|win)\.ini\b`},
+		},
+	},
+	{
+		ID:          "sensitive-files",
+		Description: "Probes for repository, environment and backup files",
+		Action:      "block",
+		Conditions: []WAFCondition{
+			{Target: "path", Operator: "regex", Value: `(?i)/(\.git|\.svn|\.hg)(/|$)|/\.env(\.|$)|/\.ht(access|passwd)$|\.(bak|sql|swp)$`},
+		},
+	},
+	{
+		ID:          "scanner-user-agent",
+		Description: "Known vulnerability scanners",
+		Action:      "block",
+		Conditions: []WAFCondition{
+			{Target: "header", Name: "User-Agent", Operator: "regex", Value: `(?i)\b(sqlmap|nikto|nmap|masscan|zgrab|wpscan|acunetix|nessus|nuclei|dirbuster|gobuster|ffuf|havij|w3af)\b`},
+		},
+	},
+	{
+		ID:          "missing-user-agent",
+		Description: "Clients that send no user agent",
+		Action:      "log",
+		Conditions: []WAFCondition{
+			{Target: "header", Name: "User-Agent", Operator: "exists", Negate: true},
+		},
+	},
+}
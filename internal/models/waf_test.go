@@ -0,0 +1,44 @@
+package models
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetWAFRules(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("ROUTY_DATA_DIR", tmp)
+
+	rules, err := GetWAFRules()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rules) != len(StarterWAFRules) {
+		t.Fatalf("rule count = %d, want the %d starter rules", len(rules), len(StarterWAFRules))
+	}
+
+	// the starter rules are written out to be edited
+	custom := []WAFRule{{ID: "no-trace", Action: "block", Conditions: []WAFCondition{{Target: "method", Operator: "equals", Value: "TRACE"}}}}
+	data, err := json.Marshal(custom)
+	if err != nil {
+		t.Fatalf("marshal rules: %v", err)
+	}
+
+	file := filepath.Join(tmp, wafRulesFilename)
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("starter rules were not written: %v", err)
+	}
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+
+	rules, err = GetWAFRules()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rules) != 1 || rules[0].ID != "no-trace" {
+		t.Fatalf("rules = %+v, want the edited rules", rules)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
@@ -12,6 +13,14 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+
+		return
+	}
+
 	r, err := handlers.NewRouty()
 	if err != nil {
 		log.Fatalf("Error creating new Routy: %s", err)
@@ -30,10 +39,43 @@ func main() {
 			Message: msg,
 		}
 
-		time.Sleep(2 * time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		if err := r.Shutdown(ctx); err != nil {
+			r.EventLog <- logging.EventLogMessage{
+				Level:   "ERROR",
+				Caller:  "shutdown()->r.Shutdown()",
+				Message: err.Error(),
+			}
+		}
+
+		<-ctx.Done()
 		os.Exit(0)
 	}()
 
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+
+	go func() {
+		for range reloadChan {
+			if err := r.Reload(); err != nil {
+				r.EventLog <- logging.EventLogMessage{
+					Level:   "ERROR",
+					Caller:  "reload()->r.Reload()",
+					Message: err.Error(),
+				}
+				continue
+			}
+
+			r.EventLog <- logging.EventLogMessage{
+				Level:   "INFO",
+				Caller:  "reload()",
+				Message: "Reloaded traffic splits",
+			}
+		}
+	}()
+
 	msg := "Application is running..."
 	r.EventLog <- logging.EventLogMessage{
 		Level:   "INFO",